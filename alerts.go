@@ -1,19 +1,160 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 var (
 	alertFolder = "alerts"
+	alertTiers  []AlertTiers
 )
 
-func getAlertSound(channel string) (*os.File, bool) {
+// AlertTiers maps tip amounts to alerts for a channel, "*" applies to channels without their own entry
+type AlertTiers struct {
+	Channel string      `json:"channel"`
+	Tiers   []AlertTier `json:"tiers"`
+}
+
+// AlertTier is used for tips of at least MinCents, the highest tier a tip reaches wins
+type AlertTier struct {
+	MinCents  int    `json:"min_cents"`
+	Alert     string `json:"alert"`     // Subfolder or .mp3 file in alerts/<channel>, empty for the channel's folder
+	Voice     string `json:"voice"`     // Voice for the message, empty keeps the source's voice
+	Modifiers string `json:"modifiers"` // Modifiers for the whole message, e.g. "reverb,pitch:+4"
+	Template  string `json:"template"`  // Replaces the source's template
+
+	modifiers []AudioModifier
+}
+
+func setupAlertTiers() {
+	alertTiers = nil
+	tiers := getSetting("ALERT_TIERS")
+	if tiers == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(tiers), &alertTiers)
+	if err != nil {
+		logger("Error unmarshalling alert tiers: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range alertTiers {
+		alertTiers[i].Channel = strings.ToLower(alertTiers[i].Channel)
+		for j := range alertTiers[i].Tiers {
+			tier := &alertTiers[i].Tiers[j]
+			tier.modifiers = parseModifierList(tier.Modifiers, alertTiers[i].Channel)
+		}
+		// Highest threshold first so the first match is the best tier
+		sort.Slice(alertTiers[i].Tiers, func(a, b int) bool {
+			return alertTiers[i].Tiers[a].MinCents > alertTiers[i].Tiers[b].MinCents
+		})
+	}
+}
+
+// getAlertTier returns the highest tier a tip reaches
+// Channels without configured tiers use numbered subfolders instead, e.g. alerts/<channel>/20 for tips of 20 or more
+func getAlertTier(channel string, amountCents int) (AlertTier, bool) {
+	var fallback *AlertTiers
+	channelTiers := readConfig(&alertTiers)
+	for i, tiers := range channelTiers {
+		if tiers.Channel == strings.ToLower(channel) {
+			fallback = &channelTiers[i]
+			break
+		}
+		if tiers.Channel == "*" {
+			fallback = &channelTiers[i]
+		}
+	}
+	if fallback != nil {
+		for _, tier := range fallback.Tiers {
+			if amountCents >= tier.MinCents {
+				return tier, true
+			}
+		}
+		return AlertTier{}, false
+	}
+
+	files, err := os.ReadDir(fmt.Sprintf("%s/%s", alertFolder, channel))
+	if err != nil {
+		return AlertTier{}, false
+	}
+	best := -1
+	var tier AlertTier
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		threshold, err := strconv.ParseFloat(file.Name(), 64)
+		if err != nil {
+			continue
+		}
+		// Round so folders like 0.29 aren't cut down to 28 cents by float error
+		minCents := int(math.Round(threshold * 100))
+		if amountCents >= minCents && minCents > best {
+			best = minCents
+			tier = AlertTier{MinCents: minCents, Alert: file.Name()}
+		}
+	}
+	return tier, best >= 0
+}
+
+// applyAlertTier picks the tier for a tip, sets its alert and voice on the message and returns the text to read out
+// The tier's template replaces the given one before the replacements are filled in
+func applyAlertTier(msg *Message, amountCents int, template string, replacements []string) string {
+	tier, found := getAlertTier(msg.Channel, amountCents)
+	if found {
+		logger(fmt.Sprintf("Using alert tier for %d and up", tier.MinCents), logDebug, msg.Channel)
+		msg.Alert = tier.Alert
+		if tier.Voice != "" {
+			msg.DefaultVoice = tier.Voice
+		}
+		if tier.Template != "" {
+			template = tier.Template
+		}
+	}
+
+	text := strings.TrimSpace(strings.NewReplacer(replacements...).Replace(template))
+	if text == "" {
+		return ""
+	}
+	var tags []string
+	for _, modifier := range tier.modifiers {
+		tags = append(tags, "("+modifier.String()+")")
+	}
+	if len(tags) > 0 {
+		text = strings.Join(tags, " ") + " " + text
+	}
+	return text
+}
+
+// getAlertSound picks an alert for a channel
+// alert is a subfolder or .mp3 file in the channel's alert folder, empty picks from the folder itself
+func getAlertSound(channel string, alert string) (*os.File, bool) {
 	var alertSounds []string
 	channelAlertsFolder := fmt.Sprintf("%s/%s", alertFolder, channel)
+	if alert != "" {
+		// Keep tiers from pointing outside the channel's folder
+		alertPath := filepath.Join(channelAlertsFolder, filepath.Clean("/"+alert))
+		info, err := os.Stat(alertPath)
+		if err == nil && !info.IsDir() {
+			alertSound, err := os.Open(alertPath)
+			if err == nil {
+				return alertSound, true
+			}
+		}
+		if err == nil && info.IsDir() {
+			channelAlertsFolder = alertPath
+		} else {
+			logger("Alert "+alert+" not found, using the channel's alerts", logError, channel)
+		}
+	}
 	//check if alert folder exists and if so get all .mp3 files in it
 	if _, err := os.Stat(channelAlertsFolder); err == nil {
 		files, err := os.ReadDir(channelAlertsFolder)
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetAlertTierFolders(t *testing.T) {
+	oldFolder, oldTiers := alertFolder, alertTiers
+	t.Cleanup(func() { alertFolder, alertTiers = oldFolder, oldTiers })
+	alertFolder = t.TempDir()
+	alertTiers = nil
+
+	for _, name := range []string{"0.29", "1.1", "5", "20", "sounds"} {
+		if err := os.MkdirAll(filepath.Join(alertFolder, "streamer", name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		amountCents int
+		wantAlert   string
+		wantCents   int
+		found       bool
+	}{
+		{amountCents: 28},
+		{amountCents: 29, wantAlert: "0.29", wantCents: 29, found: true},
+		{amountCents: 109, wantAlert: "0.29", wantCents: 29, found: true},
+		{amountCents: 110, wantAlert: "1.1", wantCents: 110, found: true},
+		{amountCents: 500, wantAlert: "5", wantCents: 500, found: true},
+		{amountCents: 1999, wantAlert: "5", wantCents: 500, found: true},
+		{amountCents: 100000, wantAlert: "20", wantCents: 2000, found: true},
+	}
+
+	for _, test := range tests {
+		tier, found := getAlertTier("streamer", test.amountCents)
+		if found != test.found || tier.Alert != test.wantAlert || tier.MinCents != test.wantCents {
+			t.Errorf("getAlertTier(%d) = %+v, %v, want alert %q at %d cents, %v", test.amountCents, tier, found, test.wantAlert, test.wantCents, test.found)
+		}
+	}
+}
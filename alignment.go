@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+var (
+	alignmentEnabled bool
+)
+
+// WordTiming is when a word is spoken, in seconds from the start of its audio
+type WordTiming struct {
+	Word  string  `json:"word"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// AlignedProvider is implemented by providers that can return word timings with the audio
+type AlignedProvider interface {
+	GenerateWithAlignment(request Request) ([]byte, []WordTiming, error)
+}
+
+// characterAlignment is the per-character timing returned by ElevenLabs
+type characterAlignment struct {
+	Characters []string  `json:"characters"`
+	Starts     []float64 `json:"character_start_times_seconds"`
+	Ends       []float64 `json:"character_end_times_seconds"`
+}
+
+func setupAlignment() {
+	alignmentEnabled = strings.ToLower(getSetting("CAPTION_ALIGNMENT")) == "true"
+	if alignmentEnabled {
+		logger("Word-level caption alignment enabled", logInfo, "Universal")
+	}
+}
+
+// wordsFromAlignment groups character timings into words split on whitespace
+func wordsFromAlignment(alignment characterAlignment) []WordTiming {
+	var words []WordTiming
+	var current *WordTiming
+	for i, char := range alignment.Characters {
+		if i >= len(alignment.Starts) || i >= len(alignment.Ends) {
+			break
+		}
+		if strings.TrimSpace(char) == "" {
+			current = nil
+			continue
+		}
+		if current == nil {
+			words = append(words, WordTiming{Start: alignment.Starts[i]})
+			current = &words[len(words)-1]
+		}
+		current.Word += char
+		current.End = alignment.Ends[i]
+	}
+	return words
+}
+
+// estimateWordTimings spreads words over the audio duration by their length
+// Used for providers and cached clips that have no real alignment
+func estimateWordTimings(text string, duration float64) []WordTiming {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || duration <= 0 {
+		return nil
+	}
+
+	// Weight each word by its letters plus one for the gap after it
+	total := 0
+	weights := make([]int, len(fields))
+	for i, word := range fields {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) {
+				weights[i]++
+			}
+		}
+		weights[i]++
+		total += weights[i]
+	}
+
+	var words []WordTiming
+	position := 0.0
+	for i, word := range fields {
+		length := duration * float64(weights[i]) / float64(total)
+		words = append(words, WordTiming{Word: word, Start: position, End: position + length})
+		position += length
+	}
+	return words
+}
+
+// shiftWordTimings moves and stretches word timings, e.g. after a tempo change or when segments are joined
+func shiftWordTimings(words []WordTiming, offset float64, scale float64) []WordTiming {
+	shifted := make([]WordTiming, len(words))
+	for i, word := range words {
+		shifted[i] = WordTiming{
+			Word:  word.Word,
+			Start: offset + word.Start*scale,
+			End:   offset + word.End*scale,
+		}
+	}
+	return shifted
+}
@@ -5,8 +5,6 @@ import (
 	"encoding/json"
 	"html/template"
 	"net/http"
-	"os"
-	"slices"
 	"sort"
 	"strings"
 )
@@ -38,13 +36,26 @@ func handleApp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleAPIVoices returns voices as JSON for the SPA
+// handleAPIVoices returns voices as JSON for the SPA, using the channel's catalog when ?channel= is given
 func handleAPIVoices(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	w.Header().Set("Content-Type", "application/json")
+	channel := strings.ToLower(r.URL.Query().Get("channel"))
 
 	var voiceList []VoiceData
-	for _, v := range voices {
+	seen := make(map[string]bool)
+	for _, v := range channelVoices(channel) {
+		// A channel's own voice hides a global voice with the same name
+		if seen[strings.ToLower(v.Name)] {
+			continue
+		}
+		seen[strings.ToLower(v.Name)] = true
+		if getVoiceProvider(v.ID, channel).Name() != elevenLabsProviderName {
+			voiceList = append(voiceList, VoiceData{
+				Name: v.Name,
+			})
+			continue
+		}
 		voiceInfo, err := ttsClient.GetVoice(ctx, v.ID)
 		if err != nil {
 			continue
@@ -63,29 +74,33 @@ func handleAPIVoices(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(voiceList)
 }
 
-// handleAPIEffects returns effects as JSON for the SPA
+// handleAPIEffects returns effect names as JSON for the SPA
 func handleAPIEffects(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	var effects []string
-
-	if _, err := os.Stat(effectFolder); err != nil {
-		json.NewEncoder(w).Encode(effects)
-		return
+	effects := []string{}
+	for _, effect := range listAvailableEffects(strings.ToLower(r.URL.Query().Get("channel"))) {
+		effects = append(effects, effect.Name)
 	}
+	json.NewEncoder(w).Encode(effects)
+}
 
-	files, err := os.ReadDir(effectFolder)
-	if err != nil {
-		json.NewEncoder(w).Encode(effects)
+// handleAPIEffectInfo returns effects with their metadata as JSON for the SPA
+// With all=true and the global key it includes disabled and channel only effects for managing the library
+func handleAPIEffectInfo(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("all") == "true" {
+		if !requireAdminAuth(w, r, r.FormValue("key")) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listAllEffects())
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".mp3") {
-			effects = append(effects, strings.TrimSuffix(file.Name(), ".mp3"))
-		}
+	list := listAvailableEffects(strings.ToLower(r.URL.Query().Get("channel")))
+	if list == nil {
+		list = []*Effect{}
 	}
-
-	slices.Sort(effects)
-	json.NewEncoder(w).Encode(effects)
+	json.NewEncoder(w).Encode(list)
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	approvalRules   []ApprovalRule
+	pendingMessages = make(map[string]*PendingMessage)
+	pendingMutex    = sync.Mutex{}
+
+	// maxPendingMessages caps messages per channel that wait forever, 0 for unlimited
+	maxPendingMessages = 50
+
+	errPendingNotFound = errors.New("pending message not found")
+	errPendingFull     = errors.New("too many messages waiting for approval")
+	errEditRejected    = errors.New("edited message rejected by moderation")
+)
+
+// pendingRetryDelay is how long a message waits before auto-approving again after queueing it failed
+const pendingRetryDelay = 30 * time.Second
+
+// ApprovalRule decides which messages on a channel wait for a moderator before they are queued
+type ApprovalRule struct {
+	Channel       string   `json:"channel"`
+	HoldAPI       bool     `json:"api"`             // Hold every /tts message
+	HoldChat      bool     `json:"chat"`            // Hold every Twitch chat command
+	PallyMinCents int      `json:"pally_min_cents"` // Hold tips from any donation source of at least this amount, 0 never holds them
+	Timeout       int      `json:"timeout_seconds"` // Approve automatically after this many seconds, 0 waits forever
+	Trusted       []string `json:"trusted"`         // Usernames that are never held
+}
+
+// PendingMessage is a message waiting for a moderator
+type PendingMessage struct {
+	ID       string           `json:"id"`
+	Channel  string           `json:"channel"`
+	Source   string           `json:"source"`
+	User     string           `json:"user"`
+	Amount   int              `json:"amount_cents,omitempty"`
+	Text     string           `json:"text"`
+	Segments []PendingSegment `json:"segments"`
+	Received time.Time        `json:"received"`
+	Expires  *time.Time       `json:"expires,omitempty"`
+	Message  Message          `json:"-"`
+
+	timer *time.Timer
+}
+
+// PendingSegment is the parsed breakdown of a pending message shown to moderators
+type PendingSegment struct {
+	Text      string   `json:"text,omitempty"`
+	Voice     string   `json:"voice,omitempty"`
+	Modifiers []string `json:"modifiers,omitempty"`
+	Effect    string   `json:"effect,omitempty"`
+}
+
+type PendingResponse struct {
+	ID     string `json:"pending_id"`
+	Status string `json:"status"`
+}
+
+func setupApproval() {
+	approvalRules = nil
+	rules := getSetting("APPROVAL_RULES")
+	if rules == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(rules), &approvalRules)
+	if err != nil {
+		logger("Error unmarshalling approval rules: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range approvalRules {
+		approvalRules[i].Channel = strings.ToLower(approvalRules[i].Channel)
+	}
+}
+
+// setupPendingLimit reads PENDING_MAX_MESSAGES, which is only read at startup
+func setupPendingLimit() {
+	maxPending := getSetting("PENDING_MAX_MESSAGES")
+	if maxPending == "" {
+		return
+	}
+	limit, err := strconv.Atoi(maxPending)
+	if err != nil || limit < 0 {
+		logger("Invalid PENDING_MAX_MESSAGES, using default of "+strconv.Itoa(maxPendingMessages), logError, "Universal")
+		return
+	}
+	maxPendingMessages = limit
+}
+
+func getApprovalRule(channel string) (ApprovalRule, bool) {
+	for _, rule := range readConfig(&approvalRules) {
+		if rule.Channel == channel {
+			return rule, true
+		}
+	}
+	return ApprovalRule{}, false
+}
+
+// shouldHold reports whether a message needs approval before it is queued
+// forced is set when the sender asked for the message to be held, e.g. for channel point redemptions
+func shouldHold(channel string, source string, user string, amountCents int, forced bool) bool {
+	rule, exists := getApprovalRule(channel)
+	for _, trusted := range rule.Trusted {
+		if user != "" && strings.EqualFold(trusted, user) {
+			return false
+		}
+	}
+	if forced {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	switch source {
+	case sourcePally, sourceKofi, sourceStreamElements, sourceStreamlabs:
+		return rule.PallyMinCents > 0 && amountCents >= rule.PallyMinCents
+	case sourceTwitch:
+		return rule.HoldChat
+	case sourceEventSub:
+		// Twitch events are only held when their event template asks for it
+		return false
+	default:
+		return rule.HoldAPI
+	}
+}
+
+// describeSegments converts parsed segments into the breakdown shown on the moderation page
+func describeSegments(segments []AudioSegment) []PendingSegment {
+	described := []PendingSegment{}
+	for _, segment := range segments {
+		pending := PendingSegment{
+			Text:   segment.Text,
+			Voice:  segment.VoiceName,
+			Effect: segment.Effect,
+		}
+		for _, modifier := range segment.Modifiers {
+			pending.Modifiers = append(pending.Modifiers, modifier.String())
+		}
+		described = append(described, pending)
+	}
+	return described
+}
+
+// holdMessage stores a message until a moderator approves or rejects it
+func holdMessage(msg Message, source string, user string, amountCents int) (*PendingMessage, error) {
+	segments, err := ParseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.JobID == "" {
+		msg.JobID = generateJobID()
+	}
+	pending := &PendingMessage{
+		ID:       msg.JobID,
+		Channel:  msg.Channel,
+		Source:   source,
+		User:     user,
+		Amount:   amountCents,
+		Text:     msg.Text,
+		Segments: describeSegments(segments),
+		Received: time.Now(),
+		Message:  msg,
+	}
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	// Messages without a timeout are never approved on their own, so only so many may wait at once
+	if rule, ok := getApprovalRule(msg.Channel); ok && rule.Timeout > 0 {
+		armPendingTimer(pending, time.Duration(rule.Timeout)*time.Second)
+	} else if maxPendingMessages > 0 && countWaitingForever(msg.Channel) >= maxPendingMessages {
+		return nil, errPendingFull
+	}
+	pendingMessages[pending.ID] = pending
+
+	logger(fmt.Sprintf("Holding %s message from %s for approval: %s", source, user, msg.Text), logInfo, msg.Channel)
+	return pending, nil
+}
+
+// countWaitingForever counts a channel's pending messages that have no auto-approve timer, pendingMutex must be held
+func countWaitingForever(channel string) int {
+	count := 0
+	for _, pending := range pendingMessages {
+		if pending.Channel == channel && pending.Expires == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// armPendingTimer auto-approves a pending message after the delay, pendingMutex must be held
+func armPendingTimer(pending *PendingMessage, delay time.Duration) {
+	expires := time.Now().Add(delay)
+	pending.Expires = &expires
+	pending.timer = time.AfterFunc(delay, func() {
+		logger("Auto-approving pending message "+getAudioDataName(pending.ID), logInfo, pending.Channel)
+		if _, err := approvePending(pending.Channel, pending.ID, ""); err != nil {
+			logger("Error auto-approving pending message: "+err.Error(), logError, pending.Channel)
+		}
+	})
+}
+
+// takePending removes a pending message so only one moderator action applies to it
+func takePending(channel string, id string) (*PendingMessage, bool) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pending, ok := pendingMessages[id]
+	if !ok || pending.Channel != channel {
+		return nil, false
+	}
+	delete(pendingMessages, id)
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	return pending, true
+}
+
+// restorePending puts a message back when approving it failed, re-arming its
+// auto-approve timer so it is retried instead of staying pending forever
+func restorePending(pending *PendingMessage) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if pending.Expires != nil {
+		delay := time.Until(*pending.Expires)
+		if delay < pendingRetryDelay {
+			delay = pendingRetryDelay
+		}
+		armPendingTimer(pending, delay)
+	}
+	pendingMessages[pending.ID] = pending
+}
+
+// approvePending queues a pending message, replacing its text first if the moderator edited it
+func approvePending(channel string, id string, text string) (*QueueJob, error) {
+	pending, ok := takePending(channel, id)
+	if !ok {
+		return nil, errPendingNotFound
+	}
+
+	// Edited text goes through the same checks as a new message, and the original stays pending if it fails them
+	msg := pending.Message
+	if text != "" && text != msg.Text {
+		moderation := moderateMessage(channel, text, pending.Source)
+		if moderation.Rejected {
+			restorePending(pending)
+			return nil, errEditRejected
+		}
+		msg.Text = moderation.Text
+		segments, err := ParseMessage(msg)
+		if err != nil {
+			restorePending(pending)
+			return nil, err
+		}
+		if _, err := applyMessageLimits(channel, segments, false); err != nil {
+			restorePending(pending)
+			return nil, err
+		}
+	}
+
+	job, _, err := enqueueMessage(msg)
+	if err != nil {
+		restorePending(pending)
+		return nil, err
+	}
+	logger("Approved pending message "+getAudioDataName(pending.ID), logInfo, channel)
+	return job, nil
+}
+
+// rejectPending drops a pending message and logs it for review
+func rejectPending(channel string, id string) bool {
+	pending, ok := takePending(channel, id)
+	if !ok {
+		return false
+	}
+	recordModeration(ModerationEntry{
+		Time:    time.Now(),
+		Channel: channel,
+		Source:  pending.Source,
+		Action:  moderationReject,
+		Matches: []string{"rejected by moderator"},
+		Text:    pending.Text,
+	})
+	return true
+}
+
+// getPendingMessages copies the pending messages of a channel so a re-armed timer can't race the encoder
+func getPendingMessages(channel string) []PendingMessage {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	list := []PendingMessage{}
+	for _, pending := range pendingMessages {
+		if pending.Channel == channel {
+			list = append(list, *pending)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Received.Before(list[j].Received)
+	})
+	return list
+}
+
+// handlePendingList returns the messages waiting for approval on a channel
+func handlePendingList(w http.ResponseWriter, r *http.Request) {
+	channel := strings.ToLower(r.FormValue("channel"))
+	if channel == "" {
+		http.Error(w, "Missing channel", http.StatusBadRequest)
+		return
+	}
+	if !requireChannelAuth(w, r, channel, r.FormValue("key")) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getPendingMessages(channel))
+}
+
+// handlePendingAction approves or rejects a pending message
+func handlePendingAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	channel := strings.ToLower(r.FormValue("channel"))
+	if channel == "" {
+		http.Error(w, "Missing channel", http.StatusBadRequest)
+		return
+	}
+	if !requireChannelAuth(w, r, channel, r.FormValue("key")) {
+		return
+	}
+
+	switch vars["action"] {
+	case "approve":
+		job, err := approvePending(channel, vars["id"], strings.TrimSpace(r.FormValue("text")))
+		if err != nil {
+			if errors.Is(err, errPendingNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+			} else if errors.Is(err, errQueueFull) {
+				http.Error(w, "Queue is full, try again later", http.StatusServiceUnavailable)
+			} else if errors.Is(err, errEditRejected) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			} else if errors.Is(err, errMessageTooLong) {
+				http.Error(w, "Message is too long", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PendingResponse{ID: job.ID, Status: "approved"})
+	case "reject":
+		if !rejectPending(channel, vars["id"]) {
+			http.Error(w, errPendingNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PendingResponse{ID: vars["id"], Status: "rejected"})
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+	}
+}
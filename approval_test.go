@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// usePending starts a test with no pending messages and no approval rules
+func usePending(t *testing.T) {
+	t.Helper()
+	pendingMutex.Lock()
+	oldPending, oldMax := pendingMessages, maxPendingMessages
+	pendingMessages = make(map[string]*PendingMessage)
+	pendingMutex.Unlock()
+	configMutex.Lock()
+	oldRules := approvalRules
+	approvalRules = nil
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		pendingMutex.Lock()
+		for _, pending := range pendingMessages {
+			if pending.timer != nil {
+				pending.timer.Stop()
+			}
+		}
+		pendingMessages, maxPendingMessages = oldPending, oldMax
+		pendingMutex.Unlock()
+		configMutex.Lock()
+		approvalRules = oldRules
+		configMutex.Unlock()
+	})
+}
+
+func TestHoldMessageCap(t *testing.T) {
+	usePending(t)
+	maxPendingMessages = 2
+
+	hold := func(channel string, id string) error {
+		_, err := holdMessage(Message{Channel: channel, Text: "hello", JobID: id}, sourceAPI, "viewer", 0)
+		return err
+	}
+	for _, id := range []string{"1", "2"} {
+		if err := hold("streamer", id); err != nil {
+			t.Fatalf("holding message %s: %v", id, err)
+		}
+	}
+	if err := hold("streamer", "3"); !errors.Is(err, errPendingFull) {
+		t.Fatalf("got error %v, want %v", err, errPendingFull)
+	}
+	if err := hold("other", "4"); err != nil {
+		t.Fatalf("cap on one channel held back another: %v", err)
+	}
+
+	// Messages that approve themselves don't count towards the cap
+	configMutex.Lock()
+	approvalRules = []ApprovalRule{{Channel: "streamer", Timeout: 3600}}
+	configMutex.Unlock()
+	if err := hold("streamer", "5"); err != nil {
+		t.Fatalf("holding a message with a timeout: %v", err)
+	}
+
+	if !rejectPending("streamer", "1") {
+		t.Fatal("couldn't reject a pending message")
+	}
+	configMutex.Lock()
+	approvalRules = nil
+	configMutex.Unlock()
+	if err := hold("streamer", "6"); err != nil {
+		t.Fatalf("holding a message after one was rejected: %v", err)
+	}
+}
+
+func TestApprovePendingChecksEdits(t *testing.T) {
+	usePending(t)
+	// Registered first so they run after t.Setenv has restored the environment
+	t.Cleanup(setupModeration)
+	t.Cleanup(setupMessageLimits)
+	t.Setenv("MODERATION_RULES", `[{"channel": "*", "words": ["badword"], "action": "reject"}]`)
+	t.Setenv("MESSAGE_LIMITS", `[{"channel": "*", "max_characters": 20, "policy": "reject"}]`)
+	setupModeration()
+	setupMessageLimits()
+
+	if _, err := holdMessage(Message{Channel: "streamer", Text: "hello", JobID: "edit-1"}, sourceAPI, "viewer", 0); err != nil {
+		t.Fatalf("holding message: %v", err)
+	}
+
+	tests := []struct {
+		text string
+		want error
+	}{
+		{"hello b4dw0rd", errEditRejected},
+		{"this edit is far longer than twenty characters", errMessageTooLong},
+	}
+	for _, test := range tests {
+		if _, err := approvePending("streamer", "edit-1", test.text); !errors.Is(err, test.want) {
+			t.Errorf("approving %q: got error %v, want %v", test.text, err, test.want)
+		}
+		pending := getPendingMessages("streamer")
+		if len(pending) != 1 || pending[0].Message.Text != "hello" {
+			t.Fatalf("approving %q: message wasn't kept pending unchanged: %+v", test.text, pending)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var (
+	channelKeys []ChannelKey
+)
+
+type ChannelKey struct {
+	Channel string `json:"channel"`
+	Key     string `json:"key"`
+}
+
+func setupChannelKeys() {
+	channelKeys = nil
+	keys := getSetting("TTS_CHANNEL_KEYS")
+	if keys == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(keys), &channelKeys)
+	if err != nil {
+		logger("Error unmarshalling channel keys: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range channelKeys {
+		channelKeys[i].Channel = strings.ToLower(channelKeys[i].Channel)
+	}
+}
+
+// keysMatch compares two keys in constant time
+func keysMatch(provided string, expected string) bool {
+	if provided == "" || expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) == 1
+}
+
+// authorizeChannel checks a key against the global TTS_KEY and the keys for the channel
+// Keys belonging to other channels are never accepted
+func authorizeChannel(channel string, key string) bool {
+	authorized := keysMatch(key, ttsKey)
+	for _, channelKey := range readConfig(&channelKeys) {
+		if channelKey.Channel == channel && keysMatch(key, channelKey.Key) {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// requireChannelAuth writes a 401 and logs the attempt if the key is not valid for the channel
+func requireChannelAuth(w http.ResponseWriter, r *http.Request, channel string, key string) bool {
+	if authorizeChannel(channel, key) {
+		return true
+	}
+	logger("Unauthorized request to "+r.URL.Path+" from "+r.RemoteAddr, logInfo, channel)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// requireAdminAuth writes a 401 unless the key is the global TTS_KEY, for changes that affect every channel
+func requireAdminAuth(w http.ResponseWriter, r *http.Request, key string) bool {
+	if keysMatch(key, ttsKey) {
+		return true
+	}
+	logger("Unauthorized request to "+r.URL.Path+" from "+r.RemoteAddr, logInfo, "Universal")
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
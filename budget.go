@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	budgets       []BudgetConfig
+	budgetReserve int
+	budgetFile    = "budgets.json"
+	budgetUsage   = make(map[string]*BudgetUsage)
+	budgetMutex   = sync.Mutex{}
+
+	// Characters left on the ElevenLabs account, -1 until it has been checked
+	elevenRemaining  int64 = -1
+	elevenCheckedAt  time.Time
+	elevenCheckMutex = sync.Mutex{}
+
+	errBudgetExceeded = errors.New("character budget exhausted")
+)
+
+// Budget fallbacks
+const (
+	budgetReject    = "reject"
+	budgetDowngrade = "downgrade"
+	budgetLocal     = "local"
+)
+
+// BudgetConfig caps how many ElevenLabs characters a channel may use, "*" applies to channels without their own entry
+type BudgetConfig struct {
+	Channel        string `json:"channel"`
+	Daily          int    `json:"daily"`           // 0 for no daily cap
+	Monthly        int    `json:"monthly"`         // 0 for no monthly cap
+	Fallback       string `json:"fallback"`        // reject, downgrade or local (default reject)
+	DowngradeModel string `json:"downgrade_model"` // ElevenLabs model used by downgrade (default eleven_flash_v2_5)
+	FallbackVoice  string `json:"fallback_voice"`  // Local voice used by local (default the first local voice)
+}
+
+// BudgetUsage is the characters a channel used in the current day and month
+type BudgetUsage struct {
+	Day     string `json:"day"`
+	Daily   int    `json:"daily"`
+	Month   string `json:"month"`
+	Monthly int    `json:"monthly"`
+}
+
+// BudgetStatus is shown on the usage page
+type BudgetStatus struct {
+	Channel      string `json:"channel"`
+	DailyUsed    int    `json:"daily_used"`
+	DailyLimit   int    `json:"daily_limit"`
+	MonthlyUsed  int    `json:"monthly_used"`
+	MonthlyLimit int    `json:"monthly_limit"`
+	Reserve      int    `json:"reserve"`
+	Fallback     string `json:"fallback"`
+	Exhausted    bool   `json:"exhausted"`
+}
+
+func setupBudgets() {
+	if file := getSetting("BUDGET_FILE"); file != "" {
+		budgetFile = file
+	}
+	setupBudgetLimits()
+
+	data, err := os.ReadFile(budgetFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger("Error reading budget file: "+err.Error(), logError, "Universal")
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &budgetUsage); err != nil {
+		logger("Error unmarshalling budget file: "+err.Error(), logError, "Universal")
+	}
+}
+
+// setupBudgetLimits reads the caps and reserve, the usage file is only read at startup
+func setupBudgetLimits() {
+	budgets = nil
+	budgetReserve = 0
+	if reserve := getSetting("BUDGET_RESERVE"); reserve != "" {
+		value, err := strconv.Atoi(reserve)
+		if err != nil || value < 0 {
+			logger("Invalid BUDGET_RESERVE, reserve disabled", logError, "Universal")
+		} else {
+			budgetReserve = value
+		}
+	}
+
+	config := getSetting("CHARACTER_BUDGETS")
+	if config != "" {
+		err := json.Unmarshal([]byte(config), &budgets)
+		if err != nil {
+			logger("Error unmarshalling character budgets: "+err.Error(), logError, "Universal")
+		}
+		for i := range budgets {
+			budgets[i].Channel = strings.ToLower(budgets[i].Channel)
+			budgets[i].Fallback = strings.ToLower(budgets[i].Fallback)
+			if budgets[i].Fallback == "" {
+				budgets[i].Fallback = budgetReject
+			}
+			if budgets[i].DowngradeModel == "" {
+				budgets[i].DowngradeModel = "eleven_flash_v2_5"
+			}
+		}
+	}
+}
+
+func getBudget(channel string) (BudgetConfig, bool) {
+	var fallback BudgetConfig
+	found := false
+	for _, budget := range readConfig(&budgets) {
+		if budget.Channel == channel {
+			return budget, true
+		}
+		if budget.Channel == "*" {
+			fallback = budget
+			found = true
+		}
+	}
+	fallback.Channel = channel
+	if fallback.Fallback == "" {
+		fallback.Fallback = budgetReject
+	}
+	return fallback, found
+}
+
+// currentUsage returns a channel's usage, resetting counters when a new day or month starts
+// Must be called with budgetMutex held
+func currentUsage(channel string, now time.Time) *BudgetUsage {
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+	usage, exists := budgetUsage[channel]
+	if !exists {
+		usage = &BudgetUsage{Day: day, Month: month}
+		budgetUsage[channel] = usage
+	}
+	if usage.Day != day {
+		usage.Day = day
+		usage.Daily = 0
+	}
+	if usage.Month != month {
+		usage.Month = month
+		usage.Monthly = 0
+	}
+	return usage
+}
+
+// getElevenRemaining returns the characters left on the ElevenLabs account, checked at most every five minutes
+func getElevenRemaining() (int64, bool) {
+	elevenCheckMutex.Lock()
+	defer elevenCheckMutex.Unlock()
+
+	if elevenKey == "" {
+		return 0, false
+	}
+	if elevenRemaining >= 0 && time.Since(elevenCheckedAt) < 5*time.Minute {
+		return elevenRemaining, true
+	}
+
+	clientData, err := ttsClient.GetUserInfo(context.Background())
+	if err != nil {
+		logger("Error getting user info for budget reserve: "+err.Error(), logError, "Universal")
+		return elevenRemaining, elevenRemaining >= 0
+	}
+	elevenRemaining = int64(clientData.Subscription.CharacterLimit - clientData.Subscription.CharacterCount)
+	elevenCheckedAt = time.Now()
+	return elevenRemaining, true
+}
+
+// budgetExhausted reports whether a channel has hit a cap or the account is down to its reserve
+func budgetExhausted(channel string, characters int) bool {
+	budget, _ := getBudget(channel)
+
+	budgetMutex.Lock()
+	usage := *currentUsage(channel, time.Now())
+	budgetMutex.Unlock()
+
+	if budget.Daily > 0 && usage.Daily+characters > budget.Daily {
+		return true
+	}
+	if budget.Monthly > 0 && usage.Monthly+characters > budget.Monthly {
+		return true
+	}
+	if reserve := readConfig(&budgetReserve); reserve > 0 {
+		if remaining, ok := getElevenRemaining(); ok && remaining-int64(characters) < int64(reserve) {
+			return true
+		}
+	}
+	return false
+}
+
+// budgetRejects reports whether new messages for a channel should be turned away
+// A message needs at least one character, so a channel exactly at its cap is already out
+func budgetRejects(channel string) bool {
+	budget, _ := getBudget(channel)
+	return budget.Fallback == budgetReject && budgetExhausted(channel, 1)
+}
+
+// applyBudget checks an ElevenLabs request against the channel's budget and applies the fallback when it is exhausted
+func applyBudget(request Request) (Request, error) {
+	if getVoiceProvider(request.Voice.Voice, request.Channel).Name() != elevenLabsProviderName {
+		return request, nil
+	}
+	// ElevenLabs bills characters, not bytes, so emotes and CJK text count once per character
+	if !budgetExhausted(request.Channel, utf8.RuneCountInString(request.Text)) {
+		return request, nil
+	}
+
+	budget, _ := getBudget(request.Channel)
+	switch budget.Fallback {
+	case budgetDowngrade:
+		logger("Character budget exhausted, downgrading to "+budget.DowngradeModel, logInfo, request.Channel)
+		request.Model = budget.DowngradeModel
+		return request, nil
+	case budgetLocal:
+		voiceID, ok := getFallbackVoice(budget.FallbackVoice, request.Channel)
+		if !ok {
+			logger("Character budget exhausted and no local voice is configured", logError, request.Channel)
+			return request, errBudgetExceeded
+		}
+		logger("Character budget exhausted, switching to a local voice", logInfo, request.Channel)
+		request.Voice.Voice = voiceID
+		return request, nil
+	default:
+		logger("Character budget exhausted, rejecting message", logInfo, request.Channel)
+		return request, errBudgetExceeded
+	}
+}
+
+// getFallbackVoice returns the named local voice, or the first local voice if no name is given
+func getFallbackVoice(name string, channel string) (string, bool) {
+	for _, voice := range channelVoices(channel) {
+		if getVoiceProvider(voice.ID, channel).Name() != localProviderName {
+			continue
+		}
+		if name == "" || strings.EqualFold(voice.Name, name) {
+			return voice.ID, true
+		}
+	}
+	return "", false
+}
+
+// recordBudgetUsage adds generated ElevenLabs characters to a channel's usage and saves it
+func recordBudgetUsage(channel string, characters int) {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+
+	usage := currentUsage(channel, time.Now())
+	usage.Daily += characters
+	usage.Monthly += characters
+
+	elevenCheckMutex.Lock()
+	if elevenRemaining >= 0 {
+		elevenRemaining -= int64(characters)
+	}
+	elevenCheckMutex.Unlock()
+
+	saveBudgetUsage()
+}
+
+// saveBudgetUsage writes usage to disk so budgets survive restarts
+// Must be called with budgetMutex held
+func saveBudgetUsage() {
+	data, err := json.MarshalIndent(budgetUsage, "", "  ")
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(budgetFile)
+	tempFile, err := os.CreateTemp(dir, ".budgets-*")
+	if err != nil {
+		logger("Error saving budget file: "+err.Error(), logError, "Universal")
+		return
+	}
+	_, err = tempFile.Write(data)
+	tempFile.Close()
+	if err != nil {
+		logger("Error saving budget file: "+err.Error(), logError, "Universal")
+		os.Remove(tempFile.Name())
+		return
+	}
+	if err := os.Rename(tempFile.Name(), budgetFile); err != nil {
+		logger("Error saving budget file: "+err.Error(), logError, "Universal")
+		os.Remove(tempFile.Name())
+	}
+}
+
+// handleBudget returns a channel's budget and usage as JSON
+func handleBudget(w http.ResponseWriter, r *http.Request) {
+	channel := strings.ToLower(mux.Vars(r)["channel"])
+	budget, _ := getBudget(channel)
+
+	budgetMutex.Lock()
+	usage := *currentUsage(channel, time.Now())
+	budgetMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BudgetStatus{
+		Channel:      channel,
+		DailyUsed:    usage.Daily,
+		DailyLimit:   budget.Daily,
+		MonthlyUsed:  usage.Monthly,
+		MonthlyLimit: budget.Monthly,
+		Reserve:      readConfig(&budgetReserve),
+		Fallback:     budget.Fallback,
+		Exhausted:    budgetExhausted(channel, 0),
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheFolder   = "cache"
+	cacheMaxBytes = int64(500 * 1024 * 1024)
+	cacheMaxAge   = 7 * 24 * time.Hour
+	cacheMutex    = sync.Mutex{}
+	evictMutex    = sync.Mutex{}
+	cacheStats    = CacheStats{}
+)
+
+// CacheStats tracks how much synthesis the audio cache has saved since startup
+type CacheStats struct {
+	Hits            int `json:"hits"`
+	Misses          int `json:"misses"`
+	CharactersSaved int `json:"characters_saved"`
+}
+
+func setupCache() {
+	if folder := getSetting("AUDIO_CACHE_DIR"); folder != "" {
+		cacheFolder = folder
+	}
+	if maxMB := getSetting("AUDIO_CACHE_MAX_MB"); maxMB != "" {
+		mb, err := strconv.Atoi(maxMB)
+		if err != nil || mb < 0 {
+			logger("Invalid AUDIO_CACHE_MAX_MB, using default", logError, "Universal")
+		} else {
+			cacheMaxBytes = int64(mb) * 1024 * 1024
+		}
+	}
+	if maxAge := getSetting("AUDIO_CACHE_MAX_AGE_HOURS"); maxAge != "" {
+		hours, err := strconv.Atoi(maxAge)
+		if err != nil || hours <= 0 {
+			logger("Invalid AUDIO_CACHE_MAX_AGE_HOURS, using default", logError, "Universal")
+		} else {
+			cacheMaxAge = time.Duration(hours) * time.Hour
+		}
+	}
+
+	if !cacheEnabled() {
+		logger("Audio cache disabled", logInfo, "Universal")
+		return
+	}
+	if err := os.MkdirAll(cacheFolder, 0755); err != nil {
+		logger("Error creating cache folder, audio cache disabled: "+err.Error(), logError, "Universal")
+		cacheMaxBytes = 0
+		return
+	}
+	logger("Audio cache enabled in "+cacheFolder, logInfo, "Universal")
+	go evictCache()
+}
+
+func cacheEnabled() bool {
+	return cacheMaxBytes > 0
+}
+
+// audioCacheKey hashes everything that affects the synthesized audio
+func audioCacheKey(provider TTSProvider, request Request) string {
+	model, format := provider.Settings(request)
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%.4f\x00%.4f\x00%.4f\x00%s",
+		provider.Name(), request.Text, request.Voice.Voice, model,
+		request.Voice.Stability, request.Voice.SimilarityBoost, request.Voice.Style, format)
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func cachePath(key string) string {
+	return filepath.Join(cacheFolder, key[:2], key+".mp3")
+}
+
+// getCachedAudio returns the cached audio for a key and refreshes its modification time
+func getCachedAudio(key string) ([]byte, bool) {
+	path := cachePath(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if time.Since(info.ModTime()) > cacheMaxAge {
+		removeCacheEntry(key)
+		return nil, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// removeCacheEntry deletes a cached clip together with its word timings
+func removeCacheEntry(key string) {
+	os.Remove(cachePath(key))
+	os.Remove(alignmentPath(key))
+}
+
+// alignmentPath is the sidecar file holding word timings for a cached clip
+func alignmentPath(key string) string {
+	return filepath.Join(cacheFolder, key[:2], key+".json")
+}
+
+// getCachedAlignment returns the word timings stored next to a cached clip, if any
+func getCachedAlignment(key string) ([]WordTiming, bool) {
+	data, err := os.ReadFile(alignmentPath(key))
+	if err != nil {
+		return nil, false
+	}
+	var words []WordTiming
+	if err := json.Unmarshal(data, &words); err != nil || len(words) == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(alignmentPath(key), now, now)
+	return words, true
+}
+
+func storeCachedAlignment(key string, words []WordTiming, channel string) {
+	data, err := json.Marshal(words)
+	if err != nil {
+		return
+	}
+	path := alignmentPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logger("Error creating cache folder: "+err.Error(), logError, channel)
+		return
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		logger("Error writing alignment cache file: "+err.Error(), logError, channel)
+	}
+}
+
+func storeCachedAudio(key string, data []byte, channel string) {
+	path := cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logger("Error creating cache folder: "+err.Error(), logError, channel)
+		return
+	}
+
+	// Write to a temp file first so a partial write is never served
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		logger("Error creating cache file: "+err.Error(), logError, channel)
+		return
+	}
+	_, err = tempFile.Write(data)
+	tempFile.Close()
+	if err != nil {
+		logger("Error writing cache file: "+err.Error(), logError, channel)
+		os.Remove(tempFile.Name())
+		return
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		logger("Error saving cache file: "+err.Error(), logError, channel)
+		os.Remove(tempFile.Name())
+		return
+	}
+
+	go evictCache()
+}
+
+func recordCacheResult(hit bool, characters int) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if hit {
+		cacheStats.Hits++
+		cacheStats.CharactersSaved += characters
+	} else {
+		cacheStats.Misses++
+	}
+}
+
+// cacheEntry is a cached clip and its word timings sidecar, which are always evicted together
+type cacheEntry struct {
+	paths   []string
+	size    int64
+	modTime time.Time
+}
+
+// evictCache removes expired entries and then the least recently used ones until the cache fits
+func evictCache() {
+	if !evictMutex.TryLock() {
+		return
+	}
+	defer evictMutex.Unlock()
+
+	// Files are grouped by name without the extension, so a clip and its sidecar form one entry
+	entries := make(map[string]*cacheEntry)
+	var total int64
+	filepath.WalkDir(cacheFolder, func(path string, dirEntry os.DirEntry, err error) error {
+		if err != nil || dirEntry.IsDir() {
+			return nil
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil
+		}
+		name := strings.TrimSuffix(path, filepath.Ext(path))
+		entry, ok := entries[name]
+		if !ok {
+			entry = &cacheEntry{}
+			entries[name] = entry
+		}
+		entry.paths = append(entry.paths, path)
+		entry.size += info.Size()
+		if info.ModTime().After(entry.modTime) {
+			entry.modTime = info.ModTime()
+		}
+		total += info.Size()
+		return nil
+	})
+
+	var list []*cacheEntry
+	for _, entry := range entries {
+		if time.Since(entry.modTime) > cacheMaxAge {
+			removeCacheFiles(entry)
+			total -= entry.size
+			continue
+		}
+		list = append(list, entry)
+	}
+
+	if total <= cacheMaxBytes {
+		return
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].modTime.Before(list[j].modTime)
+	})
+	removed := 0
+	for _, entry := range list {
+		if total <= cacheMaxBytes {
+			break
+		}
+		removeCacheFiles(entry)
+		total -= entry.size
+		removed++
+	}
+	logger(fmt.Sprintf("Evicted %d entries from the audio cache", removed), logDebug, "Universal")
+}
+
+// removeCacheFiles deletes every file of a cache entry
+func removeCacheFiles(entry *cacheEntry) {
+	for _, path := range entry.paths {
+		os.Remove(path)
+	}
+}
+
+// handleCacheStats returns the audio cache hit/miss counters as JSON
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	cacheMutex.Lock()
+	stats := cacheStats
+	cacheMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictCacheRemovesPairs(t *testing.T) {
+	oldFolder, oldMax, oldAge := cacheFolder, cacheMaxBytes, cacheMaxAge
+	t.Cleanup(func() { cacheFolder, cacheMaxBytes, cacheMaxAge = oldFolder, oldMax, oldAge })
+	cacheFolder = t.TempDir()
+	cacheMaxAge = 24 * time.Hour
+
+	// Each entry is 100 bytes of audio and 50 bytes of word timings
+	write := func(key string, age time.Duration, sidecarAge time.Duration) {
+		t.Helper()
+		files := map[string]time.Duration{cachePath(key): age, alignmentPath(key): sidecarAge}
+		for path, fileAge := range files {
+			size := 100
+			if strings.HasSuffix(path, ".json") {
+				size = 50
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			modTime := time.Now().Add(-fileAge)
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	oldest := strings.Repeat("a", 64)
+	middle := strings.Repeat("b", 64)
+	newest := strings.Repeat("c", 64)
+	expired := strings.Repeat("d", 64)
+	write(oldest, 3*time.Hour, 3*time.Hour)
+	// Its audio is old but its timings were just read, so the entry counts as recently used
+	write(middle, 5*time.Hour, time.Hour)
+	write(newest, 2*time.Hour, 2*time.Hour)
+	write(expired, 48*time.Hour, 48*time.Hour)
+	cacheMaxBytes = 300
+
+	evictCache()
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for _, key := range []string{oldest, expired} {
+		if exists(cachePath(key)) || exists(alignmentPath(key)) {
+			t.Errorf("entry %s... wasn't removed as a whole", key[:4])
+		}
+	}
+	for _, key := range []string{middle, newest} {
+		if !exists(cachePath(key)) || !exists(alignmentPath(key)) {
+			t.Errorf("entry %s... lost a file", key[:4])
+		}
+	}
+}
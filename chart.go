@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
@@ -36,6 +35,8 @@ type Data struct {
 	Channel       string    `json:"channel" bson:"channel"`
 	NumCharacters int       `json:"num_characters" bson:"num_characters"`
 	EstimatedCost float64   `json:"estimated_cost" bson:"estimated_cost"`
+	// Characters served from the audio cache instead of being generated
+	CachedCharacters int `json:"cached_characters" bson:"cached_characters"`
 }
 
 func setupDB() {
@@ -59,7 +60,7 @@ func setupDB() {
 
 func createData(request Request) (*Data, error) {
 	numCharacters := len(request.Text)
-	elevenPriceStr := os.Getenv("ELEVENLABS_PRICE")
+	elevenPriceStr := getSetting("ELEVENLABS_PRICE")
 
 	elevenPrice, err := strconv.ParseFloat(elevenPriceStr, 64)
 	if err != nil {
@@ -90,6 +91,15 @@ func createData(request Request) (*Data, error) {
 	return &data, nil
 }
 
+// createCachedData records a cache hit, which costs nothing but shows the savings
+func createCachedData(request Request) *Data {
+	return &Data{
+		Date:             time.Now(),
+		Channel:          request.Channel,
+		CachedCharacters: len(request.Text),
+	}
+}
+
 func addData(data *Data) error {
 	collection := dbClient.Database(dbName).Collection(collectionName)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
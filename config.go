@@ -0,0 +1,892 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configFile    = "config.yaml"
+	configModTime time.Time
+
+	// Values from the config file, keyed by the environment variable each one replaces
+	configSettings = make(map[string]string)
+	settingsMutex  = sync.RWMutex{}
+
+	// Held for writing while a reload rebuilds the live config, readers copy what they need with readConfig
+	configMutex = sync.RWMutex{}
+
+	configWatchInterval = 5 * time.Second
+
+	settingNameRe  = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	settingVarRe   = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+	yamlErrorRe    = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	voiceModelKeys = map[string]bool{"": true, "turbo": true, "v2": true, "v3": true}
+)
+
+// Secrets set in the environment win over the config file so the file can be shared without them
+var secretSettings = map[string]bool{
+	"TTS_KEY":                true,
+	"ELEVENLABS_KEY":         true,
+	"MONGO_USER":             true,
+	"MONGO_PASS":             true,
+	"SENTRY_URL":             true,
+	"TWITCH_IRC_TOKEN":       true,
+	"TWITCH_EVENTSUB_SECRET": true,
+}
+
+// Settings applied by a reload, anything else needs a restart
+var reloadableSettings = map[string]bool{
+	"TTS_CHANNEL_KEYS":        true,
+	"MODERATION_RULES":        true,
+	"MODERATION_BLEEP_EFFECT": true,
+	"MODERATION_MASK_TEXT":    true,
+	"MODERATION_LOG":          true,
+	"MESSAGE_LIMITS":          true,
+	"APPROVAL_RULES":          true,
+	"RATE_LIMITS":             true,
+	"RATE_LIMIT_GLOBAL":       true,
+	"CHARACTER_BUDGETS":       true,
+	"BUDGET_RESERVE":          true,
+	"PALLY_VOICES":            true,
+	"DONATION_SETTINGS":       true,
+	"ALERT_TIERS":             true,
+	"KOFI_TOKENS":             true,
+	"TWITCH_EVENTS":           true,
+	"TWITCH_EVENTSUB_SECRET":  true,
+	"VOICES":                  true,
+	"VOICE_MODELS":            true,
+	"VOICE_STYLES":            true,
+	"VOICE_MODIFIERS":         true,
+	"VOICE_CATALOGS":          true,
+	"LOUDNESS_TARGETS":        true,
+	"STITCH_AUDIO":            true,
+}
+
+// ConfigVoice is a voice along with the model, style and modifiers that used to be set in separate variables
+type ConfigVoice struct {
+	Name      string   `json:"name"`
+	ID        string   `json:"id"`
+	Provider  string   `json:"provider"`
+	Model     string   `json:"model"`     // turbo, v2 or v3
+	Style     *float64 `json:"style"`     // 0 to 1
+	Modifiers string   `json:"modifiers"` // e.g. "reverb,pitch:+4"
+}
+
+// ConfigChannel holds everything set for a single channel
+type ConfigChannel struct {
+	Name            string        `json:"name"`
+	Key             string        `json:"key"`         // Channel key for /tts and the moderation page
+	PallyVoice      string        `json:"pally_voice"` // Voice for Pally tips
+	Voices          []ConfigVoice `json:"voices"`      // Voices only this channel can use
+	IncludeGlobal   *bool         `json:"include_global"`
+	DefaultVoice    string        `json:"default_voice"`
+	Stability       *float64      `json:"stability"`
+	SimilarityBoost *float64      `json:"similarity_boost"`
+	Style           *float64      `json:"style"`
+}
+
+// ConfigSources are the donation and Twitch connections
+type ConfigSources struct {
+	Pally          []ConfigPallyKey    `json:"pally"`
+	Kofi           []DonationKey       `json:"kofi"`
+	StreamElements []DonationKey       `json:"streamelements"`
+	Streamlabs     []DonationKey       `json:"streamlabs"`
+	TwitchChat     *ConfigTwitchChat   `json:"twitch_chat"`
+	TwitchEvents   *ConfigTwitchEvents `json:"twitch_events"`
+}
+
+type ConfigPallyKey struct {
+	Channel string `json:"channel"`
+	Key     string `json:"key"`
+}
+
+type ConfigTwitchChat struct {
+	Nick     string          `json:"nick"`
+	Token    string          `json:"token"`
+	Server   string          `json:"server"`
+	Channels []TwitchChannel `json:"channels"`
+}
+
+type ConfigTwitchEvents struct {
+	Secret   string           `json:"secret"`
+	Channels []EventSubConfig `json:"channels"`
+}
+
+// ConfigLimits are the rate limits, message limits and character budgets
+type ConfigLimits struct {
+	Rate          []RateLimitConfig `json:"rate"`
+	GlobalRate    *BucketConfig     `json:"global_rate"`
+	Message       []MessageLimit    `json:"message"`
+	Budgets       []BudgetConfig    `json:"budgets"`
+	BudgetReserve *int              `json:"budget_reserve"`
+}
+
+// configLoader turns a config file into settings, collecting every problem instead of stopping at the first
+type configLoader struct {
+	file     string
+	settings map[string]string
+	owners   map[string]string // Section that set each setting
+	errors   []error
+	voices   map[string]bool // Lowercased names of the global voices
+}
+
+// setupConfig loads the config file if there is one, an invalid file stops the server
+func setupConfig() {
+	file, explicit := os.LookupEnv("CONFIG_FILE")
+	if explicit && file != "" {
+		configFile = file
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			log.Fatal("Error reading config file: " + err.Error())
+		}
+		logger("No config file found, using environment variables only", logDebug, "Universal")
+		return
+	}
+	loaded, errs := loadConfigFile(configFile)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logger(err.Error(), logError, "Universal")
+		}
+		log.Fatalf("Config file %s is invalid", configFile)
+	}
+	configSettings = loaded
+	configModTime = info.ModTime()
+	logger(fmt.Sprintf("Loaded %d settings from %s", len(loaded), configFile), logInfo, "Universal")
+}
+
+// getSetting returns a setting from the config file, falling back to the environment
+func getSetting(name string) string {
+	value, _ := lookupSetting(name)
+	return value
+}
+
+// lookupSetting is getSetting that also reports whether the setting was set at all
+func lookupSetting(name string) (string, bool) {
+	if secretSettings[name] {
+		if value := os.Getenv(name); value != "" {
+			return value, true
+		}
+	}
+	settingsMutex.RLock()
+	value, ok := configSettings[name]
+	settingsMutex.RUnlock()
+	if ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// readConfig copies a reloadable setting so it can't change halfway through being used
+func readConfig[T any](value *T) T {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return *value
+}
+
+// watchConfig reloads the config file on SIGHUP or when the file changes
+func watchConfig() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hangup:
+			logger("Received SIGHUP, reloading "+configFile, logInfo, "Universal")
+			reloadConfig()
+		case <-ticker.C:
+			info, err := os.Stat(configFile)
+			if err != nil || info.ModTime().Equal(configModTime) {
+				continue
+			}
+			logger(configFile+" changed, reloading it", logInfo, "Universal")
+			reloadConfig()
+		}
+	}
+}
+
+// reloadConfig swaps in the config file's current contents, keeping the old config if the file is invalid
+// Connected clients and queued messages are untouched, new messages use the new config
+func reloadConfig() {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		logger("Error reading config file, keeping the current config: "+err.Error(), logError, "Universal")
+		return
+	}
+	configModTime = info.ModTime()
+	loaded, errs := loadConfigFile(configFile)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logger(err.Error(), logError, "Universal")
+		}
+		logger("Config file is invalid, keeping the current config", logError, "Universal")
+		return
+	}
+
+	settingsMutex.Lock()
+	previous := configSettings
+	configSettings = loaded
+	settingsMutex.Unlock()
+
+	// Every reloadable setup starts from empty so entries removed from the file go away
+	configMutex.Lock()
+	setupChannelKeys()
+	setupModeration()
+	setupMessageLimits()
+	setupApproval()
+	setupRateLimits()
+	setupBudgetLimits()
+	setupPallyVoices()
+	setupDonations()
+	setupAlertTiers()
+	setupKofi()
+	setupEventSub()
+	setupVoices()
+	setupVoiceModels()
+	setupVoiceStyles()
+	setupVoiceModifiers()
+	setupVoiceCatalogs()
+	setupLoudness()
+	setupStitchAudio()
+	configMutex.Unlock()
+
+	for name := range previous {
+		if loaded[name] != previous[name] && !reloadableSettings[name] {
+			logger(name+" changed, restart to apply it", logInfo, "Universal")
+		}
+	}
+	for name := range loaded {
+		if _, existed := previous[name]; !existed && !reloadableSettings[name] {
+			logger(name+" changed, restart to apply it", logInfo, "Universal")
+		}
+	}
+	logger("Reloaded "+configFile, logInfo, "Universal")
+}
+
+// loadConfigFile parses and validates a config file, returning the settings it sets or every problem found
+func loadConfigFile(file string) (map[string]string, []error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		if match := yamlErrorRe.FindStringSubmatch(err.Error()); match != nil {
+			return nil, []error{fmt.Errorf("%s:%s: %s", file, match[1], match[2])}
+		}
+		return nil, []error{fmt.Errorf("%s: %w", file, err)}
+	}
+
+	c := &configLoader{
+		file:     file,
+		settings: make(map[string]string),
+		owners:   make(map[string]string),
+		voices:   make(map[string]bool),
+	}
+	if len(root.Content) == 0 {
+		return c.settings, nil
+	}
+	document := root.Content[0]
+	if document.Kind != yaml.MappingNode {
+		c.errorf(document, "", "the config file must be a mapping of sections")
+		return nil, c.errors
+	}
+
+	sections := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(document.Content); i += 2 {
+		key, value := document.Content[i], document.Content[i+1]
+		switch key.Value {
+		case "settings", "voices", "channels", "sources", "limits", "moderation", "approval", "donations", "alert_tiers", "loudness":
+			if _, exists := sections[key.Value]; exists {
+				c.errorf(key, key.Value, "section is set twice")
+				continue
+			}
+			sections[key.Value] = value
+		default:
+			c.errorf(key, key.Value, "unknown section")
+		}
+	}
+
+	// Voices come first so channels can be checked against them
+	if node, ok := sections["voices"]; ok {
+		c.loadVoices(node)
+	}
+	if node, ok := sections["channels"]; ok {
+		c.loadChannels(node)
+	}
+	if node, ok := sections["sources"]; ok {
+		c.loadSources(node)
+	}
+	if node, ok := sections["limits"]; ok {
+		c.loadLimits(node)
+	}
+	if node, ok := sections["moderation"]; ok {
+		rules := decodeList(c, node, "moderation", c.checkModeration)
+		c.set("MODERATION_RULES", "moderation", rules)
+	}
+	if node, ok := sections["approval"]; ok {
+		rules := decodeList(c, node, "approval", func(rule ApprovalRule, at *yaml.Node, path string) {
+			c.requireChannel(rule.Channel, at, path)
+		})
+		c.set("APPROVAL_RULES", "approval", rules)
+	}
+	if node, ok := sections["donations"]; ok {
+		donations := decodeList(c, node, "donations", func(donation DonationSettings, at *yaml.Node, path string) {
+			c.requireChannel(donation.Channel, at, path)
+		})
+		c.set("DONATION_SETTINGS", "donations", donations)
+	}
+	if node, ok := sections["alert_tiers"]; ok {
+		tiers := decodeList(c, node, "alert_tiers", func(channelTiers AlertTiers, at *yaml.Node, path string) {
+			c.requireChannel(channelTiers.Channel, at, path)
+			for i, tier := range channelTiers.Tiers {
+				c.checkModifiers(tier.Modifiers, item(child(at, "tiers"), i), fmt.Sprintf("%s.tiers[%d]", path, i))
+			}
+		})
+		c.set("ALERT_TIERS", "alert_tiers", tiers)
+	}
+	if node, ok := sections["loudness"]; ok {
+		targets := decodeList(c, node, "loudness", func(target LoudnessTarget, at *yaml.Node, path string) {
+			c.requireChannel(target.Channel, at, path)
+			if target.LUFS < -70 || target.LUFS > 0 {
+				c.errorf(child(at, "lufs"), path, "lufs must be between -70 and 0")
+			}
+		})
+		c.set("LOUDNESS_TARGETS", "loudness", targets)
+	}
+	// Plain settings last so they can't quietly override a section
+	if node, ok := sections["settings"]; ok {
+		c.loadSettings(node)
+	}
+
+	if len(c.errors) > 0 {
+		return nil, c.errors
+	}
+	return c.settings, nil
+}
+
+func (c *configLoader) errorf(node *yaml.Node, path string, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if path != "" {
+		message = path + ": " + message
+	}
+	c.errors = append(c.errors, fmt.Errorf("%s:%d: %s", c.file, node.Line, message))
+}
+
+// set stores a section's value as the JSON the setting's environment variable would hold
+func (c *configLoader) set(name string, section string, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		c.errors = append(c.errors, fmt.Errorf("%s: %s: %w", c.file, section, err))
+		return
+	}
+	c.settings[name] = string(data)
+	c.owners[name] = section
+}
+
+// setString stores a plain value, empty values are left unset so the environment can still provide them
+func (c *configLoader) setString(name string, section string, value string) {
+	if value == "" {
+		return
+	}
+	c.settings[name] = value
+	c.owners[name] = section
+}
+
+// value converts a node to plain Go values, replacing strings like ${NAME} with the environment variable
+func (c *configLoader) value(node *yaml.Node) any {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return c.value(node.Alias)
+	case yaml.MappingNode:
+		mapping := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if _, exists := mapping[key.Value]; exists {
+				c.errorf(key, key.Value, "key is set twice")
+			}
+			mapping[key.Value] = c.value(node.Content[i+1])
+		}
+		return mapping
+	case yaml.SequenceNode:
+		list := make([]any, 0, len(node.Content))
+		for _, entry := range node.Content {
+			list = append(list, c.value(entry))
+		}
+		return list
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!str" {
+			return expandSetting(node.Value)
+		}
+		var value any
+		if err := node.Decode(&value); err != nil {
+			c.errorf(node, "", "%v", err)
+			return nil
+		}
+		return value
+	}
+	return nil
+}
+
+// expandSetting replaces a value of the form ${NAME} with the environment variable NAME
+func expandSetting(value string) string {
+	if match := settingVarRe.FindStringSubmatch(value); match != nil {
+		return os.Getenv(match[1])
+	}
+	return value
+}
+
+// decode fills out from a node, reporting unknown fields and wrong types at the line they are on
+func (c *configLoader) decode(node *yaml.Node, path string, out any) bool {
+	before := len(c.errors)
+	data, err := json.Marshal(c.value(node))
+	if err != nil {
+		c.errorf(node, path, "%v", err)
+		return false
+	}
+	if len(c.errors) > before {
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(out)
+	if err == nil {
+		return true
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := typeErr.Field
+		if i := strings.LastIndex(field, "."); i != -1 {
+			field = field[i+1:]
+		}
+		at := node
+		if key := findKey(node, field); key != nil {
+			at = key
+		}
+		if field == "" {
+			c.errorf(at, path, "should be %s, not %s", describeType(typeErr.Type.String()), typeErr.Value)
+		} else {
+			c.errorf(at, path, "%s should be %s, not %s", field, describeType(typeErr.Type.String()), typeErr.Value)
+		}
+		return false
+	}
+	if field, found := strings.CutPrefix(err.Error(), "json: unknown field "); found {
+		at := node
+		if key := findKey(node, strings.Trim(field, `"`)); key != nil {
+			at = key
+		}
+		c.errorf(at, path, "unknown field %s", field)
+		return false
+	}
+	c.errorf(node, path, "%s", strings.TrimPrefix(err.Error(), "json: "))
+	return false
+}
+
+// describeType names a Go type the way it is written in the config file
+func describeType(goType string) string {
+	switch {
+	case strings.HasPrefix(goType, "[]"):
+		return "a list"
+	case strings.HasPrefix(goType, "map["), strings.HasPrefix(goType, "main."), strings.HasPrefix(goType, "struct"):
+		return "a mapping"
+	case strings.HasPrefix(goType, "int"):
+		return "a whole number"
+	case strings.HasPrefix(goType, "float"):
+		return "a number"
+	case goType == "bool":
+		return "true or false"
+	}
+	return "a " + goType
+}
+
+// findKey returns the first mapping key with the name under a node
+func findKey(node *yaml.Node, name string) *yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				return node.Content[i]
+			}
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if key := findKey(node.Content[i], name); key != nil {
+				return key
+			}
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, entry := range node.Content {
+			if key := findKey(entry, name); key != nil {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// child returns the value of a key in a mapping, or the mapping itself so errors still get a line
+func child(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	}
+	return node
+}
+
+// item returns an entry of a list, or the list itself so errors still get a line
+func item(node *yaml.Node, i int) *yaml.Node {
+	if node.Kind == yaml.SequenceNode && i < len(node.Content) {
+		return node.Content[i]
+	}
+	return node
+}
+
+func (c *configLoader) requireChannel(channel string, node *yaml.Node, path string) {
+	if strings.TrimSpace(channel) == "" {
+		c.errorf(node, path, "channel is required")
+	}
+}
+
+// checkModifiers makes sure every modifier in a list like "reverb,pitch:+4" exists and has valid arguments
+func (c *configLoader) checkModifiers(list string, node *yaml.Node, path string) {
+	for _, tag := range strings.Split(list, ",") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		if _, err := parseModifier(strings.ReplaceAll(tag, ";", ",")); err != nil {
+			c.errorf(node, path, "invalid modifier %s: %v", strings.TrimSpace(tag), err)
+		}
+	}
+}
+
+// decodeList decodes each entry of a list section on its own so one bad entry doesn't hide problems in the rest
+// check is called for every entry that decoded, the entries that didn't are left out
+func decodeList[T any](c *configLoader, node *yaml.Node, path string, check func(value T, node *yaml.Node, path string)) []T {
+	if node.Kind != yaml.SequenceNode {
+		c.errorf(node, path, "should be a list")
+		return nil
+	}
+	list := make([]T, 0, len(node.Content))
+	for i, entry := range node.Content {
+		var value T
+		entryPath := fmt.Sprintf("%s[%d]", path, i)
+		if !c.decode(entry, entryPath, &value) {
+			continue
+		}
+		if check != nil {
+			check(value, entry, entryPath)
+		}
+		list = append(list, value)
+	}
+	return list
+}
+
+// checkVoice validates a voice, seen holds the lowercased names already in the same list
+func (c *configLoader) checkVoice(voice ConfigVoice, node *yaml.Node, path string, seen map[string]bool) {
+	if voice.Name == "" {
+		c.errorf(node, path, "name is required")
+	} else if seen[strings.ToLower(voice.Name)] {
+		c.errorf(node, path, "voice %s is listed twice", voice.Name)
+	}
+	seen[strings.ToLower(voice.Name)] = true
+	if voice.ID == "" {
+		c.errorf(node, path, "id is required")
+	}
+	if _, ok := providers[strings.ToLower(voice.Provider)]; voice.Provider != "" && !ok {
+		c.errorf(child(node, "provider"), path, "unknown provider %s", voice.Provider)
+	}
+	if !voiceModelKeys[voice.Model] {
+		c.errorf(child(node, "model"), path, "model must be turbo, v2 or v3")
+	}
+	if voice.Style != nil && (*voice.Style < 0 || *voice.Style > 1) {
+		c.errorf(child(node, "style"), path, "style must be between 0 and 1")
+	}
+	c.checkModifiers(voice.Modifiers, child(node, "modifiers"), path)
+}
+
+// splitVoices turns config voices into the voice, model, style and modifier lists
+func splitVoices(list []ConfigVoice) ([]Voice, []VoiceModel, []VoiceStyle, []VoiceModifier) {
+	voiceList := []Voice{}
+	models := []VoiceModel{}
+	styles := []VoiceStyle{}
+	modifiers := []VoiceModifier{}
+	for _, voice := range list {
+		voiceList = append(voiceList, Voice{Name: voice.Name, ID: voice.ID, Provider: voice.Provider})
+		if voice.Model != "" {
+			models = append(models, VoiceModel{Name: voice.Name, Model: voice.Model})
+		}
+		if voice.Style != nil {
+			styles = append(styles, VoiceStyle{Name: voice.Name, Style: strconv.FormatFloat(*voice.Style, 'f', -1, 64)})
+		}
+		if voice.Modifiers != "" {
+			modifiers = append(modifiers, VoiceModifier{Name: voice.Name, Modifier: voice.Modifiers})
+		}
+	}
+	return voiceList, models, styles, modifiers
+}
+
+func (c *configLoader) loadVoices(node *yaml.Node) {
+	seen := make(map[string]bool)
+	list := decodeList(c, node, "voices", func(voice ConfigVoice, at *yaml.Node, path string) {
+		c.checkVoice(voice, at, path, seen)
+	})
+	voiceList, models, styles, modifiers := splitVoices(list)
+	for _, voice := range voiceList {
+		c.voices[strings.ToLower(voice.Name)] = true
+	}
+	c.set("VOICES", "voices", voiceList)
+	c.set("VOICE_MODELS", "voices", models)
+	c.set("VOICE_STYLES", "voices", styles)
+	c.set("VOICE_MODIFIERS", "voices", modifiers)
+}
+
+func (c *configLoader) loadChannels(node *yaml.Node) {
+	seen := make(map[string]bool)
+	list := decodeList(c, node, "channels", func(channel ConfigChannel, at *yaml.Node, path string) {
+		name := strings.ToLower(channel.Name)
+		if name == "" {
+			c.errorf(at, path, "name is required")
+		} else if seen[name] {
+			c.errorf(at, path, "channel %s is listed twice", channel.Name)
+		}
+		seen[name] = true
+
+		voiceNames := make(map[string]bool)
+		for i, voice := range channel.Voices {
+			c.checkVoice(voice, item(child(at, "voices"), i), fmt.Sprintf("%s.voices[%d]", path, i), voiceNames)
+		}
+		if channel.DefaultVoice != "" {
+			global := c.voices[strings.ToLower(channel.DefaultVoice)] && (channel.IncludeGlobal == nil || *channel.IncludeGlobal)
+			if !global && !voiceNames[strings.ToLower(channel.DefaultVoice)] {
+				c.errorf(child(at, "default_voice"), path, "default voice %s is not one of the channel's voices", channel.DefaultVoice)
+			}
+		}
+		for field, value := range map[string]*float64{"stability": channel.Stability, "similarity_boost": channel.SimilarityBoost, "style": channel.Style} {
+			if value != nil && (*value < 0 || *value > 1) {
+				c.errorf(child(at, field), path, "%s must be between 0 and 1", field)
+			}
+		}
+	})
+
+	keys := []ChannelKey{}
+	pallyVoiceList := []PallyVoice{}
+	catalogs := []VoiceCatalog{}
+	for _, channel := range list {
+		name := strings.ToLower(channel.Name)
+		if channel.Key != "" {
+			keys = append(keys, ChannelKey{Channel: name, Key: channel.Key})
+		}
+		if channel.PallyVoice != "" {
+			pallyVoiceList = append(pallyVoiceList, PallyVoice{Channel: name, Voice: channel.PallyVoice})
+		}
+		// Channels that only set a key or Pally voice don't need a catalog
+		if len(channel.Voices) == 0 && channel.IncludeGlobal == nil && channel.DefaultVoice == "" &&
+			channel.Stability == nil && channel.SimilarityBoost == nil && channel.Style == nil {
+			continue
+		}
+		voiceList, models, styles, modifiers := splitVoices(channel.Voices)
+		catalogs = append(catalogs, VoiceCatalog{
+			Channel:         name,
+			Voices:          voiceList,
+			IncludeGlobal:   channel.IncludeGlobal,
+			DefaultVoice:    channel.DefaultVoice,
+			Stability:       channel.Stability,
+			SimilarityBoost: channel.SimilarityBoost,
+			Style:           channel.Style,
+			Models:          models,
+			Styles:          styles,
+			Modifiers:       modifiers,
+		})
+	}
+	c.set("TTS_CHANNEL_KEYS", "channels", keys)
+	c.set("PALLY_VOICES", "channels", pallyVoiceList)
+	c.set("VOICE_CATALOGS", "channels", catalogs)
+}
+
+func (c *configLoader) loadSources(node *yaml.Node) {
+	var sources ConfigSources
+	if !c.decode(node, "sources", &sources) {
+		return
+	}
+	if sources.Pally != nil {
+		keys := []PallyKeys{}
+		for i, key := range sources.Pally {
+			path := fmt.Sprintf("sources.pally[%d]", i)
+			c.requireChannel(key.Channel, item(child(node, "pally"), i), path)
+			if key.Key == "" {
+				c.errorf(item(child(node, "pally"), i), path, "key is required")
+			}
+			keys = append(keys, PallyKeys{Name: strings.ToLower(key.Channel), Key: key.Key})
+		}
+		c.set("PALLY_KEYS", "sources.pally", keys)
+	}
+	donationSources := []struct {
+		name    string
+		setting string
+		keys    []DonationKey
+	}{
+		{"kofi", "KOFI_TOKENS", sources.Kofi},
+		{"streamelements", "STREAMELEMENTS_TOKENS", sources.StreamElements},
+		{"streamlabs", "STREAMLABS_TOKENS", sources.Streamlabs},
+	}
+	for _, source := range donationSources {
+		if source.keys == nil {
+			continue
+		}
+		for i, key := range source.keys {
+			path := fmt.Sprintf("sources.%s[%d]", source.name, i)
+			c.requireChannel(key.Channel, item(child(node, source.name), i), path)
+			if key.Token == "" {
+				c.errorf(item(child(node, source.name), i), path, "token is required")
+			}
+		}
+		c.set(source.setting, "sources."+source.name, source.keys)
+	}
+	if chat := sources.TwitchChat; chat != nil {
+		for i, channel := range chat.Channels {
+			c.requireChannel(channel.Channel, item(child(child(node, "twitch_chat"), "channels"), i), fmt.Sprintf("sources.twitch_chat.channels[%d]", i))
+		}
+		c.setString("TWITCH_IRC_NICK", "sources.twitch_chat", chat.Nick)
+		c.setString("TWITCH_IRC_TOKEN", "sources.twitch_chat", chat.Token)
+		c.setString("TWITCH_IRC_SERVER", "sources.twitch_chat", chat.Server)
+		c.set("TWITCH_CHANNELS", "sources.twitch_chat", chat.Channels)
+	}
+	if events := sources.TwitchEvents; events != nil {
+		for i, channel := range events.Channels {
+			c.requireChannel(channel.Channel, item(child(child(node, "twitch_events"), "channels"), i), fmt.Sprintf("sources.twitch_events.channels[%d]", i))
+		}
+		c.setString("TWITCH_EVENTSUB_SECRET", "sources.twitch_events", events.Secret)
+		c.set("TWITCH_EVENTS", "sources.twitch_events", events.Channels)
+	}
+}
+
+func (c *configLoader) loadLimits(node *yaml.Node) {
+	var limits ConfigLimits
+	if !c.decode(node, "limits", &limits) {
+		return
+	}
+	if limits.Rate != nil {
+		for i, rate := range limits.Rate {
+			at := item(child(node, "rate"), i)
+			path := fmt.Sprintf("limits.rate[%d]", i)
+			c.requireChannel(rate.Channel, at, path)
+			c.checkBucket(rate.ChannelLimit, child(at, "channel_limit"), path+".channel_limit")
+			c.checkBucket(rate.UserLimit, child(at, "user_limit"), path+".user_limit")
+		}
+		c.set("RATE_LIMITS", "limits.rate", limits.Rate)
+	}
+	if limits.GlobalRate != nil {
+		c.checkBucket(limits.GlobalRate, child(node, "global_rate"), "limits.global_rate")
+		c.set("RATE_LIMIT_GLOBAL", "limits.global_rate", limits.GlobalRate)
+	}
+	if limits.Message != nil {
+		for i, limit := range limits.Message {
+			at := item(child(node, "message"), i)
+			path := fmt.Sprintf("limits.message[%d]", i)
+			c.requireChannel(limit.Channel, at, path)
+			if policy := strings.ToLower(limit.Policy); policy != "" && policy != limitTruncate && policy != limitReject {
+				c.errorf(child(at, "policy"), path, "policy must be %s or %s", limitTruncate, limitReject)
+			}
+		}
+		c.set("MESSAGE_LIMITS", "limits.message", limits.Message)
+	}
+	if limits.Budgets != nil {
+		for i, budget := range limits.Budgets {
+			at := item(child(node, "budgets"), i)
+			path := fmt.Sprintf("limits.budgets[%d]", i)
+			c.requireChannel(budget.Channel, at, path)
+			switch strings.ToLower(budget.Fallback) {
+			case "", budgetReject, budgetDowngrade, budgetLocal:
+			default:
+				c.errorf(child(at, "fallback"), path, "fallback must be %s, %s or %s", budgetReject, budgetDowngrade, budgetLocal)
+			}
+			if budget.Daily < 0 || budget.Monthly < 0 {
+				c.errorf(at, path, "daily and monthly can't be negative")
+			}
+		}
+		c.set("CHARACTER_BUDGETS", "limits.budgets", limits.Budgets)
+	}
+	if limits.BudgetReserve != nil {
+		if *limits.BudgetReserve < 0 {
+			c.errorf(child(node, "budget_reserve"), "limits", "budget_reserve can't be negative")
+		}
+		c.setString("BUDGET_RESERVE", "limits.budget_reserve", strconv.Itoa(*limits.BudgetReserve))
+	}
+}
+
+func (c *configLoader) checkBucket(bucket *BucketConfig, node *yaml.Node, path string) {
+	if bucket != nil && (bucket.Burst <= 0 || bucket.WindowSeconds <= 0) {
+		c.errorf(node, path, "burst and window_seconds must be above 0")
+	}
+}
+
+func (c *configLoader) checkModeration(rule ModerationRules, node *yaml.Node, path string) {
+	c.requireChannel(rule.Channel, node, path)
+	if action := strings.ToLower(rule.Action); action != "" && !validModerationAction(action) {
+		c.errorf(child(node, "action"), path, "action must be %s, %s or %s", moderationReject, moderationMask, moderationBleep)
+	}
+	if donations := strings.ToLower(rule.Donations); donations != "" && donations != moderationAllow && !validModerationAction(donations) {
+		c.errorf(child(node, "donations"), path, "donations must be %s, %s, %s or %s", moderationAllow, moderationReject, moderationMask, moderationBleep)
+	}
+	for i, pattern := range rule.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			c.errorf(item(child(node, "patterns"), i), path, "invalid pattern %s: %v", pattern, err)
+		}
+	}
+}
+
+// loadSettings reads the plain settings, named after the environment variables they replace
+func (c *configLoader) loadSettings(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		c.errorf(node, "settings", "should be a mapping of names to values")
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := key.Value
+		if !settingNameRe.MatchString(name) {
+			c.errorf(key, "settings", "%s is not a valid setting name, names are upper case like SERVER_URL", name)
+			continue
+		}
+		if name == "CONFIG_FILE" {
+			c.errorf(key, "settings", "CONFIG_FILE can only be set in the environment")
+			continue
+		}
+		if owner, exists := c.owners[name]; exists {
+			c.errorf(key, "settings", "%s is already set by %s", name, owner)
+			continue
+		}
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		if value.Kind != yaml.ScalarNode {
+			c.errorf(value, "settings", "%s should be a single value", name)
+			continue
+		}
+		if value.ShortTag() == "!!str" {
+			c.settings[name] = expandSetting(value.Value)
+		} else if value.ShortTag() != "!!null" {
+			c.settings[name] = value.Value
+		}
+		c.owners[name] = "settings"
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, dir string, contents string) string {
+	t.Helper()
+	file := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(file, []byte(strings.TrimLeft(contents, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// loadConfigErrors loads a config file and returns its errors with the temporary directory left out
+func loadConfigErrors(t *testing.T, contents string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	_, errs := loadConfigFile(writeConfig(t, dir, contents))
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)))
+	}
+	return messages
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name: "unknown section",
+			config: `
+voice:
+  - name: adam
+    id: abc
+`,
+			want: []string{"config.yaml:1: voice: unknown section"},
+		},
+		{
+			name: "section set twice",
+			config: `
+loudness: []
+loudness: []
+`,
+			want: []string{"config.yaml:2: loudness: section is set twice"},
+		},
+		{
+			name: "unknown field",
+			config: `
+voices:
+  - name: adam
+    id: abc
+  - name: bella
+    idd: def
+`,
+			want: []string{`config.yaml:5: voices[1]: unknown field "idd"`},
+		},
+		{
+			name: "unknown nested field",
+			config: `
+limits:
+  global_rate:
+    burst: 5
+    window: 60
+`,
+			want: []string{`config.yaml:4: limits: unknown field "window"`},
+		},
+		{
+			name: "wrong type",
+			config: `
+limits:
+  budget_reserve: lots
+`,
+			want: []string{"config.yaml:2: limits: budget_reserve should be a whole number, not string"},
+		},
+		{
+			name: "wrong type in a list entry",
+			config: `
+voices:
+  - name: adam
+    id: abc
+    style: high
+`,
+			want: []string{"config.yaml:4: voices[0]: style should be a number, not string"},
+		},
+		{
+			name: "section of the wrong kind",
+			config: `
+moderation:
+  channel: "*"
+`,
+			want: []string{"config.yaml:2: moderation: should be a list"},
+		},
+		{
+			name: "every bad entry is reported",
+			config: `
+voices:
+  - name: adam
+    id: abc
+    model: v4
+  - name: bella
+    id: def
+    modifiers: reverb,wobble
+  - id: ghi
+`,
+			want: []string{
+				"config.yaml:4: voices[0]: model must be turbo, v2 or v3",
+				"config.yaml:7: voices[1]: invalid modifier wobble: unknown modifier: wobble",
+				"config.yaml:8: voices[2]: name is required",
+			},
+		},
+		{
+			name: "duplicate voices",
+			config: `
+voices:
+  - name: adam
+    id: abc
+  - name: Adam
+    id: def
+`,
+			want: []string{"config.yaml:4: voices[1]: voice Adam is listed twice"},
+		},
+		{
+			name: "duplicate channel voices",
+			config: `
+channels:
+  - name: streamer
+    voices:
+      - name: me
+        id: abc
+      - name: me
+        id: def
+`,
+			want: []string{"config.yaml:6: channels[0].voices[1]: voice me is listed twice"},
+		},
+		{
+			name: "duplicate channels",
+			config: `
+channels:
+  - name: streamer
+    key: one
+  - name: Streamer
+    key: two
+`,
+			want: []string{"config.yaml:4: channels[1]: channel Streamer is listed twice"},
+		},
+		{
+			name: "duplicate key",
+			config: `
+channels:
+  - name: streamer
+    key: one
+    key: two
+`,
+			want: []string{"config.yaml:4: key: key is set twice"},
+		},
+		{
+			name: "default voice not available",
+			config: `
+voices:
+  - name: adam
+    id: abc
+channels:
+  - name: streamer
+    include_global: false
+    default_voice: adam
+`,
+			want: []string{"config.yaml:7: channels[0]: default voice adam is not one of the channel's voices"},
+		},
+		{
+			name: "missing channel",
+			config: `
+approval:
+  - pally_min_cents: 500
+`,
+			want: []string{"config.yaml:2: approval[0]: channel is required"},
+		},
+		{
+			name: "invalid values",
+			config: `
+limits:
+  rate:
+    - channel: "*"
+      user_limit: {burst: 0, window_seconds: 30}
+  message:
+    - channel: "*"
+      policy: cut
+moderation:
+  - channel: "*"
+    patterns: ["(unclosed"]
+    action: shout
+`,
+			want: []string{
+				"config.yaml:4: limits.rate[0].user_limit: burst and window_seconds must be above 0",
+				"config.yaml:7: limits.message[0]: policy must be truncate or reject",
+				"config.yaml:11: moderation[0]: action must be reject, mask or bleep",
+				"config.yaml:10: moderation[0]: invalid pattern (unclosed: error parsing regexp: missing closing ): `(unclosed`",
+			},
+		},
+		{
+			name: "settings",
+			config: `
+voices:
+  - name: adam
+    id: abc
+settings:
+  server_url: example.com
+  CONFIG_FILE: other.yaml
+  VOICES: "[]"
+  LOUDNESS_TARGETS: [1, 2]
+`,
+			want: []string{
+				"config.yaml:5: settings: server_url is not a valid setting name, names are upper case like SERVER_URL",
+				"config.yaml:6: settings: CONFIG_FILE can only be set in the environment",
+				"config.yaml:7: settings: VOICES is already set by voices",
+				"config.yaml:8: settings: LOUDNESS_TARGETS should be a single value",
+			},
+		},
+		{
+			name: "yaml syntax",
+			config: `
+settings:
+  SERVER_URL: example.com
+    FFMPEG_ENABLED: true
+`,
+			want: []string{"config.yaml:3: mapping values are not allowed in this context"},
+		},
+		{
+			name:   "not a mapping",
+			config: "- voices\n",
+			want:   []string{"config.yaml:1: the config file must be a mapping of sections"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := loadConfigErrors(t, test.config)
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Fatalf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileSettings(t *testing.T) {
+	t.Setenv("TEST_CHANNEL_KEY", "from-env")
+	t.Setenv("TEST_SERVER_URL", "env.example.com")
+	t.Setenv("TEST_EMPTY", "")
+
+	file := writeConfig(t, t.TempDir(), `
+voices:
+  - name: adam
+    id: abc
+    model: v3
+    style: 0.3
+  - name: robot
+    id: en-us
+    provider: local
+channels:
+  - name: Streamer
+    key: ${TEST_CHANNEL_KEY}
+    pally_voice: adam
+limits:
+  budget_reserve: 100
+settings:
+  SERVER_URL: ${TEST_SERVER_URL}
+  MODERATION_MASK_TEXT: prefix-${TEST_SERVER_URL}
+  MONGO_USER: ${TEST_EMPTY}
+  FFMPEG_ENABLED: true
+  ELEVENLABS_PRICE: 22
+  SENTRY_URL:
+`)
+	settings, errs := loadConfigFile(file)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	want := map[string]string{
+		"VOICES":               `[{"name":"adam","id":"abc","provider":""},{"name":"robot","id":"en-us","provider":"local"}]`,
+		"VOICE_MODELS":         `[{"name":"adam","model":"v3"}]`,
+		"VOICE_STYLES":         `[{"name":"adam","style":"0.3"}]`,
+		"VOICE_MODIFIERS":      `[]`,
+		"TTS_CHANNEL_KEYS":     `[{"channel":"streamer","key":"from-env"}]`,
+		"PALLY_VOICES":         `[{"channel":"streamer","voice":"adam"}]`,
+		"VOICE_CATALOGS":       `[]`,
+		"BUDGET_RESERVE":       "100",
+		"SERVER_URL":           "env.example.com",
+		"MODERATION_MASK_TEXT": "prefix-${TEST_SERVER_URL}",
+		"MONGO_USER":           "",
+		"FFMPEG_ENABLED":       "true",
+		"ELEVENLABS_PRICE":     "22",
+	}
+	for name, value := range want {
+		if got, ok := settings[name]; !ok || got != value {
+			t.Errorf("%s = %q (set %v), want %q", name, got, ok, value)
+		}
+	}
+	if _, ok := settings["SENTRY_URL"]; ok {
+		t.Errorf("empty SENTRY_URL should be left unset")
+	}
+	if len(settings) != len(want) {
+		t.Errorf("got %d settings, want %d: %v", len(settings), len(want), settings)
+	}
+}
+
+func TestLookupSettingPrecedence(t *testing.T) {
+	settingsMutex.Lock()
+	oldSettings := configSettings
+	configSettings = map[string]string{
+		"TTS_KEY":        "file-key",
+		"ELEVENLABS_KEY": "file-elevenlabs",
+		"SERVER_URL":     "file.example.com",
+		"MONGO_HOST":     "",
+	}
+	settingsMutex.Unlock()
+	t.Cleanup(func() {
+		settingsMutex.Lock()
+		configSettings = oldSettings
+		settingsMutex.Unlock()
+	})
+
+	t.Setenv("TTS_KEY", "env-key")
+	t.Setenv("ELEVENLABS_KEY", "")
+	t.Setenv("SERVER_URL", "env.example.com")
+	t.Setenv("MONGO_HOST", "env-mongo")
+	t.Setenv("MONGO_DB", "env-db")
+	t.Setenv("SENTRY_URL", "")
+	os.Unsetenv("SENTRY_URL") // Restored by t.Setenv once the test ends
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"TTS_KEY", "env-key", true},                // Secrets in the environment win
+		{"ELEVENLABS_KEY", "file-elevenlabs", true}, // Unless they are empty
+		{"SERVER_URL", "file.example.com", true},    // Anything else comes from the file first
+		{"MONGO_HOST", "", true},                    // Even when the file sets it empty
+		{"MONGO_DB", "env-db", true},                // The environment fills in what the file leaves out
+		{"SENTRY_URL", "", false},
+	}
+	for _, test := range tests {
+		value, ok := lookupSetting(test.name)
+		if value != test.value || ok != test.ok {
+			t.Errorf("lookupSetting(%s) = %q, %v, want %q, %v", test.name, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+func TestReloadConfigKeepsOldConfig(t *testing.T) {
+	dir := t.TempDir()
+	oldFile, oldModTime := configFile, configModTime
+	settingsMutex.Lock()
+	oldSettings := configSettings
+	settingsMutex.Unlock()
+	t.Cleanup(func() {
+		// Reload from an empty file so every reloadable setting goes back to the environment
+		writeConfig(t, dir, "")
+		reloadConfig()
+		settingsMutex.Lock()
+		configSettings = oldSettings
+		settingsMutex.Unlock()
+		configFile, configModTime = oldFile, oldModTime
+	})
+
+	configFile = writeConfig(t, dir, `
+channels:
+  - name: streamer
+    key: first-key
+`)
+	reloadConfig()
+	if !authorizeChannel("streamer", "first-key") {
+		t.Fatal("channel key from the config file wasn't applied")
+	}
+
+	writeConfig(t, dir, `
+channels:
+  - name: streamer
+    key: second-key
+  - name: streamer
+    key: third-key
+`)
+	reloadConfig()
+	if !authorizeChannel("streamer", "first-key") || authorizeChannel("streamer", "second-key") {
+		t.Fatal("invalid config file replaced the running config")
+	}
+	if got := getSetting("TTS_CHANNEL_KEYS"); got != `[{"channel":"streamer","key":"first-key"}]` {
+		t.Fatalf("TTS_CHANNEL_KEYS = %s after an invalid reload", got)
+	}
+
+	writeConfig(t, dir, `
+channels:
+  - name: streamer
+    key: second-key
+`)
+	reloadConfig()
+	if authorizeChannel("streamer", "first-key") || !authorizeChannel("streamer", "second-key") {
+		t.Fatal("valid config file wasn't applied after a failed reload")
+	}
+}
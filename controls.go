@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	playbacks      = make(map[string]*playbackState)
+	pausedChannels = make(map[string]bool)
+	skippedJobs    = make(map[string]bool)
+	playbackMutex  = sync.Mutex{}
+
+	errPlaybackSkipped = errors.New("skipped by moderator")
+	errPlaybackTimeout = errors.New("timeout waiting for playback confirmation")
+)
+
+// Moderator control actions
+const (
+	actionSkip   = "skip"
+	actionPause  = "pause"
+	actionResume = "resume"
+	actionClear  = "clear"
+)
+
+// playbackState is the segment a channel is currently waiting on
+type playbackState struct {
+	jobID string
+	// done receives nil when the client confirms playback or errPlaybackSkipped on skip
+	done chan error
+	// paused receives the new pause state so the confirmation timeout can be held
+	paused chan bool
+}
+
+// ControlResponse is returned by the moderator control endpoints
+type ControlResponse struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+	Cleared int    `json:"cleared,omitempty"`
+}
+
+// startPlayback registers the segment a channel is about to wait on
+func startPlayback(channel string, jobID string) *playbackState {
+	playbackMutex.Lock()
+	defer playbackMutex.Unlock()
+	state := &playbackState{
+		jobID:  jobID,
+		done:   make(chan error, 1),
+		paused: make(chan bool, 1),
+	}
+	playbacks[channel] = state
+	return state
+}
+
+// finishPlayback releases the wait on a channel's segment if it still belongs to jobID
+// An empty jobID matches whatever is playing
+func finishPlayback(channel string, jobID string, err error) bool {
+	playbackMutex.Lock()
+	defer playbackMutex.Unlock()
+	state, ok := playbacks[channel]
+	if !ok || (jobID != "" && state.jobID != jobID) {
+		return false
+	}
+	delete(playbacks, channel)
+	state.done <- err
+	return true
+}
+
+// waitForPlayback blocks until the segment is confirmed, skipped or times out
+// The timeout is held while the channel is paused and restarts on resume
+func waitForPlayback(state *playbackState, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case err := <-state.done:
+			return err
+		case paused := <-state.paused:
+			if paused {
+				timer.Stop()
+			} else {
+				timer.Reset(timeout)
+			}
+		case <-timer.C:
+			return errPlaybackTimeout
+		}
+	}
+}
+
+// isJobSkipped reports whether a moderator skipped a job before or while it played
+func isJobSkipped(jobID string) bool {
+	playbackMutex.Lock()
+	defer playbackMutex.Unlock()
+	return skippedJobs[jobID]
+}
+
+func forgetSkippedJob(jobID string) {
+	playbackMutex.Lock()
+	defer playbackMutex.Unlock()
+	delete(skippedJobs, jobID)
+}
+
+// skipCurrent stops the message playing on a channel, including segments not sent yet
+func skipCurrent(channel string) (*QueueJob, bool) {
+	current := skipCurrentJob(channel)
+	if current == nil {
+		return nil, false
+	}
+
+	sendControlMessage(channel, ControlMessage{Type: controlSkip, JobID: current.ID})
+	finishPlayback(channel, current.ID, errPlaybackSkipped)
+	return current, true
+}
+
+// setChannelPaused pauses or resumes a channel's overlays and queue
+func setChannelPaused(channel string, paused bool) bool {
+	playbackMutex.Lock()
+	if pausedChannels[channel] == paused {
+		playbackMutex.Unlock()
+		return false
+	}
+	if paused {
+		pausedChannels[channel] = true
+	} else {
+		delete(pausedChannels, channel)
+	}
+	if state, ok := playbacks[channel]; ok {
+		// Drop a pending state change the waiter hasn't seen, only the latest matters
+		select {
+		case <-state.paused:
+		default:
+		}
+		state.paused <- paused
+	}
+	playbackMutex.Unlock()
+
+	controlType := controlResume
+	if paused {
+		controlType = controlPause
+	}
+	sendControlMessage(channel, ControlMessage{Type: controlType})
+	return true
+}
+
+func isChannelPaused(channel string) bool {
+	playbackMutex.Lock()
+	defer playbackMutex.Unlock()
+	return pausedChannels[channel]
+}
+
+// waitWhilePaused holds the queue worker until the channel is resumed
+func waitWhilePaused(channel string) {
+	for isChannelPaused(channel) {
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// handleControl lets moderators skip, pause, resume or clear a channel's queue
+// GET requests return plain text so chat bots can show the response directly, POST returns JSON
+func handleControl(w http.ResponseWriter, r *http.Request) {
+	action := strings.ToLower(mux.Vars(r)["action"])
+	channel := strings.ToLower(r.FormValue("channel"))
+	if channel == "" {
+		http.Error(w, "Missing channel", http.StatusBadRequest)
+		return
+	}
+	if !requireChannelAuth(w, r, channel, r.FormValue("key")) {
+		return
+	}
+
+	response := ControlResponse{Action: action, Channel: channel}
+	switch action {
+	case actionSkip:
+		if job, ok := skipCurrent(channel); ok {
+			response.Message = "Skipped the current message"
+			logger("Moderator skipped job "+getAudioDataName(job.ID), logInfo, channel)
+		} else {
+			response.Message = "Nothing is playing"
+		}
+	case actionPause:
+		if setChannelPaused(channel, true) {
+			response.Message = "TTS paused"
+			logger("Moderator paused playback", logInfo, channel)
+		} else {
+			response.Message = "TTS is already paused"
+		}
+	case actionResume:
+		if setChannelPaused(channel, false) {
+			response.Message = "TTS resumed"
+			logger("Moderator resumed playback", logInfo, channel)
+		} else {
+			response.Message = "TTS is not paused"
+		}
+	case actionClear:
+		response.Cleared = clearQueue(channel)
+		response.Message = fmt.Sprintf("Cleared %d queued messages", response.Cleared)
+		logger(response.Message, logInfo, channel)
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, response.Message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var donationSettings []DonationSettings
+
+// Donation is a tip from any donation source, normalized so every source is read out the same way
+type Donation struct {
+	Source      string
+	Channel     string
+	Donor       string
+	AmountCents int    // Amount in the smallest unit of Currency
+	Currency    string // ISO 4217 code, e.g. USD
+	Message     string
+}
+
+// DonationSettings are shared by every donation source on a channel, "*" applies to channels without their own entry
+type DonationSettings struct {
+	Channel  string `json:"channel"`
+	Template string `json:"template"`  // Read out for each tip, using {donor}, {amount} and {message}
+	MinCents int    `json:"min_cents"` // Tips below this amount are ignored
+	Voice    string `json:"voice"`     // Default voice for tips, overrides PALLY_VOICES
+	Alert    *bool  `json:"alert"`     // Play the channel's alert sound first (default true)
+}
+
+// DonationKey links a donation source's token to a channel
+type DonationKey struct {
+	Channel string `json:"channel"`
+	Token   string `json:"token"`
+}
+
+// currencyName is how an amount in a currency is read out
+type currencyName struct {
+	Unit, Units, Sub, Subs string
+}
+
+var currencyNames = map[string]currencyName{
+	"USD": {"dollar", "dollars", "cent", "cents"},
+	"CAD": {"Canadian dollar", "Canadian dollars", "cent", "cents"},
+	"AUD": {"Australian dollar", "Australian dollars", "cent", "cents"},
+	"EUR": {"euro", "euros", "cent", "cents"},
+	"GBP": {"pound", "pounds", "penny", "pence"},
+}
+
+func setupDonations() {
+	donationSettings = nil
+	settings := getSetting("DONATION_SETTINGS")
+	if settings == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(settings), &donationSettings)
+	if err != nil {
+		logger("Error unmarshalling donation settings: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range donationSettings {
+		donationSettings[i].Channel = strings.ToLower(donationSettings[i].Channel)
+	}
+}
+
+// loadDonationKeys reads a JSON list of channel/token pairs from an environment variable
+func loadDonationKeys(name string) []DonationKey {
+	var keys []DonationKey
+	config := getSetting(name)
+	if config == "" {
+		return nil
+	}
+	err := json.Unmarshal([]byte(config), &keys)
+	if err != nil {
+		logger("Error unmarshalling "+name+": "+err.Error(), logError, "Universal")
+		return nil
+	}
+	var valid []DonationKey
+	for _, key := range keys {
+		if key.Channel == "" || key.Token == "" {
+			continue
+		}
+		key.Channel = strings.ToLower(key.Channel)
+		valid = append(valid, key)
+	}
+	return valid
+}
+
+// getDonationSettings returns the settings for a channel, falling back to the "*" entry
+func getDonationSettings(channel string) DonationSettings {
+	var fallback DonationSettings
+	for _, settings := range readConfig(&donationSettings) {
+		if settings.Channel == channel {
+			return settings
+		}
+		if settings.Channel == "*" {
+			fallback = settings
+		}
+	}
+	return fallback
+}
+
+func isDonationSource(source string) bool {
+	switch source {
+	case sourcePally, sourceKofi, sourceStreamElements, sourceStreamlabs:
+		return true
+	}
+	return false
+}
+
+// parseAmountCents converts an amount like 5, 5.5 or "5.50" into cents
+func parseAmountCents(value json.RawMessage) (int, bool) {
+	text := strings.Trim(string(value), `"`)
+	amount, err := strconv.ParseFloat(strings.ReplaceAll(text, ",", ""), 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	return int(math.Round(amount * 100)), true
+}
+
+// formatDonationAmount writes an amount out in words, e.g. "5 dollars and 50 cents"
+func formatDonationAmount(cents int, currency string) string {
+	currency = strings.ToUpper(currency)
+	if currency == "" {
+		currency = "USD"
+	}
+	units := cents / 100
+	subunits := cents % 100
+	name, known := currencyNames[currency]
+	if !known {
+		return fmt.Sprintf("%d.%02d %s", units, subunits, currency)
+	}
+
+	plural := func(count int, one string, many string) string {
+		if count == 1 {
+			return fmt.Sprintf("%d %s", count, one)
+		}
+		return fmt.Sprintf("%d %s", count, many)
+	}
+	if subunits == 0 {
+		return plural(units, name.Unit, name.Units)
+	}
+	if units == 0 {
+		return plural(subunits, name.Sub, name.Subs)
+	}
+	return plural(units, name.Unit, name.Units) + " and " + plural(subunits, name.Sub, name.Subs)
+}
+
+// handleDonation reads out a tip from any donation source
+func handleDonation(donation Donation) {
+	channel := donation.Channel
+	receivedAt := time.Now()
+
+	settings := getDonationSettings(channel)
+	if donation.AmountCents < settings.MinCents {
+		logger(fmt.Sprintf("Ignoring %s tip from %s below the minimum", donation.Source, donation.Donor), logInfo, channel)
+		return
+	}
+
+	donor := donation.Donor
+	if donor == "" {
+		logger("No username found in tip so assuming it's anonymous", logInfo, channel)
+		donor = "Anonymous"
+	}
+
+	// Check if there is a connected client for the channel
+	for !channelHasClient(channel) {
+		if time.Since(receivedAt) > 30*time.Second {
+			logger("No connected client", logInfo, channel)
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	// Only the donor's own message is moderated, a rejected message still gets the tip announced
+	message := strings.TrimSpace(donation.Message)
+	if message != "" {
+		moderation := moderateMessage(channel, message, donation.Source)
+		if moderation.Rejected {
+			logger(donation.Source+" message from "+donor+" rejected by moderation", logInfo, channel)
+		}
+		message = moderation.Text
+	}
+
+	template := settings.Template
+	if template == "" {
+		template = "{donor} just tipped {amount}! {message}"
+		if donation.Source == sourcePally {
+			template = "{donor} just tipped {amount} to the mods! {message}"
+		}
+	}
+
+	// Fall back to the channel's Pally voice so existing setups keep their voice
+	voice := settings.Voice
+	if voice == "" {
+		for _, pallyVoice := range readConfig(&pallyVoices) {
+			if pallyVoice.Channel == channel {
+				voice = pallyVoice.Voice
+				break
+			}
+		}
+	}
+
+	// Use unified message processor - now supports voice tags, modifiers, and effects
+	stability, similarityBoost, style := getVoiceSettings(channel)
+	msg := Message{
+		Channel:         channel,
+		DefaultVoice:    voice,
+		Stability:       stability,
+		SimilarityBoost: similarityBoost,
+		Style:           style,
+		PlayAlert:       settings.Alert == nil || *settings.Alert,
+		Stitch:          readConfig(&stitchEnabled),
+		User:            donor,
+		Announcement:    true,
+	}
+	msg.Text = applyAlertTier(&msg, donation.AmountCents, template, []string{
+		"{donor}", donor,
+		"{amount}", formatDonationAmount(donation.AmountCents, donation.Currency),
+		"{message}", message,
+	})
+	if msg.Text == "" {
+		return
+	}
+	logger(msg.Text, logInfo, channel)
+
+	var err error
+	if shouldHold(channel, donation.Source, donor, donation.AmountCents, false) {
+		_, err = holdMessage(msg, donation.Source, donor, donation.AmountCents)
+	} else {
+		_, _, err = enqueueMessage(msg)
+	}
+	if err != nil {
+		logger("Error queueing "+donation.Source+" message: "+err.Error(), logError, channel)
+		return
+	}
+
+	// Log to MongoDB if enabled
+	if mongoEnabled {
+		requestTime := fmt.Sprintf("%d", time.Now().UnixNano())
+		request := Request{
+			Channel: channel + "-" + donation.Source,
+			Text:    msg.Text,
+			Time:    requestTime,
+		}
+		data, err := createData(request)
+		if err != nil {
+			logger("Error creating data: "+err.Error(), logError, channel)
+			return
+		}
+		addData(data)
+	}
+}
@@ -1,96 +1,342 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 var (
 	effectFolder = "effects"
+
+	// effectFuzzyMatch lets tags match part of an effect name when nothing matches exactly
+	effectFuzzyMatch bool
+
+	effects         = make(map[string]*Effect) // Lowercase name to effect
+	effectAliases   = make(map[string]string)  // Lowercase alias to lowercase name
+	effectSignature string
+	effectMutex     = sync.RWMutex{}
 )
 
+// How often the effects folder is checked for changes
+const effectWatchInterval = 5 * time.Second
+
 type FileListData struct {
 	Files []string
 }
 
-func listEffects(w http.ResponseWriter, _ *http.Request) {
-	var responseString string
-	//check if effect folder exists and if so get all .mp3 files in it
-	if _, err := os.Stat(effectFolder); err == nil {
-		files, err := os.ReadDir(effectFolder)
+// EffectMeta is read from the optional <name>.json sidecar next to an effect
+type EffectMeta struct {
+	Aliases     []string `json:"aliases"`
+	Category    string   `json:"category"`
+	GainDB      float64  `json:"gain_db"`      // Volume change in dB applied when the effect is played
+	MaxDuration float64  `json:"max_duration"` // Cut the effect off after this many seconds, 0 plays all of it
+	Channels    []string `json:"channels"`     // Channels that may use the effect, empty for all
+	Disabled    bool     `json:"disabled"`
+}
+
+// Effect is a sound effect in the library
+type Effect struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	EffectMeta
+
+	audioMutex sync.Mutex
+	audio      []byte
+}
+
+func setupEffects() {
+	effectFuzzyMatch = strings.ToLower(getSetting("EFFECT_FUZZY_MATCH")) == "true"
+	loadEffects()
+	go watchEffects()
+}
+
+// effectFolderSignature summarizes the effects folder so changes can be spotted without reloading it
+func effectFolderSignature() string {
+	files, err := os.ReadDir(effectFolder)
+	if err != nil {
+		return ""
+	}
+	var signature strings.Builder
+	for _, file := range files {
+		info, err := file.Info()
 		if err != nil {
-			logger("Error reading effects folder: "+err.Error(), logError, "Universal")
-			w.Write([]byte("Error reading effect folder: " + err.Error()))
-			return
-		} else {
-			for _, file := range files {
-				if strings.HasSuffix(file.Name(), ".mp3") {
-					responseString += strings.TrimSuffix(file.Name(), ".mp3") + ", "
-				}
+			continue
+		}
+		fmt.Fprintf(&signature, "%s:%d:%d;", file.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return signature.String()
+}
+
+// loadEffects indexes every .mp3 in the effects folder along with its sidecar metadata
+func loadEffects() {
+	signature := effectFolderSignature()
+	files, err := os.ReadDir(effectFolder)
+	if err != nil && !os.IsNotExist(err) {
+		logger("Error reading effects folder: "+err.Error(), logError, "Universal")
+	}
+
+	library := make(map[string]*Effect)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".mp3") {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".mp3")
+		effect := &Effect{Name: name, File: file.Name()}
+		if data, err := os.ReadFile(filepath.Join(effectFolder, name+".json")); err == nil {
+			if err := json.Unmarshal(data, &effect.EffectMeta); err != nil {
+				logger("Error reading metadata for effect "+name+": "+err.Error(), logError, "Universal")
 			}
 		}
-	} else {
-		w.Write([]byte("Effects folder does not exist"))
-		return
+		library[strings.ToLower(name)] = effect
 	}
 
-	responseString = strings.TrimSuffix(responseString, ", ")
+	// Names always win over aliases, and the first effect to claim an alias keeps it
+	aliases := make(map[string]string)
+	keys := make([]string, 0, len(library))
+	for key := range library {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, alias := range library[key].Aliases {
+			alias = strings.ToLower(strings.TrimSpace(alias))
+			if alias == "" {
+				continue
+			}
+			if _, isName := library[alias]; isName {
+				logger("Effect alias "+alias+" is already an effect name", logError, "Universal")
+				continue
+			}
+			if owner, taken := aliases[alias]; taken {
+				logger("Effect alias "+alias+" is already used by "+owner, logError, "Universal")
+				continue
+			}
+			aliases[alias] = key
+		}
+	}
+
+	effectMutex.Lock()
+	effects = library
+	effectAliases = aliases
+	effectSignature = signature
+	effectMutex.Unlock()
 
-	w.Write([]byte(responseString))
+	logger(fmt.Sprintf("Loaded %d effects", len(library)), logDebug, "Universal")
 }
 
-func getEffectSound(effect string) ([]byte, bool) {
-	logger("Getting effect sound for: "+effect, logDebug, "Universal")
-	var effectSounds []string
-	//check if effects folder exists and if so get all .mp3 files in it
-	if _, err := os.Stat(effectFolder); err == nil {
-		files, err := os.ReadDir(effectFolder)
-		if err != nil {
-			logger("Error reading effects folder: "+err.Error(), logError, "Universal")
-			return nil, false
-		} else {
-			for _, file := range files {
-				if strings.HasSuffix(file.Name(), ".mp3") {
-					effectSounds = append(effectSounds, file.Name())
-				}
-			}
+// watchEffects reloads the library when files in the effects folder change
+func watchEffects() {
+	for {
+		time.Sleep(effectWatchInterval)
+		signature := effectFolderSignature()
+		effectMutex.RLock()
+		changed := signature != effectSignature
+		effectMutex.RUnlock()
+		if changed {
+			logger("Effects folder changed, reloading effects", logInfo, "Universal")
+			loadEffects()
 		}
-	} else {
+	}
+}
+
+// availableTo reports whether a channel may use the effect
+func (effect *Effect) availableTo(channel string) bool {
+	if effect.Disabled {
+		return false
+	}
+	if len(effect.Channels) == 0 {
+		return true
+	}
+	for _, allowed := range effect.Channels {
+		if strings.EqualFold(allowed, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveEffect finds the effect a tag refers to, by exact name first and then by alias
+// Partial matches are only tried when EFFECT_FUZZY_MATCH is enabled
+func resolveEffect(tag string, channel string) (*Effect, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
 		return nil, false
 	}
 
-	// check if there are any effect sounds in the folder
-	if len(effectSounds) == 0 {
-		logger("No effect sounds found in effect folder: "+effectFolder, logDebug, "Universal")
+	effectMutex.RLock()
+	defer effectMutex.RUnlock()
+
+	if effect, ok := effects[tag]; ok {
+		return effect, effect.availableTo(channel)
+	}
+	if name, ok := effectAliases[tag]; ok {
+		effect := effects[name]
+		return effect, effect.availableTo(channel)
+	}
+	if !effectFuzzyMatch {
 		return nil, false
 	}
 
-	// get the effect sound from the list of effect sounds if the name of the effect is contained in the file name
-	var effectSelected string
-	for _, sound := range effectSounds {
-		if strings.Contains(sound, effect) {
-			effectSelected = sound
+	// Prefer names that start with the tag, then the shortest name, so the closest match wins every time
+	var best *Effect
+	bestPrefix := false
+	for key, effect := range effects {
+		if !strings.Contains(key, tag) || !effect.availableTo(channel) {
+			continue
+		}
+		prefix := strings.HasPrefix(key, tag)
+		switch {
+		case best == nil,
+			prefix && !bestPrefix,
+			prefix == bestPrefix && len(key) < len(best.Name),
+			prefix == bestPrefix && len(key) == len(best.Name) && key < strings.ToLower(best.Name):
+			best = effect
+			bestPrefix = prefix
+		}
+	}
+	return best, best != nil
+}
+
+// listAvailableEffects returns the effects a channel may use sorted by name, an empty channel lists effects open to everyone
+func listAvailableEffects(channel string) []*Effect {
+	effectMutex.RLock()
+	defer effectMutex.RUnlock()
+	var list []*Effect
+	for _, effect := range effects {
+		if effect.availableTo(channel) {
+			list = append(list, effect)
+		}
+	}
+	sortEffects(list)
+	return list
+}
+
+// sortEffects orders effects by name ignoring case
+func sortEffects(list []*Effect) {
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+}
+
+func listEffects(w http.ResponseWriter, r *http.Request) {
+	if _, err := os.Stat(effectFolder); err != nil {
+		w.Write([]byte("Effects folder does not exist"))
+		return
+	}
+
+	var names []string
+	for _, effect := range listAvailableEffects(strings.ToLower(r.URL.Query().Get("channel"))) {
+		names = append(names, effect.Name)
+	}
+	w.Write([]byte(strings.Join(names, ", ")))
+}
+
+// serveEffectFile serves the audio of one effect from the library
+// Only effects the channel may use are served, unless the global TTS_KEY is sent, and sidecars never are
+func serveEffectFile(w http.ResponseWriter, r *http.Request) {
+	file := mux.Vars(r)["file"]
+	channel := strings.ToLower(r.URL.Query().Get("channel"))
+	admin := keysMatch(r.URL.Query().Get("key"), ttsKey)
+
+	var effect *Effect
+	effectMutex.RLock()
+	for _, candidate := range effects {
+		if candidate.File == file && (admin || candidate.availableTo(channel)) {
+			effect = candidate
 			break
 		}
 	}
-	if effectSelected == "" {
-		logger("No effect sound found for: "+effect, logDebug, "Universal")
-		return nil, false
+	effectMutex.RUnlock()
+	if effect == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(effectFolder, effect.File))
+	if err != nil {
+		http.NotFound(w, r)
+		return
 	}
-	effectSound, err := os.Open(fmt.Sprintf("%s/%s", effectFolder, effectSelected))
+	defer f.Close()
+	info, err := f.Stat()
 	if err != nil {
-		logger("Error opening effect sound: "+err.Error(), logError, "Universal")
+		http.Error(w, "Error reading effect", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	http.ServeContent(w, r, effect.File, info.ModTime(), f)
+}
+
+// getEffectSound returns the audio for an effect tag with the effect's gain and length limit applied
+func getEffectSound(tag string, channel string) ([]byte, bool) {
+	logger("Getting effect sound for: "+tag, logDebug, channel)
+	effect, found := resolveEffect(tag, channel)
+	if !found {
+		logger("No effect sound found for: "+tag, logDebug, channel)
 		return nil, false
 	}
 
-	effectSoundBytes, err := io.ReadAll(effectSound)
+	// Effects are processed once and kept until the library is reloaded
+	// Failed reads and failed processing aren't kept so the next request tries again
+	effect.audioMutex.Lock()
+	defer effect.audioMutex.Unlock()
+	if effect.audio != nil {
+		return effect.audio, true
+	}
+	data, err := os.ReadFile(filepath.Join(effectFolder, effect.File))
 	if err != nil {
-		logger("Error reading effect sound: "+err.Error(), logError, "Universal")
+		logger("Error reading effect sound: "+err.Error(), logError, channel)
 		return nil, false
 	}
+	if effect.GainDB != 0 || effect.MaxDuration > 0 {
+		processed, err := processEffect(data, effect)
+		if err != nil {
+			logger("Error processing effect "+effect.Name+", playing it unchanged: "+err.Error(), logError, channel)
+			return data, true
+		}
+		data = processed
+	}
+	effect.audio = data
+	return effect.audio, true
+}
+
+// processEffect applies an effect's gain and maximum duration with ffmpeg
+func processEffect(data []byte, effect *Effect) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), modifierTimeout)
+	defer cancel()
 
-	return effectSoundBytes, true
+	args := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0"}
+	if effect.MaxDuration > 0 {
+		args = append(args, "-t", strconv.FormatFloat(effect.MaxDuration, 'f', -1, 64))
+	}
+	if effect.GainDB != 0 {
+		args = append(args, "-af", "volume="+strconv.FormatFloat(effect.GainDB, 'f', -1, 64)+"dB")
+	}
+	args = append(args, "-b:a", "320k", "-f", "mp3", "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg produced no audio")
+	}
+	return stdout.Bytes(), nil
 }
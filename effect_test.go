@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestServeEffectFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"airhorn.mp3":  "airhorn audio",
+		"airhorn.json": `{"aliases": ["horn"]}`,
+		"private.mp3":  "private audio",
+		"private.json": `{"channels": ["streamer"]}`,
+		"hidden.mp3":   "hidden audio",
+		"hidden.json":  `{"disabled": true}`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldFolder, oldKey := effectFolder, ttsKey
+	t.Cleanup(func() {
+		effectFolder, ttsKey = oldFolder, oldKey
+		loadEffects()
+	})
+	effectFolder = dir
+	ttsKey = "admin-key"
+	loadEffects()
+
+	tests := []struct {
+		file  string
+		query string
+		want  int
+	}{
+		{"airhorn.mp3", "", http.StatusOK},
+		{"airhorn.json", "", http.StatusNotFound},
+		{"airhorn.json", "key=admin-key", http.StatusNotFound},
+		{"private.mp3", "", http.StatusNotFound},
+		{"private.mp3", "channel=other", http.StatusNotFound},
+		{"private.mp3", "channel=Streamer", http.StatusOK},
+		{"hidden.mp3", "channel=streamer", http.StatusNotFound},
+		{"hidden.mp3", "key=wrong-key", http.StatusNotFound},
+		{"hidden.mp3", "key=admin-key", http.StatusOK},
+		{"missing.mp3", "key=admin-key", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/effects/"+test.file+"?"+test.query, nil)
+		request = mux.SetURLVars(request, map[string]string{"file": test.file})
+		recorder := httptest.NewRecorder()
+		serveEffectFile(recorder, request)
+		if recorder.Code != test.want {
+			t.Errorf("%s?%s: got status %d, want %d", test.file, test.query, recorder.Code, test.want)
+			continue
+		}
+		if test.want == http.StatusOK && recorder.Body.String() != files[test.file] {
+			t.Errorf("%s?%s: got body %q, want %q", test.file, test.query, recorder.Body.String(), files[test.file])
+		}
+	}
+}
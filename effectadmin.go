@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	effectMaxBytes   int64 = 5 * 1024 * 1024
+	effectMaxSeconds       = 30.0
+	effectTargetLUFS       = -16.0
+
+	// Management changes are made one at a time so a rename can't race a delete
+	effectAdminMutex = sync.Mutex{}
+
+	effectNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+	errEffectExists   = errors.New("an effect, alias, voice or modifier already uses that name")
+	errEffectNotFound = errors.New("effect not found")
+)
+
+// Formats ffprobe may report for an upload, everything is stored as mp3
+var effectUploadFormats = map[string]bool{
+	"mp3":  true,
+	"wav":  true,
+	"ogg":  true,
+	"flac": true,
+}
+
+// How long ffprobe and ffmpeg get to check and convert an upload
+const effectIngestTimeout = 60 * time.Second
+
+// effectProbe is the part of ffprobe's output used to validate uploads
+type effectProbe struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+func setupEffectUploads() {
+	if maxMB := getSetting("EFFECT_MAX_SIZE_MB"); maxMB != "" {
+		mb, err := strconv.Atoi(maxMB)
+		if err != nil || mb <= 0 {
+			logger("Invalid EFFECT_MAX_SIZE_MB, using default", logError, "Universal")
+		} else {
+			effectMaxBytes = int64(mb) * 1024 * 1024
+		}
+	}
+	if maxSeconds := getSetting("EFFECT_MAX_SECONDS"); maxSeconds != "" {
+		seconds, err := strconv.ParseFloat(maxSeconds, 64)
+		if err != nil || seconds <= 0 {
+			logger("Invalid EFFECT_MAX_SECONDS, using default", logError, "Universal")
+		} else {
+			effectMaxSeconds = seconds
+		}
+	}
+	if target := getSetting("EFFECT_TARGET_LUFS"); target != "" {
+		lufs, err := strconv.ParseFloat(target, 64)
+		if err != nil || lufs < -70 || lufs > -5 {
+			logger("Invalid EFFECT_TARGET_LUFS, using default", logError, "Universal")
+		} else {
+			effectTargetLUFS = lufs
+		}
+	}
+}
+
+// effectNameTaken reports whether a tag would already resolve to something other than the effect being changed
+func effectNameTaken(name string, except string) bool {
+	key := strings.ToLower(name)
+	if voiceNameInUse(name) || isModifier(key) {
+		return true
+	}
+	effectMutex.RLock()
+	defer effectMutex.RUnlock()
+	if _, ok := effects[key]; ok && key != except {
+		return true
+	}
+	if owner, ok := effectAliases[key]; ok && owner != except {
+		return true
+	}
+	return false
+}
+
+// findEffect looks an effect up by its exact name, including disabled and channel only effects
+func findEffect(name string) (*Effect, bool) {
+	effectMutex.RLock()
+	defer effectMutex.RUnlock()
+	effect, ok := effects[strings.ToLower(name)]
+	return effect, ok
+}
+
+// listAllEffects returns every effect in the library sorted by name
+func listAllEffects() []*Effect {
+	effectMutex.RLock()
+	defer effectMutex.RUnlock()
+	list := make([]*Effect, 0, len(effects))
+	for _, effect := range effects {
+		list = append(list, effect)
+	}
+	sortEffects(list)
+	return list
+}
+
+// probeEffect checks an upload is a supported audio file within the length limit
+func probeEffect(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), effectIngestTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=format_name,duration:stream=codec_type", "-of", "json", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("not a readable audio file: %s", strings.TrimSpace(stderr.String()))
+	}
+	var probe effectProbe
+	if err := json.Unmarshal(stdout.Bytes(), &probe); err != nil {
+		return fmt.Errorf("not a readable audio file")
+	}
+
+	supported := false
+	for _, format := range strings.Split(probe.Format.FormatName, ",") {
+		if effectUploadFormats[format] {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("unsupported format %q, use mp3, wav, ogg or flac", probe.Format.FormatName)
+	}
+	hasAudio := false
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			hasAudio = true
+		}
+	}
+	if !hasAudio {
+		return fmt.Errorf("file has no audio")
+	}
+	duration, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("could not read the length of the file")
+	}
+	if duration > effectMaxSeconds {
+		return fmt.Errorf("effect is %.1f seconds long, the limit is %g", duration, effectMaxSeconds)
+	}
+	return nil
+}
+
+// ingestEffect converts an upload to a loudness normalized mp3 at the destination
+func ingestEffect(source string, destination string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), effectIngestTimeout)
+	defer cancel()
+
+	loudnorm := fmt.Sprintf("loudnorm=I=%s:TP=-1.5:LRA=11", strconv.FormatFloat(effectTargetLUFS, 'f', -1, 64))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-y", "-i", source,
+		"-vn", "-map_metadata", "-1", "-af", loudnorm, "-ar", "44100", "-b:a", "320k", "-f", "mp3", destination)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeEffectMeta saves an effect's sidecar, replacing it in one step so the watcher never reads half a file
+func writeEffectMeta(name string, meta EffectMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(effectFolder, ".meta-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(effectFolder, name+".json"))
+}
+
+// splitList reads a comma separated form value, dropping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// applyEffectForm updates metadata with whichever fields were sent, leaving the rest as they were
+func applyEffectForm(r *http.Request, meta *EffectMeta) error {
+	if _, ok := r.Form["aliases"]; ok {
+		meta.Aliases = splitList(r.FormValue("aliases"))
+	}
+	if _, ok := r.Form["category"]; ok {
+		meta.Category = strings.TrimSpace(r.FormValue("category"))
+	}
+	if _, ok := r.Form["channels"]; ok {
+		meta.Channels = splitList(strings.ToLower(r.FormValue("channels")))
+	}
+	if _, ok := r.Form["gain_db"]; ok {
+		gain, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("gain_db")), 64)
+		if err != nil || gain < -30 || gain > 30 {
+			return fmt.Errorf("gain_db must be between -30 and 30")
+		}
+		meta.GainDB = gain
+	}
+	if _, ok := r.Form["max_duration"]; ok {
+		duration, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("max_duration")), 64)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("max_duration must be 0 or more seconds")
+		}
+		meta.MaxDuration = duration
+	}
+	if _, ok := r.Form["disabled"]; ok {
+		meta.Disabled = r.FormValue("disabled") == "true"
+	}
+	return nil
+}
+
+// checkEffectAliases makes sure new aliases won't be shadowed by another tag
+func checkEffectAliases(aliases []string, owner string) error {
+	for _, alias := range aliases {
+		if strings.EqualFold(alias, owner) {
+			continue
+		}
+		if effectNameTaken(alias, strings.ToLower(owner)) {
+			return fmt.Errorf("alias %q: %w", alias, errEffectExists)
+		}
+	}
+	return nil
+}
+
+// writeEffectResponse reloads the library so the change is live and returns the effect
+func writeEffectResponse(w http.ResponseWriter, name string) {
+	loadEffects()
+	effect, ok := findEffect(name)
+	if !ok {
+		http.Error(w, errEffectNotFound.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effect)
+}
+
+// handleEffectUpload adds an effect or replaces one when replace=true
+func handleEffectUpload(w http.ResponseWriter, r *http.Request) {
+	// Leave room for the other form fields on top of the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, effectMaxBytes+1024*1024)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("File is over the %d MB limit", effectMaxBytes/1024/1024), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	if !requireAdminAuth(w, r, r.FormValue("key")) {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !effectNamePattern.MatchString(name) {
+		http.Error(w, "Effect names may only use letters, numbers, - and _", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > effectMaxBytes {
+		http.Error(w, fmt.Sprintf("File is over the %d MB limit", effectMaxBytes/1024/1024), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	effectAdminMutex.Lock()
+	defer effectAdminMutex.Unlock()
+
+	key := strings.ToLower(name)
+	existing, exists := findEffect(name)
+	if exists && r.FormValue("replace") != "true" {
+		http.Error(w, errEffectExists.Error(), http.StatusConflict)
+		return
+	}
+	if effectNameTaken(name, key) {
+		http.Error(w, errEffectExists.Error(), http.StatusConflict)
+		return
+	}
+	// Replacing keeps the original file name so existing metadata stays attached
+	if exists {
+		name = existing.Name
+	}
+
+	var meta EffectMeta
+	if exists {
+		meta = existing.EffectMeta
+	}
+	if err := applyEffectForm(r, &meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkEffectAliases(meta.Aliases, name); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// ffprobe needs a real file to read the length reliably
+	upload, err := os.CreateTemp("", "effect-upload-*")
+	if err != nil {
+		logger("Error saving effect upload: "+err.Error(), logError, "Universal")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(upload.Name())
+	_, err = io.Copy(upload, file)
+	upload.Close()
+	if err != nil {
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+	if err := probeEffect(upload.Name()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := os.MkdirAll(effectFolder, 0755); err != nil {
+		logger("Error creating effects folder: "+err.Error(), logError, "Universal")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Convert next to the library and move it in once finished so a half written effect is never played
+	converted := filepath.Join(effectFolder, ".upload-"+key+".tmp")
+	defer os.Remove(converted)
+	if err := ingestEffect(upload.Name(), converted); err != nil {
+		logger("Error converting effect "+name+": "+err.Error(), logError, "Universal")
+		http.Error(w, "Could not convert the file", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := os.Rename(converted, filepath.Join(effectFolder, name+".mp3")); err != nil {
+		logger("Error saving effect "+name+": "+err.Error(), logError, "Universal")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if exists || meta.Category != "" || len(meta.Aliases) > 0 || len(meta.Channels) > 0 || meta.GainDB != 0 || meta.MaxDuration > 0 || meta.Disabled {
+		if err := writeEffectMeta(name, meta); err != nil {
+			logger("Error saving metadata for effect "+name+": "+err.Error(), logError, "Universal")
+		}
+	}
+
+	logger("Effect "+name+" uploaded from "+r.RemoteAddr, logInfo, "Universal")
+	writeEffectResponse(w, name)
+}
+
+// handleEffectAction renames, tags or deletes an effect
+func handleEffectAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	if !requireAdminAuth(w, r, r.FormValue("key")) {
+		return
+	}
+
+	effectAdminMutex.Lock()
+	defer effectAdminMutex.Unlock()
+
+	effect, ok := findEffect(vars["name"])
+	if !ok {
+		http.Error(w, errEffectNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	name := effect.Name
+	sidecar := filepath.Join(effectFolder, name+".json")
+
+	switch vars["action"] {
+	case "rename":
+		newName := strings.TrimSpace(r.FormValue("name"))
+		if !effectNamePattern.MatchString(newName) {
+			http.Error(w, "Effect names may only use letters, numbers, - and _", http.StatusBadRequest)
+			return
+		}
+		if effectNameTaken(newName, strings.ToLower(name)) {
+			http.Error(w, errEffectExists.Error(), http.StatusConflict)
+			return
+		}
+		if err := os.Rename(filepath.Join(effectFolder, effect.File), filepath.Join(effectFolder, newName+".mp3")); err != nil {
+			logger("Error renaming effect "+name+": "+err.Error(), logError, "Universal")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := os.Rename(sidecar, filepath.Join(effectFolder, newName+".json")); err != nil && !os.IsNotExist(err) {
+			logger("Error renaming metadata for effect "+name+": "+err.Error(), logError, "Universal")
+		}
+		logger("Effect "+name+" renamed to "+newName, logInfo, "Universal")
+		writeEffectResponse(w, newName)
+	case "tag":
+		meta := effect.EffectMeta
+		if err := applyEffectForm(r, &meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkEffectAliases(meta.Aliases, name); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := writeEffectMeta(name, meta); err != nil {
+			logger("Error saving metadata for effect "+name+": "+err.Error(), logError, "Universal")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		logger("Effect "+name+" metadata updated", logInfo, "Universal")
+		writeEffectResponse(w, name)
+	case "delete":
+		if err := os.Remove(filepath.Join(effectFolder, effect.File)); err != nil {
+			logger("Error deleting effect "+name+": "+err.Error(), logError, "Universal")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			logger("Error deleting metadata for effect "+name+": "+err.Error(), logError, "Universal")
+		}
+		logger("Effect "+name+" deleted", logInfo, "Universal")
+		loadEffects()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+	}
+}
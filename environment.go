@@ -19,20 +19,24 @@ func setupENV() {
 	if err != nil {
 		logger("Error loading .env file", logError, "Universal")
 	}
-	elevenKey = os.Getenv("ELEVENLABS_KEY")
-	serverURL = os.Getenv("SERVER_URL")
-	sentryURL = os.Getenv("SENTRY_URL")
-	ttsKey = os.Getenv("TTS_KEY")
-	ffmpegEnabled := strings.ToLower(os.Getenv("FFMPEG_ENABLED"))
-	mongoUser = os.Getenv("MONGO_USER")
-	mongoPass = os.Getenv("MONGO_PASS")
-	mongoHost = os.Getenv("MONGO_HOST")
-	mongoPort = os.Getenv("MONGO_PORT")
-	dbName = os.Getenv("MONGO_DB")
-	if elevenKey == "" || serverURL == "" || ttsKey == "" || ffmpegEnabled != "true" {
+	setupConfig()
+	elevenKey = getSetting("ELEVENLABS_KEY")
+	serverURL = getSetting("SERVER_URL")
+	sentryURL = getSetting("SENTRY_URL")
+	ttsKey = getSetting("TTS_KEY")
+	ffmpegEnabled := strings.ToLower(getSetting("FFMPEG_ENABLED"))
+	mongoUser = getSetting("MONGO_USER")
+	mongoPass = getSetting("MONGO_PASS")
+	mongoHost = getSetting("MONGO_HOST")
+	mongoPort = getSetting("MONGO_PORT")
+	dbName = getSetting("MONGO_DB")
+	if serverURL == "" || ttsKey == "" || ffmpegEnabled != "true" {
 		logger("Missing required environment variables", logError, "Universal")
 		return
 	}
+	if elevenKey == "" {
+		logger("ELEVENLABS_KEY not provided. Only local voices will work.", logInfo, "Universal")
+	}
 	if mongoHost == "" || mongoPort == "" || dbName == "" {
 		logger("MongoDB environment variables not provided. MongoDB will be disabled.", logInfo, "Universal")
 		mongoEnabled = false
@@ -52,11 +56,34 @@ func setupENV() {
 	} else {
 		log.Fatal("Not enough arguments provided. Please provide at least a port number and optionally a log level.")
 	}
+	setupStitching()
+	setupAlignment()
+	setupCache()
+	setupEffects()
+	setupEffectUploads()
+	setupLoudness()
+	setupLocalTTS()
+	setupChannelKeys()
+	setupModeration()
+	setupMessageLimits()
+	setupApproval()
+	setupPendingLimit()
+	setupRateLimits()
+	setupBudgets()
+	setupQueue()
 	setupPally()
 	setupPallyVoices()
+	setupDonations()
+	setupAlertTiers()
+	setupKofi()
+	setupStreamAlerts()
+	setupTwitchChat()
+	setupEventSub()
 	setupVoices()
 	setupVoiceModels()
 	setupVoiceStyles()
 	setupVoiceModifiers()
+	setupVoiceCatalogs()
 	setupDB()
+	go watchConfig()
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	eventSubSecret  string
+	eventSubConfigs []EventSubConfig
+	eventSubSeen    = make(map[string]time.Time)
+	eventSubMutex   = sync.Mutex{}
+
+	// Cheermotes like Cheer100 are part of the message text but shouldn't be read out
+	// Only Twitch's global prefixes are matched so words like mp3 or covid19 are kept
+	cheermotePrefixes = []string{
+		"Cheer", "DoodleCheer", "BibleThump", "cheerwhal", "Corgo", "Scoops", "uni", "ShowLove", "Party",
+		"SeemsGood", "Pride", "Kappa", "FrankerZ", "HeyGuys", "DansGame", "EleGiggle", "TriHard", "Kreygasm",
+		"4Head", "SwiftRage", "NotLikeThis", "FailFish", "VoHiYo", "PJSalt", "MrDestructoid", "bday",
+		"RIPCheer", "Shamrock", "BitBoss", "Streamlabs", "Muxy", "HolidayCheer", "Goal", "Anon", "Charity",
+	}
+	cheermoteRe = cheermoteRegexp(nil)
+)
+
+// EventSub message types and subscription types
+const (
+	eventSubVerification = "webhook_callback_verification"
+	eventSubNotification = "notification"
+	eventSubRevocation   = "revocation"
+
+	eventSubCheer      = "channel.cheer"
+	eventSubResub      = "channel.subscription.message"
+	eventSubRedemption = "channel.channel_points_custom_reward_redemption.add"
+
+	// Twitch resends notifications, anything older than this is refused as a possible replay
+	eventSubMaxAge = 10 * time.Minute
+)
+
+// EventSubConfig sets which Twitch events are read out on a channel, events left out are ignored
+type EventSubConfig struct {
+	Channel    string         `json:"channel"`
+	Voice      string         `json:"voice"`
+	Cheer      *EventTemplate `json:"cheer"`
+	Resub      *EventTemplate `json:"resub"`
+	Redemption *EventTemplate `json:"redemption"`
+	Cheermotes []string       `json:"cheermotes"` // The channel's custom cheermote prefixes, removed from cheers like the global ones
+}
+
+// EventTemplate turns an event into a message
+// Templates can use {user}, {message}, {bits}, {months}, {reward} and {cost}
+type EventTemplate struct {
+	Template string   `json:"template"`
+	Minimum  int      `json:"minimum"` // Bits for cheers, cumulative months for resubs, points for redemptions
+	Rewards  []string `json:"rewards"` // Reward titles to read out, empty for all, redemptions only
+	Voice    string   `json:"voice"`   // Overrides the channel's voice for this event
+	Hold     bool     `json:"hold"`    // Hold these messages for approval
+}
+
+// EventSubNotification is the body of every EventSub webhook request
+type EventSubNotification struct {
+	Challenge    string               `json:"challenge"`
+	Subscription EventSubSubscription `json:"subscription"`
+	Event        json.RawMessage      `json:"event"`
+}
+
+type EventSubSubscription struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Status    string `json:"status"`
+	Condition struct {
+		BroadcasterUserID string `json:"broadcaster_user_id"`
+	} `json:"condition"`
+}
+
+// EventSubEvent holds the fields used from cheer, resub and redemption events
+type EventSubEvent struct {
+	BroadcasterUserLogin string `json:"broadcaster_user_login"`
+	UserName             string `json:"user_name"`
+	IsAnonymous          bool   `json:"is_anonymous"`
+	Bits                 int    `json:"bits"`
+	CumulativeMonths     int    `json:"cumulative_months"`
+	UserInput            string `json:"user_input"`
+	// Cheers send the message as a string, resubs as an object with the text inside
+	Message json.RawMessage `json:"message"`
+	Reward  struct {
+		Title string `json:"title"`
+		Cost  int    `json:"cost"`
+	} `json:"reward"`
+}
+
+func setupEventSub() {
+	eventSubConfigs = nil
+	eventSubSecret = getSetting("TWITCH_EVENTSUB_SECRET")
+	config := getSetting("TWITCH_EVENTS")
+	if config == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(config), &eventSubConfigs)
+	if err != nil {
+		logger("Error unmarshalling Twitch events: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range eventSubConfigs {
+		eventSubConfigs[i].Channel = strings.ToLower(eventSubConfigs[i].Channel)
+	}
+	if eventSubSecret == "" {
+		logger("TWITCH_EVENTS set without TWITCH_EVENTSUB_SECRET, Twitch events will be refused", logError, "Universal")
+	}
+}
+
+func getEventSubConfig(channel string) (EventSubConfig, bool) {
+	for _, config := range readConfig(&eventSubConfigs) {
+		if config.Channel == channel {
+			return config, true
+		}
+	}
+	return EventSubConfig{}, false
+}
+
+// verifyEventSubSignature checks the HMAC Twitch signs every webhook request with
+func verifyEventSubSignature(header http.Header, body []byte) bool {
+	secret := readConfig(&eventSubSecret)
+	if secret == "" {
+		return false
+	}
+	signature, found := strings.CutPrefix(header.Get("Twitch-Eventsub-Message-Signature"), "sha256=")
+	if !found {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header.Get("Twitch-Eventsub-Message-Id")))
+	mac.Write([]byte(header.Get("Twitch-Eventsub-Message-Timestamp")))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// seenEventSubMessage records a message ID and reports whether it was already handled
+func seenEventSubMessage(id string) bool {
+	eventSubMutex.Lock()
+	defer eventSubMutex.Unlock()
+
+	now := time.Now()
+	for seenID, seenAt := range eventSubSeen {
+		if now.Sub(seenAt) > eventSubMaxAge {
+			delete(eventSubSeen, seenID)
+		}
+	}
+	if _, seen := eventSubSeen[id]; seen {
+		return true
+	}
+	eventSubSeen[id] = now
+	return false
+}
+
+// handleEventSub receives Twitch EventSub webhooks
+func handleEventSub(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	if !verifyEventSubSignature(r.Header, body) {
+		logger("Invalid EventSub signature from "+r.RemoteAddr, logInfo, "Universal")
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, r.Header.Get("Twitch-Eventsub-Message-Timestamp"))
+	if err != nil || time.Since(timestamp) > eventSubMaxAge {
+		logger("Refusing stale EventSub message", logInfo, "Universal")
+		http.Error(w, "Message too old", http.StatusForbidden)
+		return
+	}
+
+	var notification EventSubNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Header.Get("Twitch-Eventsub-Message-Type") {
+	case eventSubVerification:
+		logger("Verified EventSub subscription for "+notification.Subscription.Type, logInfo, "Universal")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(notification.Challenge))
+	case eventSubRevocation:
+		logger("EventSub subscription for "+notification.Subscription.Type+" revoked: "+notification.Subscription.Status, logError, "Universal")
+		w.WriteHeader(http.StatusNoContent)
+	case eventSubNotification:
+		// Twitch retries anything not acknowledged quickly, so reply before the message is processed
+		w.WriteHeader(http.StatusNoContent)
+		if seenEventSubMessage(r.Header.Get("Twitch-Eventsub-Message-Id")) {
+			logger("Ignoring duplicate EventSub message", logDebug, "Universal")
+			return
+		}
+		go handleEventSubNotification(notification)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// cheermoteRegexp matches the global cheermotes and any extra prefixes followed by an amount
+func cheermoteRegexp(extra []string) *regexp.Regexp {
+	var prefixes []string
+	for _, prefix := range append(extra, cheermotePrefixes...) {
+		prefixes = append(prefixes, regexp.QuoteMeta(prefix))
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(prefixes, "|") + `)\d+\b`)
+}
+
+// removeCheermotes strips cheermotes from a cheer message
+func removeCheermotes(text string, extra []string) string {
+	re := cheermoteRe
+	if len(extra) > 0 {
+		re = cheermoteRegexp(extra)
+	}
+	return strings.Join(strings.Fields(re.ReplaceAllString(text, "")), " ")
+}
+
+// eventMessageText returns the viewer's message from a cheer or resub event
+func eventMessageText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var message struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &message); err == nil {
+		return message.Text
+	}
+	return ""
+}
+
+func handleEventSubNotification(notification EventSubNotification) {
+	var event EventSubEvent
+	if err := json.Unmarshal(notification.Event, &event); err != nil {
+		logger("Error unmarshalling EventSub event: "+err.Error(), logError, "Universal")
+		return
+	}
+	channel := strings.ToLower(event.BroadcasterUserLogin)
+	config, ok := getEventSubConfig(channel)
+	if !ok {
+		logger("No Twitch events configured", logDebug, channel)
+		return
+	}
+
+	username := event.UserName
+	if username == "" || event.IsAnonymous {
+		username = "Anonymous"
+	}
+
+	var template *EventTemplate
+	var text, defaultTemplate string
+	amount := 0
+	replacements := []string{"{user}", username}
+	switch notification.Subscription.Type {
+	case eventSubCheer:
+		template = config.Cheer
+		amount = event.Bits
+		text = removeCheermotes(eventMessageText(event.Message), config.Cheermotes)
+		defaultTemplate = "{user} cheered {bits} bits! {message}"
+		// {donor} and {amount} let alert tier templates work for cheers too
+		replacements = append(replacements, "{bits}", strconv.Itoa(event.Bits), "{donor}", username, "{amount}", strconv.Itoa(event.Bits)+" bits")
+	case eventSubResub:
+		template = config.Resub
+		amount = event.CumulativeMonths
+		text = eventMessageText(event.Message)
+		defaultTemplate = "{user} resubscribed for {months} months! {message}"
+		replacements = append(replacements, "{months}", strconv.Itoa(event.CumulativeMonths))
+	case eventSubRedemption:
+		template = config.Redemption
+		amount = event.Reward.Cost
+		text = event.UserInput
+		defaultTemplate = "{user} redeemed {reward}! {message}"
+		replacements = append(replacements, "{reward}", event.Reward.Title, "{cost}", strconv.Itoa(event.Reward.Cost))
+	default:
+		logger("Unsupported EventSub type "+notification.Subscription.Type, logDebug, channel)
+		return
+	}
+	if template == nil {
+		logger(notification.Subscription.Type+" events aren't enabled", logDebug, channel)
+		return
+	}
+	if amount < template.Minimum {
+		logger(fmt.Sprintf("Ignoring %s from %s below the minimum of %d", notification.Subscription.Type, username, template.Minimum), logInfo, channel)
+		return
+	}
+	if notification.Subscription.Type == eventSubRedemption && len(template.Rewards) > 0 {
+		found := false
+		for _, reward := range template.Rewards {
+			if strings.EqualFold(reward, event.Reward.Title) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+
+	// Only the viewer's own message is moderated, a rejected message still gets the event announced
+	text = strings.TrimSpace(text)
+	if text != "" {
+		moderation := moderateMessage(channel, text, sourceEventSub)
+		if moderation.Rejected {
+			logger("Twitch event message from "+username+" rejected by moderation", logInfo, channel)
+		}
+		text = moderation.Text
+	}
+	replacements = append(replacements, "{message}", text)
+
+	if template.Template != "" {
+		defaultTemplate = template.Template
+	}
+
+	voice := config.Voice
+	if template.Voice != "" {
+		voice = template.Voice
+	}
+	stability, similarityBoost, style := getVoiceSettings(channel)
+	msg := Message{
+		Channel:         channel,
+		DefaultVoice:    voice,
+		Stability:       stability,
+		SimilarityBoost: similarityBoost,
+		Style:           style,
+		PlayAlert:       notification.Subscription.Type != eventSubRedemption,
+		Stitch:          readConfig(&stitchEnabled),
+		User:            username,
+		Announcement:    true,
+	}
+
+	// A bit is worth a cent, so cheers use the same alert tiers as tips
+	amountCents := 0
+	if notification.Subscription.Type == eventSubCheer {
+		amountCents = event.Bits
+		msg.Text = applyAlertTier(&msg, amountCents, defaultTemplate, replacements)
+	} else {
+		msg.Text = strings.TrimSpace(strings.NewReplacer(replacements...).Replace(defaultTemplate))
+	}
+	if msg.Text == "" {
+		return
+	}
+	logger(msg.Text, logInfo, channel)
+
+	// Check if there is a connected client for the channel
+	receivedAt := time.Now()
+	for !channelHasClient(channel) {
+		if time.Since(receivedAt) > 30*time.Second {
+			logger("No connected client", logInfo, channel)
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	var err error
+	if shouldHold(channel, sourceEventSub, username, amountCents, template.Hold) {
+		_, err = holdMessage(msg, sourceEventSub, username, amountCents)
+	} else {
+		_, _, err = enqueueMessage(msg)
+	}
+	if err != nil {
+		logger("Error queueing Twitch event message: "+err.Error(), logError, channel)
+	}
+}
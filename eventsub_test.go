@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEventSubSecret = "s3cr3t-for-tests"
+
+// useEventSubSecret sets the EventSub secret and clears seen message IDs for one test
+func useEventSubSecret(t *testing.T, secret string) {
+	t.Helper()
+	oldSecret, oldSeen := eventSubSecret, eventSubSeen
+	t.Cleanup(func() { eventSubSecret, eventSubSeen = oldSecret, oldSeen })
+	eventSubSecret = secret
+	eventSubSeen = make(map[string]time.Time)
+}
+
+// signEventSub returns the headers Twitch sends with a webhook request
+func signEventSub(secret string, id string, messageType string, timestamp time.Time, body string) http.Header {
+	header := http.Header{}
+	header.Set("Twitch-Eventsub-Message-Id", id)
+	header.Set("Twitch-Eventsub-Message-Type", messageType)
+	header.Set("Twitch-Eventsub-Message-Timestamp", timestamp.UTC().Format(time.RFC3339Nano))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + header.Get("Twitch-Eventsub-Message-Timestamp") + body))
+	header.Set("Twitch-Eventsub-Message-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+// postEventSub sends a webhook request to handleEventSub
+func postEventSub(header http.Header, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/eventsub", strings.NewReader(body))
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	handleEventSub(recorder, request)
+	return recorder
+}
+
+func TestVerifyEventSubSignature(t *testing.T) {
+	body := `{"subscription":{"type":"channel.cheer"},"event":{}}`
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		secret string
+		header func() http.Header
+		body   string
+		want   bool
+	}{
+		{
+			name:   "valid",
+			secret: testEventSubSecret,
+			header: func() http.Header { return signEventSub(testEventSubSecret, "id-1", eventSubNotification, now, body) },
+			body:   body,
+			want:   true,
+		},
+		{
+			name:   "wrong secret",
+			secret: testEventSubSecret,
+			header: func() http.Header { return signEventSub("other-secret", "id-1", eventSubNotification, now, body) },
+			body:   body,
+		},
+		{
+			name:   "tampered body",
+			secret: testEventSubSecret,
+			header: func() http.Header { return signEventSub(testEventSubSecret, "id-1", eventSubNotification, now, body) },
+			body:   strings.Replace(body, "cheer", "raid", 1),
+		},
+		{
+			name:   "tampered message id",
+			secret: testEventSubSecret,
+			header: func() http.Header {
+				header := signEventSub(testEventSubSecret, "id-1", eventSubNotification, now, body)
+				header.Set("Twitch-Eventsub-Message-Id", "id-2")
+				return header
+			},
+			body: body,
+		},
+		{
+			name:   "missing prefix",
+			secret: testEventSubSecret,
+			header: func() http.Header {
+				header := signEventSub(testEventSubSecret, "id-1", eventSubNotification, now, body)
+				header.Set("Twitch-Eventsub-Message-Signature", strings.TrimPrefix(header.Get("Twitch-Eventsub-Message-Signature"), "sha256="))
+				return header
+			},
+			body: body,
+		},
+		{
+			name:   "not hex",
+			secret: testEventSubSecret,
+			header: func() http.Header {
+				header := signEventSub(testEventSubSecret, "id-1", eventSubNotification, now, body)
+				header.Set("Twitch-Eventsub-Message-Signature", "sha256=not-hex")
+				return header
+			},
+			body: body,
+		},
+		{
+			name:   "no secret configured",
+			header: func() http.Header { return signEventSub("", "id-1", eventSubNotification, now, body) },
+			body:   body,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useEventSubSecret(t, test.secret)
+			if got := verifyEventSubSignature(test.header(), []byte(test.body)); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleEventSubVerification(t *testing.T) {
+	useEventSubSecret(t, testEventSubSecret)
+	body := `{"challenge":"pogchamp-kappa-360noscope-vohiyo","subscription":{"type":"channel.cheer","status":"webhook_callback_verification_pending"}}`
+
+	response := postEventSub(signEventSub(testEventSubSecret, "verify-1", eventSubVerification, time.Now(), body), body)
+	if response.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", response.Code, http.StatusOK)
+	}
+	if got := response.Body.String(); got != "pogchamp-kappa-360noscope-vohiyo" {
+		t.Fatalf("got body %q, want the challenge", got)
+	}
+	if got := response.Header().Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("got content type %q, want text/plain", got)
+	}
+}
+
+func TestHandleEventSubRefused(t *testing.T) {
+	body := `{"challenge":"abc","subscription":{"type":"channel.cheer"}}`
+
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"bad signature", signEventSub("other-secret", "refused-1", eventSubVerification, time.Now(), body)},
+		{"stale timestamp", signEventSub(testEventSubSecret, "refused-2", eventSubVerification, time.Now().Add(-eventSubMaxAge-time.Minute), body)},
+		{"unparsable timestamp", func() http.Header {
+			header := http.Header{}
+			header.Set("Twitch-Eventsub-Message-Id", "refused-3")
+			header.Set("Twitch-Eventsub-Message-Type", eventSubVerification)
+			header.Set("Twitch-Eventsub-Message-Timestamp", "yesterday")
+			mac := hmac.New(sha256.New, []byte(testEventSubSecret))
+			mac.Write([]byte("refused-3yesterday" + body))
+			header.Set("Twitch-Eventsub-Message-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			return header
+		}()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useEventSubSecret(t, testEventSubSecret)
+			response := postEventSub(test.header, body)
+			if response.Code != http.StatusForbidden {
+				t.Fatalf("got status %d, want %d", response.Code, http.StatusForbidden)
+			}
+			if strings.Contains(response.Body.String(), "abc") {
+				t.Fatal("challenge echoed for a refused request")
+			}
+		})
+	}
+}
+
+func TestHandleEventSubDuplicate(t *testing.T) {
+	useEventSubSecret(t, testEventSubSecret)
+	// No channel has Twitch events configured, so the notification itself is ignored
+	body := `{"subscription":{"type":"channel.cheer"},"event":{"broadcaster_user_login":"nobody","bits":100}}`
+
+	for i := 0; i < 2; i++ {
+		response := postEventSub(signEventSub(testEventSubSecret, "duplicate-1", eventSubNotification, time.Now(), body), body)
+		if response.Code != http.StatusNoContent {
+			t.Fatalf("request %d: got status %d, want %d", i+1, response.Code, http.StatusNoContent)
+		}
+	}
+
+	if !seenEventSubMessage("duplicate-1") {
+		t.Fatal("message ID wasn't recorded")
+	}
+	if seenEventSubMessage("duplicate-2") {
+		t.Fatal("new message ID reported as seen")
+	}
+	if !seenEventSubMessage("duplicate-2") {
+		t.Fatal("repeated message ID reported as new")
+	}
+}
+
+func TestSeenEventSubMessageExpires(t *testing.T) {
+	useEventSubSecret(t, testEventSubSecret)
+	eventSubSeen["old"] = time.Now().Add(-eventSubMaxAge - time.Second)
+
+	if seenEventSubMessage("old") {
+		t.Fatal("message ID older than the replay window reported as seen")
+	}
+}
+
+func TestRemoveCheermotes(t *testing.T) {
+	tests := []struct {
+		text  string
+		extra []string
+		want  string
+	}{
+		{"Cheer100 great stream", nil, "great stream"},
+		{"cheer1 CHEER50 hi", nil, "hi"},
+		{"Kappa10 BibleThump5 cheerwhal100 4Head1 what", nil, "what"},
+		{"play the mp3 and gg2 after covid19", nil, "play the mp3 and gg2 after covid19"},
+		{"Cheer100", nil, ""},
+		{"cheering100 percent", nil, "cheering100 percent"},
+		{"myemote500 hello Cheer1", []string{"myemote"}, "hello"},
+		{"myemote500 hello", nil, "myemote500 hello"},
+	}
+
+	for _, test := range tests {
+		if got := removeCheermotes(test.text, test.extra); got != test.want {
+			t.Errorf("removeCheermotes(%q, %v) = %q, want %q", test.text, test.extra, got, test.want)
+		}
+	}
+}
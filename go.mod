@@ -1,4 +1,4 @@
-module main
+module ai-twitch-tts
 
 go 1.22.4
 
@@ -25,4 +25,5 @@ require (
 require (
 	github.com/gorilla/mux v1.8.1
 	go.mongodb.org/mongo-driver v1.16.0
+	gopkg.in/yaml.v3 v3.0.1
 )
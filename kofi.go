@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+var kofiKeys []DonationKey
+
+// KofiWebhook is the JSON Ko-fi sends in the data form field
+type KofiWebhook struct {
+	VerificationToken string          `json:"verification_token"`
+	MessageID         string          `json:"message_id"`
+	Type              string          `json:"type"` // Donation, Subscription, Commission or Shop Order
+	IsPublic          bool            `json:"is_public"`
+	FromName          string          `json:"from_name"`
+	Message           string          `json:"message"`
+	Amount            json.RawMessage `json:"amount"`
+	Currency          string          `json:"currency"`
+}
+
+func setupKofi() {
+	kofiKeys = loadDonationKeys("KOFI_TOKENS")
+}
+
+// getKofiChannel returns the channel a webhook verification token belongs to
+func getKofiChannel(token string) (string, bool) {
+	for _, key := range readConfig(&kofiKeys) {
+		if subtle.ConstantTimeCompare([]byte(key.Token), []byte(token)) == 1 {
+			return key.Channel, true
+		}
+	}
+	return "", false
+}
+
+// handleKofi receives Ko-fi donation webhooks
+func handleKofi(w http.ResponseWriter, r *http.Request) {
+	var webhook KofiWebhook
+	if err := json.Unmarshal([]byte(r.FormValue("data")), &webhook); err != nil {
+		http.Error(w, "Invalid data", http.StatusBadRequest)
+		return
+	}
+	channel, ok := getKofiChannel(webhook.VerificationToken)
+	if !ok {
+		logger("Invalid Ko-fi verification token from "+r.RemoteAddr, logInfo, "Universal")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Ko-fi retries until it gets a 200, so answer before the tip is processed
+	w.WriteHeader(http.StatusOK)
+
+	logger("Received "+webhook.Type+" from Ko-fi", logDebug, channel)
+	if webhook.Type != "Donation" && webhook.Type != "Subscription" {
+		return
+	}
+	amount, ok := parseAmountCents(webhook.Amount)
+	if !ok {
+		logger("Invalid Ko-fi amount: "+string(webhook.Amount), logError, channel)
+		return
+	}
+
+	donation := Donation{
+		Source:      sourceKofi,
+		Channel:     channel,
+		Donor:       webhook.FromName,
+		AmountCents: amount,
+		Currency:    webhook.Currency,
+		Message:     webhook.Message,
+	}
+	// Private tips hide who sent them and what they said
+	if !webhook.IsPublic {
+		donation.Donor = ""
+		donation.Message = ""
+	}
+	go handleDonation(donation)
+}
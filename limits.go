@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var (
+	messageLimits []MessageLimit
+
+	errMessageTooLong = errors.New("message is over the length limit")
+)
+
+// Limit policies
+const (
+	limitTruncate = "truncate"
+	limitReject   = "reject"
+)
+
+// MessageLimit caps how much a single message can say, "*" applies to channels without their own entry
+// Characters are counted on the spoken text after tags are removed, 0 means no limit
+type MessageLimit struct {
+	Channel              string `json:"channel"`
+	MaxCharacters        int    `json:"max_characters"`         // Spoken characters across the whole message
+	MaxSegmentCharacters int    `json:"max_segment_characters"` // Spoken characters per voice segment
+	MaxVoiceSwitches     int    `json:"max_voice_switches"`     // Times the voice may change
+	MaxEffects           int    `json:"max_effects"`            // Sound effects per message
+	Policy               string `json:"policy"`                 // truncate or reject (default truncate)
+	TruncateEffect       string `json:"truncate_effect"`        // Effect played after a truncated message
+	TruncateText         string `json:"truncate_text"`          // Text spoken after a truncated message if there is no effect
+}
+
+func setupMessageLimits() {
+	messageLimits = nil
+	limits := getSetting("MESSAGE_LIMITS")
+	if limits == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(limits), &messageLimits)
+	if err != nil {
+		logger("Error unmarshalling message limits: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range messageLimits {
+		messageLimits[i].Channel = strings.ToLower(messageLimits[i].Channel)
+		messageLimits[i].Policy = strings.ToLower(messageLimits[i].Policy)
+		if messageLimits[i].Policy == "" {
+			messageLimits[i].Policy = limitTruncate
+		}
+		messageLimits[i].TruncateEffect = strings.ToLower(messageLimits[i].TruncateEffect)
+	}
+}
+
+// getMessageLimit returns the limits for a channel, falling back to the "*" entry
+func getMessageLimit(channel string) (MessageLimit, bool) {
+	var fallback MessageLimit
+	found := false
+	for _, limit := range readConfig(&messageLimits) {
+		if limit.Channel == channel {
+			return limit, true
+		}
+		if limit.Channel == "*" {
+			fallback = limit
+			found = true
+		}
+	}
+	return fallback, found
+}
+
+// applyMessageLimits trims parsed segments to the channel's limits
+// Messages over a limit return errMessageTooLong instead when the channel's policy is reject,
+// unless forceTruncate is set for announcements that should still play
+func applyMessageLimits(channel string, segments []AudioSegment, forceTruncate bool) ([]AudioSegment, error) {
+	limit, exists := getMessageLimit(channel)
+	if !exists {
+		return segments, nil
+	}
+
+	var limited []AudioSegment
+	truncated := false
+	characters := 0
+	effects := 0
+	switches := 0
+	lastVoice := ""
+	lastVoiceName := ""
+
+	for _, segment := range segments {
+		if segment.Effect != "" {
+			if limit.MaxEffects > 0 && effects >= limit.MaxEffects {
+				truncated = true
+				continue
+			}
+			effects++
+			limited = append(limited, segment)
+			continue
+		}
+
+		if lastVoice != "" && segment.Voice != lastVoice {
+			if limit.MaxVoiceSwitches > 0 && switches >= limit.MaxVoiceSwitches {
+				truncated = true
+				break
+			}
+			switches++
+		}
+		lastVoice = segment.Voice
+		lastVoiceName = segment.VoiceName
+
+		maxLength := limit.MaxSegmentCharacters
+		if limit.MaxCharacters > 0 {
+			remaining := limit.MaxCharacters - characters
+			if remaining <= 0 {
+				truncated = true
+				break
+			}
+			if maxLength == 0 || remaining < maxLength {
+				maxLength = remaining
+			}
+		}
+		if maxLength > 0 {
+			text, cut := truncateText(segment.Text, maxLength)
+			if cut {
+				truncated = true
+				if text == "" {
+					break
+				}
+				segment.Text = text
+			}
+		}
+		characters += len([]rune(segment.Text))
+		limited = append(limited, segment)
+	}
+
+	if !truncated {
+		return segments, nil
+	}
+	if limit.Policy == limitReject && !forceTruncate {
+		return nil, errMessageTooLong
+	}
+
+	logger("Message truncated to fit the message limits", logInfo, channel)
+	if limit.TruncateEffect != "" {
+		if effect, found := resolveEffect(limit.TruncateEffect, channel); found {
+			return append(limited, AudioSegment{Effect: effect.Name}), nil
+		}
+		logger("Truncate effect "+limit.TruncateEffect+" not found", logError, channel)
+	}
+	if limit.TruncateText != "" {
+		if lastVoice == "" {
+			lastVoiceName, lastVoice = getDefaultVoice(channel)
+		}
+		limited = append(limited, AudioSegment{
+			Text:      limit.TruncateText,
+			Voice:     lastVoice,
+			VoiceName: lastVoiceName,
+		})
+	}
+	return limited, nil
+}
+
+// truncateText cuts text to at most maxLength characters
+// It prefers the end of the last whole sentence, then the last whole word
+func truncateText(text string, maxLength int) (string, bool) {
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return text, false
+	}
+
+	cut := runes[:maxLength]
+	sentenceEnd := -1
+	wordEnd := -1
+	for i, r := range cut {
+		next := i + 1
+		atBoundary := next == len(runes) || unicode.IsSpace(runes[next])
+		if strings.ContainsRune(".!?…", r) && atBoundary {
+			sentenceEnd = next
+		}
+		if unicode.IsSpace(r) {
+			wordEnd = i
+		}
+	}
+	// Keep a sentence only if it's not throwing away most of what fits
+	if sentenceEnd > 0 && sentenceEnd >= maxLength/3 {
+		return strings.TrimSpace(string(runes[:sentenceEnd])), true
+	}
+	if wordEnd > 0 {
+		return strings.TrimSpace(string(runes[:wordEnd])), true
+	}
+	return string(cut), true
+}
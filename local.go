@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	localEngine     = "espeak-ng"
+	localEnginePath string
+)
+
+// localProvider shells out to an offline TTS engine (espeak-ng or Piper)
+// The voice ID is the espeak-ng voice name or the path to a Piper model
+type localProvider struct{}
+
+func setupLocalTTS() {
+	engine := strings.ToLower(getSetting("LOCAL_TTS_ENGINE"))
+	if engine != "" {
+		localEngine = engine
+	}
+	localEnginePath = getSetting("LOCAL_TTS_PATH")
+	if localEnginePath == "" {
+		localEnginePath = localEngine
+	}
+	logger("Local TTS engine: "+localEngine, logDebug, "Universal")
+}
+
+func (localProvider) Name() string {
+	return localProviderName
+}
+
+func (localProvider) Settings(request Request) (string, string) {
+	return localEngine, "mp3_128k"
+}
+
+func (localProvider) Generate(request Request) ([]byte, error) {
+	logger("Generating local TTS audio with "+localEngine, logDebug, request.Channel)
+
+	tempDir, err := os.MkdirTemp("", "tts-local-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	wavFile := filepath.Join(tempDir, "output.wav")
+
+	// A hung engine or ffmpeg would otherwise block the channel's queue forever
+	ctx, cancel := context.WithTimeout(context.Background(), modifierTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	switch localEngine {
+	case "espeak-ng", "espeak":
+		cmd = exec.CommandContext(ctx, localEnginePath, "-v", request.Voice.Voice, "-w", wavFile, "--stdin")
+	case "piper":
+		cmd = exec.CommandContext(ctx, localEnginePath, "--model", request.Voice.Voice, "--output_file", wavFile)
+	default:
+		return nil, fmt.Errorf("unsupported local TTS engine: %s", localEngine)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(request.Text)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logger("Error running "+localEngine+": "+err.Error()+" "+stderr.String(), logError, request.Channel)
+		return nil, fmt.Errorf("local TTS failed: %w", err)
+	}
+
+	// Transcode to mp3 so local audio matches what ElevenLabs returns
+	var mp3 bytes.Buffer
+	stderr.Reset()
+	transcodeCtx, transcodeCancel := context.WithTimeout(context.Background(), modifierTimeout)
+	defer transcodeCancel()
+	cmd = exec.CommandContext(transcodeCtx, "ffmpeg", "-i", wavFile, "-f", "mp3", "-b:a", "128k", "pipe:1")
+	cmd.Stdout = &mp3
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logger("Error transcoding local TTS audio: "+err.Error()+" "+stderr.String(), logError, request.Channel)
+		return nil, fmt.Errorf("local TTS transcode failed: %w", err)
+	}
+
+	return mp3.Bytes(), nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	loudnessTargets []LoudnessTarget
+
+	// Measurements are keyed by a hash of the audio so effects, alerts and cached TTS are only measured once
+	loudnessMeasurements = make(map[string]loudnessMeasurement)
+	loudnessOrder        []string // Oldest measurement first
+	loudnessMutex        = sync.Mutex{}
+
+	// Normalized audio is keyed by the audio hash and target so effects and alerts are only re-encoded once
+	normalizedAudio = make(map[string][]byte)
+	normalizedOrder []string // Oldest normalized audio first
+	normalizedBytes int
+)
+
+const (
+	defaultTruePeak = -1.5
+	// Gain changes smaller than this aren't worth re-encoding for
+	loudnessTolerance = 0.5
+	// Oldest measurements are dropped past this many so the cache can't grow forever
+	maxLoudnessMeasurements = 2000
+	// Oldest normalized audio is dropped past this many bytes
+	maxNormalizedBytes = 64 << 20
+)
+
+// LoudnessTarget is the EBU R128 level audio is normalized to, "*" applies to channels without their own entry
+type LoudnessTarget struct {
+	Channel  string   `json:"channel"`
+	LUFS     float64  `json:"lufs"`      // Integrated loudness to aim for, e.g. -16, 0 turns normalization off
+	TruePeak *float64 `json:"true_peak"` // Highest true peak allowed in dBTP (default -1.5)
+}
+
+// loudnessMeasurement is what ffmpeg's loudnorm filter measured for a piece of audio
+type loudnessMeasurement struct {
+	Integrated float64
+	TruePeak   float64
+}
+
+// loudnormOutput is the JSON summary loudnorm prints when print_format=json
+type loudnormOutput struct {
+	InputI  string `json:"input_i"`
+	InputTP string `json:"input_tp"`
+}
+
+func setupLoudness() {
+	loudnessTargets = nil
+	targets := getSetting("LOUDNESS_TARGETS")
+	if targets == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(targets), &loudnessTargets)
+	if err != nil {
+		logger("Error unmarshalling loudness targets: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range loudnessTargets {
+		loudnessTargets[i].Channel = strings.ToLower(loudnessTargets[i].Channel)
+		if loudnessTargets[i].LUFS < -70 || loudnessTargets[i].LUFS > 0 {
+			logger("Invalid loudness target for "+loudnessTargets[i].Channel+", normalization disabled for it", logError, "Universal")
+			loudnessTargets[i].LUFS = 0
+		}
+	}
+}
+
+// getLoudnessTarget returns the target for a channel, falling back to the "*" entry
+func getLoudnessTarget(channel string) (LoudnessTarget, bool) {
+	var fallback LoudnessTarget
+	found := false
+	for _, target := range readConfig(&loudnessTargets) {
+		if target.Channel == channel {
+			return target, target.LUFS != 0
+		}
+		if target.Channel == "*" {
+			fallback = target
+			found = true
+		}
+	}
+	return fallback, found && fallback.LUFS != 0
+}
+
+// loudnessEnabled reports whether audio sent to a channel is normalized
+func loudnessEnabled(channel string) bool {
+	_, enabled := getLoudnessTarget(channel)
+	return enabled
+}
+
+// audioHash identifies audio for the loudness caches
+func audioHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// measureLoudness returns the loudness of audio, measuring it with ffmpeg the first time it is seen
+func measureLoudness(data []byte, key string) (loudnessMeasurement, error) {
+	loudnessMutex.Lock()
+	measurement, ok := loudnessMeasurements[key]
+	loudnessMutex.Unlock()
+	if ok {
+		return measurement, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), modifierTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-nostats", "-i", "pipe:0",
+		"-af", "loudnorm=print_format=json", "-f", "null", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// The summary is the last JSON object ffmpeg writes
+	output := stderr.String()
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start == -1 || end < start {
+		return loudnessMeasurement{}, fmt.Errorf("no loudness summary in ffmpeg output")
+	}
+	var summary loudnormOutput
+	if err := json.Unmarshal([]byte(output[start:end+1]), &summary); err != nil {
+		return loudnessMeasurement{}, err
+	}
+	integrated, err := strconv.ParseFloat(summary.InputI, 64)
+	if err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("invalid integrated loudness %q", summary.InputI)
+	}
+	truePeak, err := strconv.ParseFloat(summary.InputTP, 64)
+	if err != nil {
+		return loudnessMeasurement{}, fmt.Errorf("invalid true peak %q", summary.InputTP)
+	}
+	measurement = loudnessMeasurement{Integrated: integrated, TruePeak: truePeak}
+
+	loudnessMutex.Lock()
+	defer loudnessMutex.Unlock()
+	if _, measured := loudnessMeasurements[key]; !measured {
+		loudnessOrder = append(loudnessOrder, key)
+		if len(loudnessOrder) > maxLoudnessMeasurements {
+			delete(loudnessMeasurements, loudnessOrder[0])
+			loudnessOrder = loudnessOrder[1:]
+		}
+	}
+	loudnessMeasurements[key] = measurement
+	return measurement, nil
+}
+
+// normalizeLoudness brings audio to the channel's target loudness without letting it clip past the true peak limit
+// The original audio is returned if normalization is off or fails
+func normalizeLoudness(data []byte, channel string) []byte {
+	target, enabled := getLoudnessTarget(channel)
+	if !enabled || len(data) == 0 {
+		return data
+	}
+
+	truePeak := defaultTruePeak
+	if target.TruePeak != nil {
+		truePeak = *target.TruePeak
+	}
+	hash := audioHash(data)
+	key := fmt.Sprintf("%s/%.2f/%.2f", hash, target.LUFS, truePeak)
+	loudnessMutex.Lock()
+	normalized, ok := normalizedAudio[key]
+	loudnessMutex.Unlock()
+	if ok {
+		return normalized
+	}
+
+	measurement, err := measureLoudness(data, hash)
+	if err != nil {
+		logger("Error measuring loudness, sending audio unchanged: "+err.Error(), logError, channel)
+		return data
+	}
+	// Silence measures as -inf and has nothing to normalize
+	if math.IsInf(measurement.Integrated, 0) || math.IsNaN(measurement.Integrated) {
+		return data
+	}
+
+	gain := math.Min(target.LUFS-measurement.Integrated, truePeak-measurement.TruePeak)
+	if math.Abs(gain) < loudnessTolerance {
+		return data
+	}
+	logger(fmt.Sprintf("Normalizing audio from %.1f LUFS by %.1f dB", measurement.Integrated, gain), logDebug, channel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), modifierTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-i", "pipe:0",
+		"-af", "volume="+strconv.FormatFloat(gain, 'f', 2, 64)+"dB", "-b:a", "320k", "-f", "mp3", "pipe:1")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logger("Error normalizing loudness, sending audio unchanged: "+err.Error()+": "+strings.TrimSpace(stderr.String()), logError, channel)
+		return data
+	}
+	if stdout.Len() == 0 {
+		return data
+	}
+	storeNormalizedAudio(key, stdout.Bytes())
+	return stdout.Bytes()
+}
+
+// storeNormalizedAudio caches normalized audio, dropping the oldest entries past maxNormalizedBytes
+func storeNormalizedAudio(key string, data []byte) {
+	loudnessMutex.Lock()
+	defer loudnessMutex.Unlock()
+	if _, stored := normalizedAudio[key]; stored || len(data) > maxNormalizedBytes {
+		return
+	}
+	normalizedAudio[key] = data
+	normalizedOrder = append(normalizedOrder, key)
+	normalizedBytes += len(data)
+	for normalizedBytes > maxNormalizedBytes {
+		normalizedBytes -= len(normalizedAudio[normalizedOrder[0]])
+		delete(normalizedAudio, normalizedOrder[0])
+		normalizedOrder = normalizedOrder[1:]
+	}
+}
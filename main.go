@@ -21,8 +21,8 @@ var (
 func setupHandlers() {
 	router := mux.NewRouter()
 
-	// Serve the effects directory under the /effects route
-	router.PathPrefix("/effects/").Handler(http.StripPrefix("/effects", http.FileServer(http.Dir(effectFolder))))
+	// Serve effect audio under the /effects route, checking each effect may be played
+	router.HandleFunc("/effects/{file}", serveEffectFile)
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static", http.FileServer(http.Dir("./static"))))
 
 	router.HandleFunc("/voices", handleApp)
@@ -30,15 +30,32 @@ func setupHandlers() {
 	router.HandleFunc("/create", handleApp)
 	router.HandleFunc("/api/voices", handleAPIVoices)
 	router.HandleFunc("/api/effects", handleAPIEffects)
+	router.HandleFunc("/api/effects/info", handleAPIEffectInfo)
+	router.HandleFunc("/api/effects/upload", handleEffectUpload).Methods(http.MethodPost)
+	router.HandleFunc("/api/effects/{name}/{action}", handleEffectAction).Methods(http.MethodPost)
+	router.HandleFunc("/api/modifiers", handleAPIModifiers)
+	router.HandleFunc("/api/pending", handlePendingList)
+	router.HandleFunc("/api/pending/{id}/{action}", handlePendingAction).Methods(http.MethodPost)
+	router.HandleFunc("/moderate", handleApp)
 	router.HandleFunc("/tts", handleRequest)
+	router.HandleFunc("/queue", handleQueue)
+	router.HandleFunc("/mix/{id}", handleMixDownload)
+	router.HandleFunc("/replay", handleReplay)
+	router.HandleFunc("/eventsub", handleEventSub).Methods(http.MethodPost)
+	router.HandleFunc("/kofi", handleKofi).Methods(http.MethodPost)
+	router.HandleFunc("/moderation/log", handleModerationLog)
+	router.HandleFunc("/control/{action}", handleControl).Methods(http.MethodGet, http.MethodPost)
 	router.HandleFunc("/ws", handleWebSocket)
 	router.HandleFunc("/fx", listEffects)
 	router.HandleFunc("/update", updateHandler)
 	router.HandleFunc("/eleven/characters", getCharactersHandler)
+	router.HandleFunc("/cache/stats", handleCacheStats)
+	router.HandleFunc("/api/budget/{channel}", handleBudget)
 	if mongoEnabled {
 		router.HandleFunc("/data/{channel}", viewDataHandler)
 		router.HandleFunc("/chart", handleApp)
 	}
+	router.HandleFunc("/captions", serveCaptions)
 	router.HandleFunc("/", serveClient)
 
 	http.Handle("/", router)
@@ -52,7 +69,7 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	sendTextMessage(channel, "update "+hash)
+	sendControlMessage(channel, ControlMessage{Type: controlUpdate, Hash: hash})
 }
 
 func main() {
@@ -78,9 +95,19 @@ func ComputeMD5(filePath string) (string, error) {
 }
 
 func serveClient(w http.ResponseWriter, r *http.Request) {
-	htmlHash, err := ComputeMD5("static/index.html")
+	servePage(w, "static/index.html")
+}
+
+// serveCaptions serves the caption-only browser source
+func serveCaptions(w http.ResponseWriter, r *http.Request) {
+	servePage(w, "static/captions.html")
+}
+
+// servePage renders an overlay page with the server URL and the page's hash for update checks
+func servePage(w http.ResponseWriter, page string) {
+	htmlHash, err := ComputeMD5(page)
 	if err != nil {
-		logger("Error computing hash for index.html: "+err.Error(), logError, "Universal")
+		logger("Error computing hash for "+page+": "+err.Error(), logError, "Universal")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -104,7 +131,7 @@ func serveClient(w http.ResponseWriter, r *http.Request) {
 			Hash:      htmlHash,
 		}
 	}
-	tmpl, err := template.ParseFiles("static/index.html")
+	tmpl, err := template.ParseFiles(page)
 	if err != nil {
 		logger("Error parsing template: "+err.Error(), logError, "Universal")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	moderationRules   []ModerationRules
+	bleepEffect       = "bleep"
+	maskText          = "beep"
+	moderationLogFile string
+	moderationLog     []ModerationEntry
+	moderationMutex   = sync.Mutex{}
+	maxModerationLog  = 200
+)
+
+// Moderation actions
+const (
+	moderationReject = "reject"
+	moderationMask   = "mask"
+	moderationBleep  = "bleep"
+	// moderationAllow skips moderation, only valid as a source policy
+	moderationAllow = "allow"
+)
+
+// Message sources, used for per-source moderation policies and logging
+const (
+	sourceAPI            = "api"
+	sourcePally          = "pally"
+	sourceKofi           = "kofi"
+	sourceStreamElements = "streamelements"
+	sourceStreamlabs     = "streamlabs"
+	sourceTwitch         = "twitch"
+	sourceEventSub       = "eventsub"
+)
+
+// ModerationRules is a blocklist for a channel, "*" applies it to every channel
+type ModerationRules struct {
+	Channel   string   `json:"channel"`
+	Words     []string `json:"words"`     // Words and phrases matched on whole words after normalization
+	Patterns  []string `json:"patterns"`  // Regular expressions matched against the normalized text
+	Action    string   `json:"action"`    // reject, mask or bleep (default reject)
+	Donations string   `json:"donations"` // Action for tips from every donation source, "allow" skips moderation (default same as action)
+
+	// matchers holds the compiled words and patterns
+	matchers []*regexp.Regexp
+}
+
+// ModerationResult is what moderation did to a message
+type ModerationResult struct {
+	Text     string
+	Rejected bool
+	Matches  []string
+}
+
+// ModerationEntry is a logged moderation hit kept for review
+type ModerationEntry struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Source  string    `json:"source"`
+	Action  string    `json:"action"`
+	Matches []string  `json:"matches"`
+	Text    string    `json:"text"`
+}
+
+func setupModeration() {
+	moderationRules = nil
+	bleepEffect, maskText = "bleep", "beep"
+	if effect := getSetting("MODERATION_BLEEP_EFFECT"); effect != "" {
+		bleepEffect = strings.ToLower(effect)
+	}
+	if mask, ok := lookupSetting("MODERATION_MASK_TEXT"); ok {
+		maskText = mask
+	}
+	moderationLogFile = getSetting("MODERATION_LOG")
+
+	rules := getSetting("MODERATION_RULES")
+	if rules == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(rules), &moderationRules)
+	if err != nil {
+		logger("Error unmarshalling moderation rules: "+err.Error(), logError, "Universal")
+		return
+	}
+
+	for i := range moderationRules {
+		rule := &moderationRules[i]
+		rule.Channel = strings.ToLower(rule.Channel)
+		rule.Action = strings.ToLower(rule.Action)
+		rule.Donations = strings.ToLower(rule.Donations)
+		if rule.Action == "" {
+			rule.Action = moderationReject
+		}
+		if !validModerationAction(rule.Action) {
+			logger("Invalid moderation action "+rule.Action+", using reject", logError, rule.Channel)
+			rule.Action = moderationReject
+		}
+		if rule.Donations != "" && rule.Donations != moderationAllow && !validModerationAction(rule.Donations) {
+			logger("Invalid donation moderation action "+rule.Donations+", using "+rule.Action, logError, rule.Channel)
+			rule.Donations = ""
+		}
+		for _, word := range rule.Words {
+			if re := blockedWordPattern(word); re != nil {
+				rule.matchers = append(rule.matchers, re)
+			}
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				logger("Invalid moderation pattern "+pattern+": "+err.Error(), logError, rule.Channel)
+				continue
+			}
+			rule.matchers = append(rule.matchers, re)
+		}
+	}
+	logger(fmt.Sprintf("Loaded %d moderation rule sets", len(moderationRules)), logInfo, "Universal")
+}
+
+func validModerationAction(action string) bool {
+	return action == moderationReject || action == moderationMask || action == moderationBleep
+}
+
+// ruleAction returns the action a rule takes for a message source
+func (rule ModerationRules) ruleAction(source string) string {
+	if isDonationSource(source) && rule.Donations != "" {
+		return rule.Donations
+	}
+	return rule.Action
+}
+
+// leetReplacements maps digits and symbols commonly used to dodge filters to the letters they stand for
+var leetReplacements = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '6': 'g', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '|': 'i', '+': 't', '€': 'e', '£': 'l',
+}
+
+// confusables maps look-alike letters from other scripts to their latin counterparts
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ɡ': 'g',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ı': 'i', 'ł': 'l', 'ø': 'o', 'đ': 'd', 'ß': 's',
+	'á': 'a', 'à': 'a', 'â': 'a', 'ä': 'a', 'ã': 'a', 'å': 'a', 'é': 'e', 'è': 'e', 'ê': 'e',
+	'ë': 'e', 'í': 'i', 'ì': 'i', 'î': 'i', 'ï': 'i', 'ó': 'o', 'ò': 'o', 'ô': 'o', 'ö': 'o',
+	'õ': 'o', 'ú': 'u', 'ù': 'u', 'û': 'u', 'ü': 'u', 'ñ': 'n', 'ç': 'c', 'ý': 'y', 'ÿ': 'y',
+}
+
+// normalizedText is text reduced for matching, with each byte pointing back at the original text
+type normalizedText struct {
+	text  string
+	start []int
+	end   []int
+}
+
+// normalizeModerationText lowercases text and undoes common evasion tricks
+// Look-alike letters, full-width characters and leetspeak become plain letters, zero-width characters
+// and accents are dropped, dots and dashes inside words are removed and everything else becomes a space
+func normalizeModerationText(text string) normalizedText {
+	var result normalizedText
+	var builder strings.Builder
+
+	for offset, r := range text {
+		size := utf8.RuneLen(r)
+		if size < 0 {
+			size = 1
+		}
+
+		// Zero-width characters and combining accents
+		if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		// Full-width forms
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		r = unicode.ToLower(r)
+		if replacement, ok := confusables[r]; ok {
+			r = replacement
+		}
+		if replacement, ok := leetReplacements[r]; ok {
+			r = replacement
+		}
+
+		switch {
+		case unicode.IsLetter(r):
+		case r == '.' || r == '-' || r == '_' || r == '*' || r == '\'':
+			// Separators used to split a word up, e.g. "n.a.m.e"
+			continue
+		default:
+			r = ' '
+		}
+
+		before := builder.Len()
+		builder.WriteRune(r)
+		for i := before; i < builder.Len(); i++ {
+			result.start = append(result.start, offset)
+			result.end = append(result.end, offset+size)
+		}
+	}
+
+	result.text = builder.String()
+	return result
+}
+
+// originalSpan maps a byte range of the normalized text back to the original text
+func (n normalizedText) originalSpan(start int, end int) (int, int) {
+	return n.start[start], n.end[end-1]
+}
+
+// moderationSpan is a part of the original text a rule matched
+type moderationSpan struct {
+	start  int
+	end    int
+	action string
+}
+
+// blockedWordPattern matches a blocklist entry as whole words in normalized text
+// Each letter may be repeated so stretched out spellings are caught too
+func blockedWordPattern(word string) *regexp.Regexp {
+	normalized := strings.Fields(normalizeModerationText(word).text)
+	if len(normalized) == 0 {
+		return nil
+	}
+	var parts []string
+	for _, field := range normalized {
+		var part strings.Builder
+		for _, r := range field {
+			part.WriteString(regexp.QuoteMeta(string(r)) + "+")
+		}
+		parts = append(parts, part.String())
+	}
+	return regexp.MustCompile(`\b` + strings.Join(parts, " +") + `\b`)
+}
+
+// moderateMessage runs a message through the channel's rules
+// Masked and bleeped words are replaced in the returned text, rejected messages should not be played
+func moderateMessage(channel string, text string, source string) ModerationResult {
+	result := ModerationResult{Text: text}
+	rules := readConfig(&moderationRules)
+	if len(rules) == 0 {
+		return result
+	}
+
+	// Tags aren't spoken, so they are blanked out before matching and a voice or effect tag is never masked into an unknown one
+	// Blanking keeps every byte in place so matches still line up with the original text
+	spoken := messageTagRe.ReplaceAllStringFunc(text, func(tag string) string {
+		return strings.Repeat(" ", len(tag))
+	})
+	normalized := normalizeModerationText(spoken)
+	var spans []moderationSpan
+	actions := make(map[string]bool)
+
+	for _, rule := range rules {
+		if rule.Channel != "*" && rule.Channel != "" && rule.Channel != channel {
+			continue
+		}
+		action := rule.ruleAction(source)
+		if action == moderationAllow {
+			continue
+		}
+
+		for _, pattern := range rule.matchers {
+			for _, match := range pattern.FindAllStringIndex(normalized.text, -1) {
+				if match[1] <= match[0] {
+					continue
+				}
+				start, end := normalized.originalSpan(match[0], match[1])
+				spans = append(spans, moderationSpan{start: start, end: end, action: action})
+				result.Matches = append(result.Matches, text[start:end])
+				actions[action] = true
+			}
+		}
+	}
+
+	if len(spans) == 0 {
+		return result
+	}
+
+	action := moderationMask
+	if actions[moderationReject] {
+		action = moderationReject
+		result.Rejected = true
+		result.Text = ""
+	} else {
+		if actions[moderationBleep] {
+			action = moderationBleep
+		}
+		result.Text = censorSpans(text, spans, channel)
+	}
+
+	recordModeration(ModerationEntry{
+		Time:    time.Now(),
+		Channel: channel,
+		Source:  source,
+		Action:  action,
+		Matches: result.Matches,
+		Text:    text,
+	})
+	return result
+}
+
+// censorSpans replaces matched parts of the text with the mask text or a bleep effect tag
+// Overlapping spans are merged, bleeping wins over masking
+func censorSpans(text string, spans []moderationSpan, channel string) string {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+
+	var merged []moderationSpan
+	for _, span := range spans {
+		if len(merged) > 0 && span.start <= merged[len(merged)-1].end {
+			last := &merged[len(merged)-1]
+			if span.end > last.end {
+				last.end = span.end
+			}
+			if span.action == moderationBleep {
+				last.action = moderationBleep
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+
+	bleep, mask := readConfig(&bleepEffect), readConfig(&maskText)
+	_, bleepFound := resolveEffect(bleep, channel)
+	var builder strings.Builder
+	position := 0
+	for _, span := range merged {
+		builder.WriteString(text[position:span.start])
+		if span.action == moderationBleep && bleepFound {
+			builder.WriteString(" (e-" + bleep + ") ")
+		} else {
+			builder.WriteString(mask)
+		}
+		position = span.end
+	}
+	builder.WriteString(text[position:])
+	return strings.Join(strings.Fields(builder.String()), " ")
+}
+
+// recordModeration logs a moderation hit and keeps it for review
+func recordModeration(entry ModerationEntry) {
+	logger(fmt.Sprintf("Moderation %s from %s: %q matched %s", entry.Action, entry.Source, entry.Text, strings.Join(entry.Matches, ", ")), logInfo, entry.Channel)
+
+	moderationMutex.Lock()
+	defer moderationMutex.Unlock()
+
+	moderationLog = append(moderationLog, entry)
+	if len(moderationLog) > maxModerationLog {
+		moderationLog = moderationLog[len(moderationLog)-maxModerationLog:]
+	}
+
+	logFile := readConfig(&moderationLogFile)
+	if logFile == "" {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger("Error opening moderation log: "+err.Error(), logError, entry.Channel)
+		return
+	}
+	defer file.Close()
+	file.Write(append(line, '\n'))
+}
+
+// handleModerationLog returns the recent moderation hits for a channel, newest first
+func handleModerationLog(w http.ResponseWriter, r *http.Request) {
+	channel := strings.ToLower(r.URL.Query().Get("channel"))
+	if channel == "" {
+		http.Error(w, "Missing channel", http.StatusBadRequest)
+		return
+	}
+	if !requireChannelAuth(w, r, channel, r.URL.Query().Get("key")) {
+		return
+	}
+
+	moderationMutex.Lock()
+	entries := []ModerationEntry{}
+	for i := len(moderationLog) - 1; i >= 0; i-- {
+		if moderationLog[i].Channel == channel {
+			entries = append(entries, moderationLog[i])
+		}
+	}
+	moderationMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
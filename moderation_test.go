@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestModerateMessageSkipsTags(t *testing.T) {
+	// Registered first so it runs after t.Setenv has restored the environment
+	t.Cleanup(setupModeration)
+	t.Setenv("MODERATION_RULES", `[{"channel": "*", "words": ["badword"], "action": "mask"}]`)
+	t.Setenv("MODERATION_MASK_TEXT", "beep")
+	setupModeration()
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"hello badword", "hello beep"},
+		{"(badword) hello", "(badword) hello"},
+		{"(badword) hello b4dw0rd (reverb)", "(badword) hello beep (reverb)"},
+		{"(adam) badword (e-badword)", "(adam) beep (e-badword)"},
+	}
+
+	for _, test := range tests {
+		if got := moderateMessage("streamer", test.text, sourceAPI).Text; got != test.want {
+			t.Errorf("moderateMessage(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	voiceModifiers []VoiceModifier
+	voiceModifiers  []VoiceModifier
+	modifierTimeout = 30 * time.Second
 )
 
 type VoiceModifier struct {
@@ -20,7 +26,8 @@ type VoiceModifier struct {
 }
 
 func setupVoiceModifiers() {
-	voiceModifiersEnv := os.Getenv("VOICE_MODIFIERS")
+	voiceModifiers = nil
+	voiceModifiersEnv := getSetting("VOICE_MODIFIERS")
 	err := json.Unmarshal([]byte(voiceModifiersEnv), &voiceModifiers)
 	if err != nil {
 		logger("Error unmarshalling voice styles: "+err.Error(), logError, "Universal")
@@ -28,136 +35,404 @@ func setupVoiceModifiers() {
 	}
 }
 
-func getVoiceModifiers(ID string) (string, error) {
-	voice, err := getVoiceName(ID)
+func getVoiceModifiers(ID string, channel string) (string, error) {
+	voice, err := getVoiceName(ID, channel)
 	if err != nil {
-		logger("Error getting voice name: "+err.Error(), logError, "Universal")
+		logger("Error getting voice name: "+err.Error(), logError, channel)
 		return "", err
 	}
-	logger("Getting voice modifier for voice: "+voice, logDebug, "Universal")
-	for _, v := range voiceModifiers {
+	logger("Getting voice modifier for voice: "+voice, logDebug, channel)
+	modifiers := readConfig(&voiceModifiers)
+	if catalog := getVoiceCatalog(channel); catalog != nil {
+		modifiers = append(append([]VoiceModifier{}, catalog.Modifiers...), modifiers...)
+	}
+	for _, v := range modifiers {
 		if strings.EqualFold(v.Name, voice) {
 			modifier := v.Modifier
 			return modifier, nil
 		}
 	}
-	logger("Voice modifier not found", logDebug, "Universal")
+	logger("Voice modifier not found", logDebug, channel)
 	return "", fmt.Errorf("Voice modifier not found")
 }
 
-func loadAudioDataFromFile(filename string) []byte {
-	file, err := os.Open(filename)
-	if err != nil {
-		logger("Failed to open file: "+filename, logError, "Universal")
+// buildModifierGraph chains the filters of all modifiers into one ffmpeg filter graph
+// Returns the graph and whether the reverb impulse response is needed as a second input
+func buildModifierGraph(modifiers []AudioModifier) (string, bool, error) {
+	var filters []string
+	impulse := false
+	in := "0:a"
+	for i, modifier := range modifiers {
+		def, ok := modifierRegistry[modifier.Name]
+		if !ok {
+			return "", false, fmt.Errorf("unknown modifier: %s", modifier.Name)
+		}
+		if def.Impulse {
+			if impulse {
+				return "", false, fmt.Errorf("modifier %s can only be used once", modifier.Name)
+			}
+			impulse = true
+		}
+		out := fmt.Sprintf("m%d", i)
+		if i == len(modifiers)-1 {
+			out = "out"
+		}
+		filters = append(filters, def.Filter(in, out, modifier.Args))
+		in = out
 	}
-	defer file.Close()
+	return strings.Join(filters, ";"), impulse, nil
+}
 
-	stat, err := file.Stat()
+func getAudioLengthFile(filename string) (int, error) {
+	logger("Getting audio length", logDebug, "Universal")
+
+	cmd := exec.Command("ffprobe", "-i", filename, "-show_entries", "format=duration", "-v", "quiet", "-of", "csv=p=0")
+	output, err := cmd.Output()
 	if err != nil {
-		logger("Failed to get file stats: "+filename, logError, "Universal")
+		logger("Failed to get audio length", logError, "Universal")
+		return 0, err
 	}
 
-	data := make([]byte, stat.Size())
-	_, err = file.Read(data)
+	length := string(output)
+	length = strings.TrimSuffix(length, "\n")
+	length = strings.TrimSuffix(length, "\r")
+
+	//round up to the nearest second
+	float, err := strconv.ParseFloat(length, 64)
 	if err != nil {
-		logger("Failed to read file: "+filename, logError, "Universal")
+		logger("Failed to convert audio length to float", logError, "Universal")
+		return 0, err
 	}
 
-	return data
+	rounded := math.Ceil(float)
+
+	return int(rounded), nil
 }
 
-func saveAudioDataToFile(filename string, data []byte) {
-	file, err := os.Create(filename)
+// getAudioDuration returns the length of audio data in seconds
+func getAudioDuration(data []byte) (float64, error) {
+	tempFile, err := os.CreateTemp("", "tts-duration-*.mp3")
 	if err != nil {
-		logger("Failed to create file: "+filename, logError, "Universal")
+		return 0, err
 	}
-	defer file.Close()
-
-	_, err = file.Write(data)
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	tempFile.Close()
 	if err != nil {
-		logger("Failed to write to file: "+filename, logError, "Universal")
+		return 0, err
 	}
-}
 
-func deleteAudioFile(filename string) {
-	err := os.Remove(filename)
+	cmd := exec.Command("ffprobe", "-i", tempFile.Name(), "-show_entries", "format=duration", "-v", "quiet", "-of", "csv=p=0")
+	output, err := cmd.Output()
 	if err != nil {
-		logger("Failed to delete file: "+filename, logError, "Universal")
+		return 0, err
 	}
+	return strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
 }
 
-func addReverbToAudio(channel string) {
-	// ffmpeg -i input.mp3 -i "reverb.wav" -filter_complex "[0:a]apad=pad_dur=2[dry];[0:a]apad=pad_dur=2,afir=dry=10:wet=10[wet];[dry][wet]amix=weights='0.8 0.2'" -b:a 320k output.mp3
-	cmd := exec.Command("ffmpeg", "-i", "input-"+channel+".mp3", "-i", "static/reverb.wav", "-filter_complex", "[0:a]volume=0.25,apad=pad_dur=2,aformat=channel_layouts=stereo[dry];[0:a]volume=0.25,apad=pad_dur=2,aformat=channel_layouts=stereo,afir=dry=10:wet=10[wet];[dry][wet]amix=weights='0.9 0.1'", "-b:a", "320k", "output-"+channel+".mp3")
-	err := cmd.Run()
+// applyModifiers runs the audio through all modifiers in a single ffmpeg invocation
+// Audio is streamed through ffmpeg's stdin and stdout so nothing is written to disk
+func applyModifiers(data []byte, modifiers []AudioModifier, channel string) ([]byte, error) {
+	if len(modifiers) == 0 {
+		return data, nil
+	}
+
+	graph, impulse, err := buildModifierGraph(modifiers)
 	if err != nil {
-		logger("Failed to add reverb to audio", logError, channel)
+		return nil, err
+	}
+
+	var names []string
+	for _, mod := range modifiers {
+		names = append(names, mod.String())
 	}
+	logger("Applying modifiers: "+strings.Join(names, " "), logDebug, channel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), modifierTimeout)
+	defer cancel()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0"}
+	if impulse {
+		args = append(args, "-i", "static/reverb.wav")
+	}
+	args = append(args, "-filter_complex", graph, "-map", "[out]", "-b:a", "320k", "-f", "mp3", "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			logger("Timed out applying modifiers", logError, channel)
+			return nil, fmt.Errorf("timed out applying modifiers")
+		}
+		logger("Failed to apply modifiers: "+err.Error()+" "+strings.TrimSpace(stderr.String()), logError, channel)
+		return nil, fmt.Errorf("error applying modifiers: %w", err)
+	}
+
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("modifiers produced no audio")
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// ModifierParam describes a numeric argument a modifier tag accepts
+type ModifierParam struct {
+	Name    string  `json:"name"`
+	Default float64 `json:"default"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
 }
 
-func reverb(data []byte, channel string) []byte {
-	// Save audio data to file
-	saveAudioDataToFile("input-"+channel+".mp3", data)
+// ModifierDef describes a modifier that can be used as a tag, e.g. (pitch:+4)
+type ModifierDef struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Params      []ModifierParam `json:"params"`
+	// Impulse is set for modifiers that need static/reverb.wav as the second ffmpeg input ([1:a])
+	Impulse bool `json:"-"`
+	// Filter builds the ffmpeg filter graph reading from the in label and writing to the out label
+	Filter func(in string, out string, args []float64) string `json:"-"`
+	// TimeScale returns how much the modifier stretches the audio, nil if it keeps the original length
+	TimeScale func(args []float64) float64 `json:"-"`
+}
 
-	// Add reverb to audio
-	addReverbToAudio(channel)
+// AudioModifier is a modifier with its arguments resolved
+type AudioModifier struct {
+	Name string
+	Args []float64
+}
 
-	// Delete the input file
-	deleteAudioFile("input-" + channel + ".mp3")
+func (m AudioModifier) String() string {
+	if len(m.Args) == 0 {
+		return m.Name
+	}
+	var args []string
+	for _, arg := range m.Args {
+		args = append(args, strconv.FormatFloat(arg, 'f', -1, 64))
+	}
+	return m.Name + ":" + strings.Join(args, ",")
+}
 
-	// Load the reverb data from the output file
-	reverbData := loadAudioDataFromFile("output-" + channel + ".mp3")
+// simpleFilter wraps a single-input filter chain in the labels used by the filter graph
+func simpleFilter(chain func(args []float64) string) func(string, string, []float64) string {
+	return func(in string, out string, args []float64) string {
+		return fmt.Sprintf("[%s]%s[%s]", in, chain(args), out)
+	}
+}
 
-	// Delete the output file
-	deleteAudioFile("output-" + channel + ".mp3")
+// pitchChain shifts pitch by semitones while keeping the original tempo
+func pitchChain(semitones float64) string {
+	factor := math.Pow(2, semitones/12)
+	return fmt.Sprintf("aresample=44100,asetrate=%.2f,aresample=44100,atempo=%.5f", 44100*factor, 1/factor)
+}
 
-	return reverbData
+// modifierRegistry maps modifier names to their definitions
+// Add new modifiers here
+var modifierRegistry = map[string]ModifierDef{
+	"reverb": {
+		Name:        "reverb",
+		Description: "Room reverb",
+		Params:      []ModifierParam{{Name: "wet", Default: 0.1, Min: 0, Max: 1}},
+		Impulse:     true,
+		Filter: func(in string, out string, args []float64) string {
+			return fmt.Sprintf("[%s]volume=0.25,apad=pad_dur=2,aformat=channel_layouts=stereo,asplit[dry][pre];[pre][1:a]afir=dry=10:wet=10[wet];[dry][wet]amix=weights='%.2f %.2f'[%s]",
+				in, 1-args[0], args[0], out)
+		},
+	},
+	"pitch": {
+		Name:        "pitch",
+		Description: "Pitch shift in semitones",
+		Params:      []ModifierParam{{Name: "semitones", Default: 4, Min: -12, Max: 12}},
+		Filter: simpleFilter(func(args []float64) string {
+			return pitchChain(args[0])
+		}),
+	},
+	"speed": {
+		Name:        "speed",
+		Description: "Playback speed without changing pitch",
+		Params:      []ModifierParam{{Name: "factor", Default: 1.25, Min: 0.5, Max: 2}},
+		Filter: simpleFilter(func(args []float64) string {
+			return fmt.Sprintf("atempo=%.3f", args[0])
+		}),
+		TimeScale: func(args []float64) float64 {
+			return 1 / args[0]
+		},
+	},
+	"echo": {
+		Name:        "echo",
+		Description: "Echo with decay and delay in milliseconds",
+		Params: []ModifierParam{
+			{Name: "decay", Default: 0.5, Min: 0.05, Max: 0.9},
+			{Name: "delay", Default: 300, Min: 20, Max: 2000},
+		},
+		Filter: simpleFilter(func(args []float64) string {
+			return fmt.Sprintf("aecho=0.8:0.9:%.0f:%.2f", args[1], args[0])
+		}),
+	},
+	"volume": {
+		Name:        "volume",
+		Description: "Volume change in dB",
+		Params:      []ModifierParam{{Name: "db", Default: 6, Min: -30, Max: 12}},
+		Filter: simpleFilter(func(args []float64) string {
+			return fmt.Sprintf("volume=%.1fdB", args[0])
+		}),
+	},
+	"robot": {
+		Name:        "robot",
+		Description: "Robotic vocoder voice",
+		Filter: simpleFilter(func(args []float64) string {
+			return "afftfilt=real='hypot(re,im)*sin(0)':imag='hypot(re,im)*cos(0)':win_size=512:overlap=0.75"
+		}),
+	},
+	"telephone": {
+		Name:        "telephone",
+		Description: "Telephone band-pass",
+		Filter: simpleFilter(func(args []float64) string {
+			return "highpass=f=300,lowpass=f=3400,volume=2"
+		}),
+	},
+	"radio": {
+		Name:        "radio",
+		Description: "Crunchy radio band-pass",
+		Filter: simpleFilter(func(args []float64) string {
+			return "highpass=f=500,lowpass=f=2800,acrusher=bits=8:mix=0.3,volume=2"
+		}),
+	},
+	"chipmunk": {
+		Name:        "chipmunk",
+		Description: "High pitched chipmunk voice",
+		Filter: simpleFilter(func(args []float64) string {
+			return "aresample=44100,asetrate=66150,aresample=44100"
+		}),
+		TimeScale: func(args []float64) float64 {
+			return 44100.0 / 66150.0
+		},
+	},
+	"underwater": {
+		Name:        "underwater",
+		Description: "Muffled underwater voice",
+		Filter: simpleFilter(func(args []float64) string {
+			return "lowpass=f=400,vibrato=f=4:d=0.3,aecho=0.8:0.88:60:0.4,volume=2"
+		}),
+	},
 }
 
-func getAudioLengthFile(filename string) (int, error) {
-	logger("Getting audio length", logDebug, "Universal")
+// isModifier checks if a string is a known modifier name
+func isModifier(name string) bool {
+	_, ok := modifierRegistry[strings.ToLower(name)]
+	return ok
+}
 
-	cmd := exec.Command("ffprobe", "-i", filename, "-show_entries", "format=duration", "-v", "quiet", "-of", "csv=p=0")
-	output, err := cmd.Output()
-	if err != nil {
-		logger("Failed to get audio length", logError, "Universal")
-		return 0, err
+// defaultModifier returns a modifier with all of its arguments set to their defaults
+func defaultModifier(name string) AudioModifier {
+	def := modifierRegistry[name]
+	modifier := AudioModifier{Name: name}
+	for _, param := range def.Params {
+		modifier.Args = append(modifier.Args, param.Default)
 	}
+	return modifier
+}
 
-	length := string(output)
-	length = strings.TrimSuffix(length, "\n")
-	length = strings.TrimSuffix(length, "\r")
+// parseModifier parses a modifier tag such as "reverb", "pitch:+4" or "echo:0.5,400"
+// Arguments that are left out use their defaults
+func parseModifier(tag string) (AudioModifier, error) {
+	name, argString, hasArgs := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), ":")
+	name = strings.TrimSpace(name)
+	def, ok := modifierRegistry[name]
+	if !ok {
+		return AudioModifier{}, fmt.Errorf("unknown modifier: %s", name)
+	}
 
-	//round up to the nearest second
-	float, err := strconv.ParseFloat(length, 64)
-	if err != nil {
-		logger("Failed to convert audio length to float", logError, "Universal")
-		return 0, err
+	modifier := defaultModifier(name)
+	if !hasArgs {
+		return modifier, nil
 	}
 
-	rounded := math.Ceil(float)
+	values := strings.Split(argString, ",")
+	if len(values) > len(def.Params) {
+		return AudioModifier{}, fmt.Errorf("modifier %s takes at most %d arguments", name, len(def.Params))
+	}
+	for i, value := range values {
+		param := def.Params[i]
+		arg, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return AudioModifier{}, fmt.Errorf("invalid %s for %s: %s", param.Name, name, value)
+		}
+		if arg < param.Min || arg > param.Max {
+			return AudioModifier{}, fmt.Errorf("%s for %s must be between %g and %g", param.Name, name, param.Min, param.Max)
+		}
+		modifier.Args[i] = arg
+	}
 
-	return int(rounded), nil
+	return modifier, nil
 }
 
-// ModifierFunc type for audio modifier functions
-type ModifierFunc func(data []byte, channel string) []byte
+// parseModifierList parses a comma separated list of modifier tags from the VOICE_MODIFIERS config
+// Arguments are separated with ";" here since "," separates modifiers, e.g. "reverb,echo:0.5;400"
+func parseModifierList(list string, channel string) []AudioModifier {
+	var modifiers []AudioModifier
+	for _, tag := range strings.Split(list, ",") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		modifier, err := parseModifier(strings.ReplaceAll(tag, ";", ","))
+		if err != nil {
+			logger("Invalid voice modifier "+tag+": "+err.Error(), logError, channel)
+			continue
+		}
+		modifiers = append(modifiers, modifier)
+	}
+	return modifiers
+}
 
-// modifierFuncs maps modifier names to their functions
-var modifierFuncs = map[string]ModifierFunc{
-	"reverb": reverb,
-	// Add more modifiers here
+// modifierTimeScale returns how much a modifier chain stretches the audio it is applied to
+func modifierTimeScale(modifiers []AudioModifier) float64 {
+	scale := 1.0
+	for _, modifier := range modifiers {
+		def, ok := modifierRegistry[modifier.Name]
+		if ok && def.TimeScale != nil {
+			scale *= def.TimeScale(modifier.Args)
+		}
+	}
+	return scale
 }
 
-// applyModifiers applies all modifiers to audio data
-func applyModifiers(data []byte, modifiers []string, channel string) []byte {
-	result := data
-	for _, mod := range modifiers {
-		if fn, ok := modifierFuncs[strings.ToLower(mod)]; ok {
-			logger("Applying modifier: "+mod, logDebug, channel)
-			result = fn(result, channel)
+// mergeModifiers combines two modifier lists, letting overrides replace modifiers with the same name
+func mergeModifiers(base []AudioModifier, overrides []AudioModifier) []AudioModifier {
+	var result []AudioModifier
+	for _, mod := range base {
+		replaced := false
+		for _, override := range overrides {
+			if override.Name == mod.Name {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			result = append(result, mod)
 		}
 	}
-	return result
+	return append(result, overrides...)
 }
 
+// handleAPIModifiers returns the available modifiers as JSON for the SPA
+func handleAPIModifiers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var defs []ModifierDef
+	for _, def := range modifierRegistry {
+		if def.Params == nil {
+			def.Params = []ModifierParam{}
+		}
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+
+	json.NewEncoder(w).Encode(defs)
+}
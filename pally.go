@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -26,7 +25,7 @@ type PallyVoice struct {
 }
 
 func setupPally() {
-	keys := os.Getenv("PALLY_KEYS")
+	keys := getSetting("PALLY_KEYS")
 	err := json.Unmarshal([]byte(keys), &pallyKeys)
 	if err != nil {
 		logger("Error unmarshalling Pally keys: "+err.Error(), logError, "Universal")
@@ -42,7 +41,8 @@ func setupPally() {
 }
 
 func setupPallyVoices() {
-	voices := os.Getenv("PALLY_VOICES")
+	pallyVoices = nil
+	voices := getSetting("PALLY_VOICES")
 	err := json.Unmarshal([]byte(voices), &pallyVoices)
 	if err != nil {
 		logger("Error unmarshalling Pally voices: "+err.Error(), logError, "Universal")
@@ -93,25 +93,6 @@ type Page struct {
 func handlePallyMessage(message []byte, channel string) {
 	logger("Received message from Pally", logDebug, channel)
 
-	var checkRequest []Request
-
-	for _, request := range requests {
-		if request.Channel == channel {
-			checkRequest = append(checkRequest, request)
-		}
-	}
-
-	if len(checkRequest) > 0 {
-		logger("Last audio is still playing on "+channel, logInfo, channel)
-		time.Sleep(1 * time.Second)
-		go handlePallyMessage(message, channel)
-		return
-	}
-
-	time_of_message := time.Now()
-
-	var found bool
-
 	var campaignTipNotify CampaignTipNotify
 	err := json.Unmarshal(message, &campaignTipNotify)
 	if err != nil {
@@ -122,103 +103,15 @@ func handlePallyMessage(message []byte, channel string) {
 		logger("Not a campaign tip notification", logDebug, channel)
 		return
 	}
-	username := campaignTipNotify.Payload.CampaignTip.DisplayName
-	if username == "" {
-		logger("No username found in message so assuming it's an anonymous tip", logInfo, channel)
-		username = "Anonymous"
-	}
-
-	// Check if there is a connected client for the channel
-	for {
-		if time.Since(time_of_message) > 30*time.Second {
-			logger("No connected client", logInfo, channel)
-			found = false
-			return
-		}
-		for _, clientChannel := range clients {
-			if clientChannel == channel {
-				found = true
-				break
-			}
-		}
-		if found {
-			break
-		}
-		time.Sleep(1 * time.Second)
-	}
-
-	amount := campaignTipNotify.Payload.CampaignTip.GrossAmountInCents
-	// format as "x dollars and xx cents" as a string. No $ sign. It will be added in the TTS message
-	//if there are no cents, it will be formatted as "x dollars"
-	dollars := amount / 100
-	cents := amount % 100
-	var amountFormatted string
-	if cents == 0 && dollars == 1 {
-		amountFormatted = fmt.Sprintf("%d dollar", dollars)
-	} else if cents == 0 && dollars > 1 {
-		amountFormatted = fmt.Sprintf("%d dollars", dollars)
-	} else if cents == 1 && dollars == 0 {
-		amountFormatted = fmt.Sprintf("%d cent", cents)
-	} else if cents == 1 && dollars == 1 {
-		amountFormatted = fmt.Sprintf("%d dollar and %d cent", dollars, cents)
-	} else if cents == 1 && dollars > 1 {
-		amountFormatted = fmt.Sprintf("%d dollars and %d cent", dollars, cents)
-	} else if cents > 1 && dollars == 0 {
-		amountFormatted = fmt.Sprintf("%d cents", cents)
-	} else {
-		amountFormatted = fmt.Sprintf("%d dollars and %02d cents", dollars, cents)
-	}
-	ttsMessage := campaignTipNotify.Payload.CampaignTip.Message
-	if ttsMessage == "" {
-		ttsMessage = fmt.Sprintf("%s just tipped %s to the mods!", username, amountFormatted)
-	} else {
-		ttsMessage = fmt.Sprintf("%s just tipped %s to the mods! %s", username, amountFormatted, ttsMessage)
-	}
-
-	logger(ttsMessage, logInfo, channel)
-
-	// Get the default voice for this Pally channel
-	pallyVoice := ""
-	for _, voice := range pallyVoices {
-		if voice.Channel == channel {
-			pallyVoice = voice.Voice
-			break
-		}
-	}
-
-	// Use unified message processor - now supports voice tags, modifiers, and effects
-	msg := Message{
-		Channel:         channel,
-		Text:            ttsMessage,
-		DefaultVoice:    pallyVoice,
-		Stability:       0.40,
-		SimilarityBoost: 1.00,
-		Style:           0.00,
-		PlayAlert:       true,
-	}
-
-	go func() {
-		err := ProcessAndPlay(msg)
-		if err != nil {
-			logger("Error processing Pally message: "+err.Error(), logError, channel)
-		}
-
-		// Log to MongoDB if enabled
-		if mongoEnabled {
-			requestTime := fmt.Sprintf("%d", time.Now().UnixNano())
-			request := Request{
-				Channel: channel + "-pally",
-				Text:    ttsMessage,
-				Time:    requestTime,
-			}
-			data, err := createData(request)
-			if err != nil {
-				logger("Error creating data: "+err.Error(), logError, channel)
-				return
-			}
-			addData(data)
-		}
-	}()
+	tip := campaignTipNotify.Payload.CampaignTip
+	handleDonation(Donation{
+		Source:      sourcePally,
+		Channel:     channel,
+		Donor:       tip.DisplayName,
+		AmountCents: tip.GrossAmountInCents,
+		Currency:    "USD",
+		Message:     tip.Message,
+	})
 }
 
 func attemptConnectToPallyWebsocket(channel string, pallyKey string) error {
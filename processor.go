@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
@@ -19,17 +22,40 @@ type Message struct {
 	SimilarityBoost float64
 	Style           float64
 	PlayAlert       bool
+	Alert           string // Alert subfolder or file in alerts/<channel>, empty picks from the channel's folder
+	JobID           string // Queue job ID, also used as the request time sent to the client
+	NoCache         bool   // Regenerate audio instead of using the audio cache
+	Stitch          bool   // Join all segments into one audio payload before sending
+	Audio           []byte // Pre-rendered audio to play instead of parsing Text (e.g. replays)
+	User            string // Who sent the message, empty if unknown
+	Announcement    bool   // Tip or Twitch event announcement, always truncated so it isn't dropped by a reject limit
 }
 
 // AudioSegment represents a piece of audio with voice and modifiers
 type AudioSegment struct {
 	Text      string
-	Voice     string   // Voice ID
-	VoiceName string   // Voice name for logging
-	Modifiers []string // Modifiers to apply (e.g., "reverb")
-	Effect    string   // Sound effect to play (empty if TTS segment)
+	Voice     string          // Voice ID
+	VoiceName string          // Voice name for logging
+	Modifiers []AudioModifier // Modifiers to apply (e.g., reverb, pitch:+4)
+	Effect    string          // Sound effect to play (empty if TTS segment)
 }
 
+// replyTimeout is how long to wait for a client to confirm a segment finished playing
+const replyTimeout = 120 * time.Second
+
+// PlaybackSegment is generated audio plus the metadata sent to overlays with it
+type PlaybackSegment struct {
+	Audio     []byte
+	Text      string
+	VoiceName string
+	Effect    string
+	Duration  float64      // Length in seconds, 0 if unknown
+	Words     []WordTiming // Word timings relative to the start of Audio, only set when caption alignment is enabled
+}
+
+// messageTagRe finds all tags - using () instead of [] to avoid conflicts with ElevenLabs v3 audio tags
+var messageTagRe = regexp.MustCompile(`\(([^)]+)\)`)
+
 // tagType represents what kind of tag was found
 type tagType int
 
@@ -50,16 +76,16 @@ func ParseMessage(msg Message) ([]AudioSegment, error) {
 		return nil, fmt.Errorf("empty message")
 	}
 
-	// Get default voice ID
-	defaultVoiceID := defaultVoiceID
+	// Get default voice ID, from the channel's catalog unless the message picks one
+	_, defaultVoiceID := getDefaultVoice(msg.Channel)
 	if msg.DefaultVoice != "" {
-		if id, err := getVoiceID(msg.DefaultVoice); err == nil {
+		if id, err := getVoiceID(msg.DefaultVoice, msg.Channel); err == nil {
 			defaultVoiceID = id
 		}
 	}
 
 	// Parse the text into segments
-	segments, err := parseTextToSegments(text, defaultVoiceID)
+	segments, err := parseTextToSegments(text, defaultVoiceID, msg.Channel)
 	if err != nil {
 		return nil, err
 	}
@@ -68,17 +94,15 @@ func ParseMessage(msg Message) ([]AudioSegment, error) {
 }
 
 // parseTextToSegments handles the core parsing logic
-func parseTextToSegments(text string, defaultVoiceID string) ([]AudioSegment, error) {
+func parseTextToSegments(text string, defaultVoiceID string, channel string) ([]AudioSegment, error) {
 	var segments []AudioSegment
 
 	// Current state
 	currentVoice := defaultVoiceID
-	currentVoiceName := defaultVoice
-	activeModifiers := make(map[string]bool)
+	currentVoiceName, _ := getVoiceName(defaultVoiceID, channel)
+	activeModifiers := make(map[string]AudioModifier)
 
-	// Regex to find all tags - using () instead of [] to avoid conflicts with ElevenLabs v3 audio tags
-	tagRe := regexp.MustCompile(`\(([^)]+)\)`)
-	matches := tagRe.FindAllStringSubmatchIndex(text, -1)
+	matches := messageTagRe.FindAllStringSubmatchIndex(text, -1)
 
 	if len(matches) == 0 {
 		// No tags, just return the text with default voice
@@ -111,7 +135,7 @@ func parseTextToSegments(text string, defaultVoiceID string) ([]AudioSegment, er
 		}
 
 		// Determine tag type
-		tType, name := identifyTag(tagContent)
+		tType, name := identifyTag(tagContent, channel)
 
 		switch tType {
 		case tagVoice:
@@ -126,7 +150,7 @@ func parseTextToSegments(text string, defaultVoiceID string) ([]AudioSegment, er
 				pendingText = ""
 			}
 			// Switch voice
-			if voiceID, err := getVoiceID(name); err == nil {
+			if voiceID, err := getVoiceID(name, channel); err == nil {
 				currentVoice = voiceID
 				currentVoiceName = name
 			} else {
@@ -144,8 +168,12 @@ func parseTextToSegments(text string, defaultVoiceID string) ([]AudioSegment, er
 				})
 				pendingText = ""
 			}
-			// Activate modifier for following text
-			activeModifiers[name] = true
+			// Activate modifier for following text, replacing any earlier arguments
+			modifier, err := parseModifier(name)
+			if err != nil {
+				return nil, err
+			}
+			activeModifiers[modifier.Name] = modifier
 
 		case tagModifierEnd:
 			// If there's pending text, create segment with current modifiers
@@ -205,8 +233,8 @@ func parseTextToSegments(text string, defaultVoiceID string) ([]AudioSegment, er
 	return segments, nil
 }
 
-// identifyTag determines what kind of tag this is
-func identifyTag(tagContent string) (tagType, string) {
+// identifyTag determines what kind of tag this is, effects are resolved to their library name
+func identifyTag(tagContent string, channel string) (tagType, string) {
 	tagContent = strings.TrimSpace(tagContent)
 	tagLower := strings.ToLower(tagContent)
 
@@ -215,9 +243,17 @@ func identifyTag(tagContent string) (tagType, string) {
 		return tagVoice, tagContent[2:]
 	}
 	if strings.HasPrefix(tagLower, "e-") {
+		if effect, found := resolveEffect(tagLower[2:], channel); found {
+			return tagEffect, effect.Name
+		}
 		return tagEffect, tagContent[2:]
 	}
 
+	// Check for a modifier with arguments (e.g., "pitch:+4")
+	if modifierName, _, hasArgs := strings.Cut(tagLower, ":"); hasArgs && isModifier(strings.TrimSpace(modifierName)) {
+		return tagModifier, tagLower
+	}
+
 	// Check for modifier end tag (e.g., "reverb-end")
 	if strings.HasSuffix(tagLower, "-end") {
 		modifierName := tagLower[:len(tagLower)-4]
@@ -227,7 +263,7 @@ func identifyTag(tagContent string) (tagType, string) {
 	}
 
 	// Check if it's a known voice
-	if validVoice(tagContent) {
+	if validVoice(tagContent, channel) {
 		return tagVoice, tagContent
 	}
 
@@ -237,19 +273,22 @@ func identifyTag(tagContent string) (tagType, string) {
 	}
 
 	// Check if it's a known effect
-	if _, found := getEffectSound(tagLower); found {
-		return tagEffect, tagLower
+	if effect, found := resolveEffect(tagLower, channel); found {
+		return tagEffect, effect.Name
 	}
 
 	return tagUnknown, tagContent
 }
 
-// getActiveModifiers converts the modifier map to a slice
-func getActiveModifiers(modifiers map[string]bool) []string {
-	var result []string
-	for mod := range modifiers {
+// getActiveModifiers converts the modifier map to a slice in a stable order
+func getActiveModifiers(modifiers map[string]AudioModifier) []AudioModifier {
+	var result []AudioModifier
+	for _, mod := range modifiers {
 		result = append(result, mod)
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
 	return result
 }
 
@@ -258,6 +297,21 @@ func getActiveModifiers(modifiers map[string]bool) []string {
 func ProcessAndPlay(msg Message) error {
 	logger("Processing message through unified pipeline", logInfo, msg.Channel)
 
+	requestTime := msg.JobID
+	if requestTime == "" {
+		requestTime = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	// Pre-rendered audio skips parsing and generation entirely
+	if len(msg.Audio) > 0 {
+		requests = append(requests, Request{Channel: msg.Channel, Time: requestTime, Text: msg.Text})
+		replay := PlaybackSegment{Audio: msg.Audio, Text: msg.Text}
+		replay.Duration, _ = getAudioDuration(msg.Audio)
+		err := playSegment(msg.Channel, requestTime, 0, 1, replay, replyTimeout)
+		clearChannelRequests(msg.Channel)
+		return err
+	}
+
 	// Parse the message into segments
 	segments, err := ParseMessage(msg)
 	if err != nil {
@@ -265,13 +319,18 @@ func ProcessAndPlay(msg Message) error {
 		return err
 	}
 
+	// Limits are applied after parsing so tags don't count towards them
+	segments, err = applyMessageLimits(msg.Channel, segments, msg.Announcement)
+	if err != nil {
+		logger("Message over the message limits, skipping", logInfo, msg.Channel)
+		return err
+	}
+
 	if len(segments) == 0 {
 		logger("No segments to process", logInfo, msg.Channel)
 		return nil
 	}
 
-	requestTime := fmt.Sprintf("%d", time.Now().UnixNano())
-
 	// Create a request entry for tracking
 	trackingRequest := Request{
 		Channel: msg.Channel,
@@ -280,21 +339,30 @@ func ProcessAndPlay(msg Message) error {
 	}
 	requests = append(requests, trackingRequest)
 
-	// Play alert sound if requested
-	if msg.PlayAlert {
-		playAlertSound(msg.Channel)
-	}
-
 	// PHASE 1: Pre-generate all audio segments
 	logger("Pre-generating all audio segments", logDebug, msg.Channel)
-	var audioSegments [][]byte
+	var audioSegments []PlaybackSegment
+
+	// Play alert sound if requested, stitched messages mix it in as the first segment instead
+	if msg.PlayAlert {
+		if msg.Stitch {
+			if alertAudio, found := getAlertAudio(msg.Channel, msg.Alert); found {
+				alertSegment := PlaybackSegment{Audio: alertAudio}
+				alertSegment.Duration, _ = getAudioDuration(alertAudio)
+				audioSegments = append(audioSegments, alertSegment)
+			}
+		} else {
+			playAlertSound(msg.Channel, msg.Alert, requestTime)
+		}
+	}
 
 	for _, segment := range segments {
 		var audioData []byte
+		var words []WordTiming
 
 		if segment.Effect != "" {
 			// This is an effect sound
-			effectAudio, found := getEffectSound(segment.Effect)
+			effectAudio, found := getEffectSound(segment.Effect, msg.Channel)
 			if !found {
 				logger("Effect sound not found: "+segment.Effect, logError, msg.Channel)
 				clearChannelRequests(msg.Channel)
@@ -303,7 +371,7 @@ func ProcessAndPlay(msg Message) error {
 			audioData = effectAudio
 		} else if segment.Text != "" {
 			// This is TTS audio
-			style, err := getVoiceStyle(segment.Voice)
+			style, err := getVoiceStyle(segment.Voice, msg.Channel)
 			if err != nil {
 				style = msg.Style
 			}
@@ -318,22 +386,33 @@ func ProcessAndPlay(msg Message) error {
 					SimilarityBoost: msg.SimilarityBoost,
 					Style:           style,
 				},
+				NoCache:   msg.NoCache,
+				Modifiers: segment.Modifiers,
 			}
 
-			audioData, err = generateAudio(ttsRequest)
+			// The budget is checked inside generateAudio so cached lines aren't rejected or downgraded
+			generated, err := generateAudio(ttsRequest)
 			if err != nil {
-				logger("Error generating audio: "+err.Error(), logError, msg.Channel)
+				if !errors.Is(err, errBudgetExceeded) {
+					logger("Error generating audio: "+err.Error(), logError, msg.Channel)
+				}
 				clearChannelRequests(msg.Channel)
 				return err
 			}
-
-			// Apply modifiers if any
-			if len(segment.Modifiers) > 0 {
-				audioData = applyModifiers(audioData, segment.Modifiers, msg.Channel)
+			ttsRequest.Voice.Voice, ttsRequest.Model = generated.Voice, generated.Model
+			audioData = generated.Audio
+			words = generated.Words
+
+			// Local voices and cached audio don't cost characters
+			billed := !generated.Cached && getVoiceProvider(ttsRequest.Voice.Voice, msg.Channel).Name() == elevenLabsProviderName
+			if billed {
+				recordBudgetUsage(msg.Channel, utf8.RuneCountInString(ttsRequest.Text))
 			}
 
 			// Log data for MongoDB if enabled
-			if mongoEnabled {
+			if mongoEnabled && generated.Cached {
+				addData(createCachedData(ttsRequest))
+			} else if mongoEnabled && billed {
 				data, err := createData(ttsRequest)
 				if err != nil {
 					logger("Error creating data: "+err.Error(), logError, msg.Channel)
@@ -344,49 +423,133 @@ func ProcessAndPlay(msg Message) error {
 		} else {
 			continue
 		}
-
-		audioSegments = append(audioSegments, audioData)
+		audioData = normalizeLoudness(audioData, msg.Channel)
+
+		playbackSegment := PlaybackSegment{
+			Audio:     audioData,
+			Text:      segment.Text,
+			VoiceName: segment.VoiceName,
+			Effect:    segment.Effect,
+			Words:     words,
+		}
+		playbackSegment.Duration, err = getAudioDuration(audioData)
+		if err != nil {
+			logger("Error getting segment duration: "+err.Error(), logDebug, msg.Channel)
+		}
+		audioSegments = append(audioSegments, playbackSegment)
 	}
 
 	logger(fmt.Sprintf("All %d audio segments generated, now sending", len(audioSegments)), logDebug, msg.Channel)
 
-	// PHASE 2: Send all pre-generated audio segments
-	for _, audioData := range audioSegments {
-		sendTextMessage(msg.Channel, "start "+requestTime)
-		time.Sleep(50 * time.Millisecond)
+	timeout := replyTimeout
+	if msg.Stitch && len(audioSegments) > 0 {
+		var audio [][]byte
+		var texts []string
+		var durations []float64
+		for _, segment := range audioSegments {
+			audio = append(audio, segment.Audio)
+			durations = append(durations, segment.Duration)
+			if segment.Text != "" {
+				texts = append(texts, segment.Text)
+			}
+		}
 
-		sendRequest := Request{
-			Channel: msg.Channel,
-			Time:    requestTime,
+		// Word timings are relative to their own segment, move them to where it starts in the mix
+		var words []WordTiming
+		for i, offset := range stitchOffsets(durations) {
+			words = append(words, shiftWordTimings(audioSegments[i].Words, offset, 1)...)
 		}
-		sendAudio(sendRequest, audioData)
 
-		// Wait for playback confirmation
-		playing[requestTime] = true
-		replyVerifyTicker := time.NewTicker(120 * time.Second)
+		mix, duration, err := stitchAudio(audio, msg.Channel)
+		if err != nil {
+			logger("Error stitching audio, sending segments separately: "+err.Error(), logError, msg.Channel)
+		} else {
+			storeMix(requestTime, msg.Channel, mix)
+			audioSegments = []PlaybackSegment{{
+				Audio:    mix,
+				Text:     strings.Join(texts, " "),
+				Duration: duration,
+				Words:    words,
+			}}
+			timeout += time.Duration(duration * float64(time.Second))
+		}
+	}
 
-		for playing[requestTime] {
-			select {
-			case <-replyVerifyTicker.C:
-				requestName := getAudioDataName(requestTime)
-				logger("No reply received for "+requestName, logInfo, msg.Channel)
-				clearChannelRequests(msg.Channel)
-				sendTextMessage(msg.Channel, "reload")
-				return fmt.Errorf("timeout waiting for playback confirmation")
-			default:
-				time.Sleep(50 * time.Millisecond)
-			}
+	// PHASE 2: Send all pre-generated audio segments
+	for i, segment := range audioSegments {
+		if err := playSegment(msg.Channel, requestTime, i, len(audioSegments), segment, timeout); err != nil {
+			clearChannelRequests(msg.Channel)
+			return err
 		}
-		replyVerifyTicker.Stop()
 	}
 
 	clearChannelRequests(msg.Channel)
 	return nil
 }
 
-// playAlertSound plays the alert sound for a channel
-func playAlertSound(channel string) {
-	alertSound, alertExists := getAlertSound(channel)
+// playSegment sends audio to the channel's clients and waits for them to confirm playback
+// Returns errPlaybackSkipped if a moderator skipped the message
+func playSegment(channel string, requestTime string, index int, count int, segment PlaybackSegment, timeout time.Duration) error {
+	if isJobSkipped(requestTime) {
+		return errPlaybackSkipped
+	}
+
+	sendControlMessage(channel, ControlMessage{
+		Type:       controlStart,
+		JobID:      requestTime,
+		Segment:    index,
+		Segments:   count,
+		Duration:   segment.Duration,
+		Text:       segment.Text,
+		Voice:      segment.VoiceName,
+		Effect:     segment.Effect,
+		Words:      segment.Words,
+		Normalized: loudnessEnabled(channel),
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// Register before sending so a fast confirmation isn't missed
+	state := startPlayback(channel, requestTime)
+	if isChannelPaused(channel) {
+		state.paused <- true
+	}
+
+	sendRequest := Request{
+		Channel: channel,
+		Time:    requestTime,
+	}
+	sendAudio(sendRequest, segment.Audio)
+
+	// Wait for playback confirmation
+	err := waitForPlayback(state, timeout)
+	if errors.Is(err, errPlaybackTimeout) {
+		finishPlayback(channel, requestTime, nil)
+		requestName := getAudioDataName(requestTime)
+		logger("No reply received for "+requestName, logInfo, channel)
+		sendControlMessage(channel, ControlMessage{Type: controlReload, JobID: requestTime})
+	}
+	return err
+}
+
+// getAlertAudio returns the bytes of a random alert sound for a channel
+func getAlertAudio(channel string, alert string) ([]byte, bool) {
+	alertSound, alertExists := getAlertSound(channel, alert)
+	if !alertExists {
+		return nil, false
+	}
+	defer alertSound.Close()
+
+	alertSoundBytes, err := io.ReadAll(alertSound)
+	if err != nil {
+		logger("Error reading alert sound: "+err.Error(), logError, channel)
+		return nil, false
+	}
+	return normalizeLoudness(alertSoundBytes, channel), true
+}
+
+// playAlertSound plays the alert sound for a channel ahead of a message's segments
+func playAlertSound(channel string, alert string, requestTime string) {
+	alertSound, alertExists := getAlertSound(channel, alert)
 	if !alertExists {
 		return
 	}
@@ -396,6 +559,7 @@ func playAlertSound(channel string) {
 		logger("Error reading alert sound: "+err.Error(), logError, channel)
 		return
 	}
+	alertSoundBytes = normalizeLoudness(alertSoundBytes, channel)
 
 	waitTime, err := getAudioLengthFile(alertSound.Name())
 	if err != nil {
@@ -403,32 +567,27 @@ func playAlertSound(channel string) {
 		waitTime = 5
 	}
 
-	for client, clientChannel := range clients {
-		if clientChannel == channel {
-			clientName := getClientName(fmt.Sprintf("%p", client))
-			err := client.WriteMessage(websocket.BinaryMessage, alertSoundBytes)
-			if err != nil {
-				logger("Error sending alert sound to "+clientName+": "+err.Error(), logError, channel)
-				client.Close()
-				connMutex.Lock()
-				delete(clients, client)
-				connMutex.Unlock()
-			} else {
-				logger("Alert sound sent to "+clientName, logInfo, channel)
-			}
+	// Clients keep the normalized flag from the last start, so the alert gets its own
+	// The job ID is suffixed so the overlay confirming the alert can't finish the message's first segment
+	sendControlMessage(channel, ControlMessage{
+		Type:       controlStart,
+		JobID:      requestTime + "-alert",
+		Segments:   1,
+		Duration:   float64(waitTime),
+		Normalized: loudnessEnabled(channel),
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	for _, client := range channelClients(channel, true) {
+		clientName := getClientName(fmt.Sprintf("%p", client))
+		err := writeToClient(client, websocket.BinaryMessage, alertSoundBytes)
+		if err != nil {
+			logger("Error sending alert sound to "+clientName+": "+err.Error(), logError, channel)
+			removeClient(client)
+		} else {
+			logger("Alert sound sent to "+clientName, logInfo, channel)
 		}
 	}
 
 	time.Sleep(time.Duration(waitTime) * time.Second)
 }
-
-// isModifier checks if a string is a known modifier name
-func isModifier(name string) bool {
-	modifiers := []string{"reverb"} // Add more modifiers here
-	for _, m := range modifiers {
-		if strings.EqualFold(m, name) {
-			return true
-		}
-	}
-	return false
-}
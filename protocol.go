@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Overlay protocol versions
+// Version 1 is the original plain text protocol ("start <time>", "confirm <time>", ...)
+// Version 2 wraps every control message in a JSON envelope, audio is still sent as binary frames
+const (
+	protocolLegacy = 1
+	protocolJSON   = 2
+)
+
+// Control message types
+const (
+	controlStart   = "start"
+	controlConfirm = "confirm"
+	controlUpdate  = "update"
+	controlReload  = "reload"
+	controlRefresh = "refresh"
+	controlPing    = "ping"
+	controlClose   = "close"
+	controlSkip    = "skip"
+	controlPause   = "pause"
+	controlResume  = "resume"
+)
+
+// ControlMessage is the JSON envelope for protocol version 2
+type ControlMessage struct {
+	Version    int          `json:"v"`
+	Type       string       `json:"type"`
+	JobID      string       `json:"job_id,omitempty"`
+	Segment    int          `json:"segment"`
+	Segments   int          `json:"segments,omitempty"`
+	Duration   float64      `json:"duration,omitempty"`
+	Text       string       `json:"text,omitempty"`
+	Voice      string       `json:"voice,omitempty"`
+	Effect     string       `json:"effect,omitempty"`
+	Words      []WordTiming `json:"words,omitempty"`
+	Normalized bool         `json:"normalized,omitempty"` // Audio is already at the channel's loudness target
+	Hash       string       `json:"hash,omitempty"`
+}
+
+// parseProtocolVersion reads the protocol version a client asked for, defaulting to the legacy protocol
+func parseProtocolVersion(value string) int {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < protocolLegacy {
+		return protocolLegacy
+	}
+	if version > protocolJSON {
+		return protocolJSON
+	}
+	return version
+}
+
+// encodeControlMessage renders a control message for a client speaking the given protocol version
+// Returns false if the message has no legacy equivalent and should not be sent
+func encodeControlMessage(message ControlMessage, version int) ([]byte, bool) {
+	if version >= protocolJSON {
+		message.Version = protocolJSON
+		data, err := json.Marshal(message)
+		if err != nil {
+			return nil, false
+		}
+		return data, true
+	}
+
+	switch message.Type {
+	case controlStart:
+		return []byte("start " + message.JobID), true
+	case controlUpdate:
+		return []byte("update " + message.Hash), true
+	case controlReload, controlRefresh, controlSkip, controlPause, controlResume:
+		return []byte(message.Type), true
+	default:
+		return nil, false
+	}
+}
+
+// decodeControlMessage parses a text frame from a client in either protocol
+func decodeControlMessage(raw string) (ControlMessage, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, "{") {
+		var message ControlMessage
+		if err := json.Unmarshal([]byte(raw), &message); err != nil {
+			return ControlMessage{}, err
+		}
+		if message.Type == "" {
+			return ControlMessage{}, fmt.Errorf("missing message type")
+		}
+		return message, nil
+	}
+
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		return ControlMessage{}, fmt.Errorf("empty message")
+	}
+	message := ControlMessage{Version: protocolLegacy, Type: fields[0]}
+	if message.Type == controlConfirm {
+		if len(fields) < 2 {
+			return ControlMessage{}, fmt.Errorf("confirm without timestamp")
+		}
+		message.JobID = fields[1]
+	}
+	return message, nil
+}
+
+// sendControlMessage sends a control message to every client of a channel in the protocol each one speaks
+func sendControlMessage(channel string, message ControlMessage) {
+	for _, client := range channelClients(channel, false) {
+		clientName := getClientName(fmt.Sprintf("%p", client))
+		data, ok := encodeControlMessage(message, getClientProtocol(client))
+		if !ok {
+			continue
+		}
+		err := writeToClient(client, websocket.TextMessage, data)
+		if err != nil {
+			logger("Error sending "+message.Type+" message to "+clientName+": "+err.Error(), logError, channel)
+			removeClient(client)
+			continue
+		}
+		logger("Sent "+message.Type+" message to "+clientName, logDebug, channel)
+	}
+}
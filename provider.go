@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	elevenLabsProviderName = "elevenlabs"
+	localProviderName      = "local"
+)
+
+// TTSProvider synthesizes the audio for a single TTS segment
+type TTSProvider interface {
+	Name() string
+	// Settings returns the model and output format the provider will use for the request
+	Settings(request Request) (model string, format string)
+	Generate(request Request) ([]byte, error)
+}
+
+// providers maps provider names used in the VOICES config to their implementations
+var providers = map[string]TTSProvider{
+	elevenLabsProviderName: elevenLabsProvider{},
+	localProviderName:      localProvider{},
+}
+
+// getVoiceProvider returns the provider for a voice ID, defaulting to ElevenLabs
+func getVoiceProvider(ID string, channel string) TTSProvider {
+	if v, found := findVoiceByID(ID, channel); found {
+		if provider, ok := providers[strings.ToLower(v.Provider)]; ok {
+			return provider
+		}
+		if v.Provider != "" {
+			logger("Unknown provider "+v.Provider+" for voice "+v.Name+", using ElevenLabs", logError, channel)
+		}
+	}
+	return providers[elevenLabsProviderName]
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	queues         = make(map[string]*channelQueue)
+	queueMutex     = sync.Mutex{}
+	maxQueueLength = 50
+
+	errQueueFull = errors.New("queue is full")
+)
+
+// QueueJob is a message waiting to be played on a channel
+type QueueJob struct {
+	ID       string    `json:"id"`
+	Channel  string    `json:"channel"`
+	Text     string    `json:"text"`
+	QueuedAt time.Time `json:"queued_at"`
+	Message  Message   `json:"-"`
+}
+
+// channelQueue holds the pending jobs for a single channel
+// Only one worker drains a channel queue at a time
+type channelQueue struct {
+	jobs    []*QueueJob
+	current *QueueJob
+	running bool
+}
+
+func setupQueue() {
+	maxLength := getSetting("QUEUE_MAX_LENGTH")
+	if maxLength == "" {
+		return
+	}
+	length, err := strconv.Atoi(maxLength)
+	if err != nil || length < 0 {
+		logger("Invalid QUEUE_MAX_LENGTH, using default of "+strconv.Itoa(maxQueueLength), logError, "Universal")
+		return
+	}
+	maxQueueLength = length
+}
+
+func generateJobID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
+
+// enqueueMessage adds a message to the channel's queue and starts a worker if none is running
+// Returns the job and the number of jobs ahead of it (0 means it plays next)
+func enqueueMessage(msg Message) (*QueueJob, int, error) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	queue, exists := queues[msg.Channel]
+	if !exists {
+		queue = &channelQueue{}
+		queues[msg.Channel] = queue
+	}
+
+	if maxQueueLength > 0 && len(queue.jobs) >= maxQueueLength {
+		return nil, 0, errQueueFull
+	}
+
+	if msg.JobID == "" {
+		msg.JobID = generateJobID()
+	}
+
+	job := &QueueJob{
+		ID:       msg.JobID,
+		Channel:  msg.Channel,
+		Text:     msg.Text,
+		QueuedAt: time.Now(),
+		Message:  msg,
+	}
+
+	position := len(queue.jobs)
+	if queue.current != nil {
+		position++
+	}
+	queue.jobs = append(queue.jobs, job)
+
+	logger(fmt.Sprintf("Queued job %s at position %d", getAudioDataName(job.ID), position), logInfo, msg.Channel)
+
+	if !queue.running {
+		queue.running = true
+		go runQueue(msg.Channel)
+	}
+
+	return job, position, nil
+}
+
+// nextJob pops the next job off the channel's queue, stopping the worker when it is empty
+func nextJob(channel string) *QueueJob {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	queue := queues[channel]
+	if len(queue.jobs) == 0 {
+		queue.current = nil
+		queue.running = false
+		return nil
+	}
+
+	job := queue.jobs[0]
+	queue.jobs = queue.jobs[1:]
+	queue.current = job
+	return job
+}
+
+// clearQueue drops every job waiting on a channel, the one playing is left alone
+// Returns the number of jobs removed
+func clearQueue(channel string) int {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	queue, exists := queues[channel]
+	if !exists {
+		return 0
+	}
+	cleared := len(queue.jobs)
+	queue.jobs = nil
+	return cleared
+}
+
+// runQueue drains a channel's queue one message at a time
+func runQueue(channel string) {
+	logger("Queue worker started", logDebug, channel)
+	for {
+		waitWhilePaused(channel)
+		job := nextJob(channel)
+		if job == nil {
+			logger("Queue empty, worker stopped", logDebug, channel)
+			return
+		}
+		playJob(job)
+		finishJob(job)
+	}
+}
+
+// finishJob clears the job that just played so a paused queue doesn't still report it as playing
+func finishJob(job *QueueJob) {
+	queueMutex.Lock()
+	if queue, exists := queues[job.Channel]; exists && queue.current == job {
+		queue.current = nil
+	}
+	queueMutex.Unlock()
+
+	// Forgotten after current is cleared so a skip can't mark the job once it is done
+	forgetSkippedJob(job.ID)
+}
+
+// skipCurrentJob marks the job playing on a channel as skipped and returns it
+func skipCurrentJob(channel string) *QueueJob {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	queue, exists := queues[channel]
+	if !exists || queue.current == nil {
+		return nil
+	}
+	playbackMutex.Lock()
+	skippedJobs[queue.current.ID] = true
+	playbackMutex.Unlock()
+	return queue.current
+}
+
+func playJob(job *QueueJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger("Recovered from panic in queue worker: "+fmt.Sprintf("%v", r), logError, job.Channel)
+			clearChannelRequests(job.Channel)
+		}
+	}()
+
+	jobName := getAudioDataName(job.ID)
+	if !channelHasClient(job.Channel) {
+		logger("No connected client, dropping job "+jobName, logInfo, job.Channel)
+		return
+	}
+
+	logger("Playing job "+jobName, logInfo, job.Channel)
+	err := ProcessAndPlay(job.Message)
+	if errors.Is(err, errPlaybackSkipped) {
+		logger("Job "+jobName+" was skipped", logInfo, job.Channel)
+	} else if err != nil {
+		logger("Error playing job "+jobName+": "+err.Error(), logError, job.Channel)
+	}
+}
+
+// getQueueJobs returns the job currently playing and a copy of the jobs waiting behind it
+func getQueueJobs(channel string) (*QueueJob, []*QueueJob) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	queue, exists := queues[channel]
+	if !exists {
+		return nil, nil
+	}
+
+	jobs := make([]*QueueJob, len(queue.jobs))
+	copy(jobs, queue.jobs)
+	return queue.current, jobs
+}
+
+type QueueResponse struct {
+	JobID    string `json:"job_id"`
+	Position int    `json:"position"`
+}
+
+type QueueStatus struct {
+	Playing *QueueJob   `json:"playing"`
+	Queued  []*QueueJob `json:"queued"`
+}
+
+// handleQueue returns the current queue for a channel as JSON
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	channel := strings.ToLower(r.URL.Query().Get("channel"))
+	if channel == "" {
+		http.Error(w, "Missing channel", http.StatusBadRequest)
+		return
+	}
+	if !requireChannelAuth(w, r, channel, r.URL.Query().Get("key")) {
+		return
+	}
+
+	current, jobs := getQueueJobs(channel)
+	if jobs == nil {
+		jobs = []*QueueJob{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QueueStatus{
+		Playing: current,
+		Queued:  jobs,
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimits      []RateLimitConfig
+	globalRateLimit *BucketConfig
+	rateBuckets     = make(map[string]*tokenBucket)
+	rateMutex       = sync.Mutex{}
+)
+
+// BucketConfig is a token bucket: up to Burst messages at once, refilled evenly over WindowSeconds
+type BucketConfig struct {
+	Burst         int `json:"burst"`
+	WindowSeconds int `json:"window_seconds"`
+}
+
+// RateLimitConfig holds the limits for a channel, "*" is used for channels without their own entry
+type RateLimitConfig struct {
+	Channel      string        `json:"channel"`
+	ChannelLimit *BucketConfig `json:"channel_limit"` // Messages for the whole channel
+	UserLimit    *BucketConfig `json:"user_limit"`    // Messages for each chatter, needs the user query parameter
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	config  BucketConfig
+}
+
+func setupRateLimits() {
+	rateLimits = nil
+	globalRateLimit = nil
+	limits := getSetting("RATE_LIMITS")
+	if limits != "" {
+		err := json.Unmarshal([]byte(limits), &rateLimits)
+		if err != nil {
+			logger("Error unmarshalling rate limits: "+err.Error(), logError, "Universal")
+		}
+		for i := range rateLimits {
+			rateLimits[i].Channel = strings.ToLower(rateLimits[i].Channel)
+		}
+	}
+
+	global := getSetting("RATE_LIMIT_GLOBAL")
+	if global != "" {
+		var config BucketConfig
+		err := json.Unmarshal([]byte(global), &config)
+		if err != nil {
+			logger("Error unmarshalling global rate limit: "+err.Error(), logError, "Universal")
+			return
+		}
+		globalRateLimit = &config
+	}
+}
+
+func (config *BucketConfig) valid() bool {
+	return config != nil && config.Burst > 0 && config.WindowSeconds > 0
+}
+
+// getRateLimit returns the limits for a channel, falling back to the "*" entry
+func getRateLimit(channel string) RateLimitConfig {
+	var fallback RateLimitConfig
+	for _, config := range readConfig(&rateLimits) {
+		if config.Channel == channel {
+			return config
+		}
+		if config.Channel == "*" {
+			fallback = config
+		}
+	}
+	return fallback
+}
+
+// refill tops the bucket up for the time passed and returns how long until a token is available
+func (bucket *tokenBucket) refill(now time.Time) time.Duration {
+	rate := float64(bucket.config.Burst) / float64(bucket.config.WindowSeconds)
+	bucket.tokens = math.Min(float64(bucket.config.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+func getBucket(key string, config BucketConfig, now time.Time) *tokenBucket {
+	bucket, exists := rateBuckets[key]
+	if !exists || bucket.config != config {
+		bucket = &tokenBucket{tokens: float64(config.Burst), updated: now, config: config}
+		rateBuckets[key] = bucket
+	}
+	return bucket
+}
+
+// checkRateLimit takes a token from the global, channel and user buckets
+// If any of them is empty nothing is taken and the time until the request would be allowed is returned
+func checkRateLimit(channel string, user string) (time.Duration, bool) {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+
+	now := time.Now()
+	config := getRateLimit(channel)
+	var buckets []*tokenBucket
+	if global := readConfig(&globalRateLimit); global.valid() {
+		buckets = append(buckets, getBucket("global", *global, now))
+	}
+	if config.ChannelLimit.valid() {
+		buckets = append(buckets, getBucket("channel:"+channel, *config.ChannelLimit, now))
+	}
+	if config.UserLimit.valid() && user != "" {
+		buckets = append(buckets, getBucket("user:"+channel+":"+strings.ToLower(user), *config.UserLimit, now))
+	}
+
+	var wait time.Duration
+	for _, bucket := range buckets {
+		if bucketWait := bucket.refill(now); bucketWait > wait {
+			wait = bucketWait
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+
+	// Forget buckets that have been full for a while so chatters don't pile up
+	if len(rateBuckets) > 1000 {
+		for key, bucket := range rateBuckets {
+			if now.Sub(bucket.updated) > time.Duration(bucket.config.WindowSeconds)*time.Second {
+				delete(rateBuckets, key)
+			}
+		}
+	}
+	return 0, true
+}
+
+// requireRateLimit writes a 429 with Retry-After if the request is over any limit
+func requireRateLimit(w http.ResponseWriter, channel string, user string) bool {
+	wait, ok := checkRateLimit(channel, user)
+	if ok {
+		return true
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	logger("Rate limited request from "+user+", retry in "+strconv.Itoa(retryAfter)+"s", logInfo, channel)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Too many requests, try again in "+strconv.Itoa(retryAfter)+" seconds", http.StatusTooManyRequests)
+	return false
+}
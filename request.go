@@ -1,11 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"net/http"
 
@@ -26,6 +27,10 @@ type URLParams struct {
 	Stability       float64
 	SimilarityBoost float64
 	Style           float64
+	NoCache         bool
+	Stitch          bool
+	User            string // Chatter who triggered the message, passed along by chat bots
+	Hold            bool   // Wait for moderator approval before queueing
 }
 
 // Index: Index of the request, Type: Type of the request, Time: Time of the request, Params: URL parameters, Voice: TTS settings, Text: Text to be converted to speech
@@ -38,6 +43,10 @@ type Request struct {
 	Voice   TTSSettings
 	Text    string
 	Effect  string
+	NoCache bool   // Skip reading the audio cache
+	Model   string // ElevenLabs model ID to use instead of the voice's own, e.g. when a budget downgrades it
+	// Modifiers applied to the generated audio, together with the voice's own modifiers
+	Modifiers []AudioModifier
 }
 
 type Part struct {
@@ -78,9 +87,6 @@ func getURLParams(r *http.Request) *URLParams {
 	logger("Getting URL parameters", logDebug, channel)
 
 	authKey := r.URL.Query().Get("key")
-	if authKey == "" {
-		return nil
-	}
 
 	text := r.URL.Query().Get("text")
 	if text == "" {
@@ -89,9 +95,12 @@ func getURLParams(r *http.Request) *URLParams {
 
 	fallbackVoice := strings.ToLower(r.URL.Query().Get("voice"))
 
+	// Settings left out of the request come from the channel's voice catalog
+	defaultStability, defaultSimilarityBoost, defaultStyle := getVoiceSettings(channel)
+
 	stabilityString := r.URL.Query().Get("stability")
 	if stabilityString == "" {
-		stabilityString = "0.40"
+		stabilityString = strconv.FormatFloat(defaultStability, 'f', -1, 64)
 	}
 	stability, err := strconv.ParseFloat(stabilityString, 64)
 	if err != nil {
@@ -100,7 +109,7 @@ func getURLParams(r *http.Request) *URLParams {
 
 	similarityBoostString := r.URL.Query().Get("similarityBoost")
 	if similarityBoostString == "" {
-		similarityBoostString = "1.00"
+		similarityBoostString = strconv.FormatFloat(defaultSimilarityBoost, 'f', -1, 64)
 	}
 	similarityBoost, err := strconv.ParseFloat(similarityBoostString, 64)
 	if err != nil {
@@ -109,13 +118,23 @@ func getURLParams(r *http.Request) *URLParams {
 
 	styleString := r.URL.Query().Get("style")
 	if styleString == "" {
-		styleString = "0.00"
+		styleString = strconv.FormatFloat(defaultStyle, 'f', -1, 64)
 	}
 	style, err := strconv.ParseFloat(styleString, 64)
 	if err != nil {
 		return nil
 	}
 
+	noCache := strings.ToLower(r.URL.Query().Get("nocache")) == "true"
+
+	stitch := readConfig(&stitchEnabled)
+	if stitchString := strings.ToLower(r.URL.Query().Get("stitch")); stitchString != "" {
+		stitch = stitchString == "true"
+	}
+
+	user := strings.TrimSpace(r.URL.Query().Get("user"))
+	hold := strings.ToLower(r.URL.Query().Get("hold")) == "true"
+
 	params := &URLParams{
 		Channel:         channel,
 		AuthKey:         authKey,
@@ -124,6 +143,10 @@ func getURLParams(r *http.Request) *URLParams {
 		Stability:       stability,
 		SimilarityBoost: similarityBoost,
 		Style:           style,
+		NoCache:         noCache,
+		Stitch:          stitch,
+		User:            user,
+		Hold:            hold,
 	}
 
 	return params
@@ -131,6 +154,10 @@ func getURLParams(r *http.Request) *URLParams {
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	params := getURLParams(r)
+	if params == nil {
+		http.Error(w, "Missing or invalid parameters", http.StatusBadRequest)
+		return
+	}
 
 	defer func(channel string) {
 		if r := recover(); r != nil {
@@ -141,37 +168,24 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	logger("Received Audio request", logInfo, params.Channel)
 
-	// Check if there's already a request being processed for this channel
-	var checkRequest []Request
-	for _, request := range requests {
-		if request.Channel == params.Channel {
-			checkRequest = append(checkRequest, request)
-		}
+	if !requireChannelAuth(w, r, params.Channel, params.AuthKey) {
+		return
 	}
 
-	if len(checkRequest) > 0 {
-		logger("Last audio is still playing", logInfo, checkRequest[0].Channel)
-		http.Error(w, "Wait for the last audio to finish playing", http.StatusTooManyRequests)
+	if budgetRejects(params.Channel) {
+		logger("Character budget exhausted, rejecting request", logInfo, params.Channel)
+		http.Error(w, "Character budget exhausted", http.StatusPaymentRequired)
 		return
 	}
 
-	if len(clients) == 0 {
+	if !hasClients() {
 		logger("No connected clients", logInfo, params.Channel)
 		http.Error(w, "No connected clients", http.StatusNotFound)
 		return
 	}
 
 	// Check if there is a connected client for the channel
-	found := false
-	for client, clientChannel := range clients {
-		clientName := getClientName(fmt.Sprintf("%p", client))
-		if clientChannel == params.Channel {
-			logger("Found client "+clientName, logDebug, params.Channel)
-			found = true
-			break
-		}
-	}
-	if !found {
+	if !channelHasClient(params.Channel) {
 		logger("No connected client", logInfo, params.Channel)
 		http.Error(w, "No connected client for channel", http.StatusNotFound)
 		return
@@ -186,33 +200,83 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		SimilarityBoost: params.SimilarityBoost,
 		Style:           params.Style,
 		PlayAlert:       false,
+		NoCache:         params.NoCache,
+		Stitch:          params.Stitch,
+		User:            params.User,
+	}
+
+	moderation := moderateMessage(msg.Channel, msg.Text, sourceAPI)
+	if moderation.Rejected {
+		http.Error(w, "Message rejected by moderation", http.StatusUnprocessableEntity)
+		return
 	}
+	msg.Text = moderation.Text
 
-	err := ProcessAndPlay(msg)
+	// Parse up front so invalid messages are rejected before they are queued
+	segments, err := ParseMessage(msg)
 	if err != nil {
 		logger("Error processing request: "+err.Error(), logError, params.Channel)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if _, err := applyMessageLimits(msg.Channel, segments, false); err != nil {
+		logger("Request over the message limits, rejecting", logInfo, params.Channel)
+		http.Error(w, "Message is too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Rate limit last so requests turned away above don't use up tokens
+	if !requireRateLimit(w, params.Channel, params.User) {
+		return
+	}
+
+	if shouldHold(msg.Channel, sourceAPI, msg.User, 0, params.Hold) {
+		pending, err := holdMessage(msg, sourceAPI, msg.User, 0)
+		if errors.Is(err, errPendingFull) {
+			logger("Too many messages waiting for approval, rejecting", logInfo, params.Channel)
+			http.Error(w, "Too many messages waiting for approval, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(PendingResponse{
+			ID:     pending.ID,
+			Status: "pending",
+		})
+		return
+	}
+
+	job, position, err := enqueueMessage(msg)
+	if err != nil {
+		logger("Error queueing request: "+err.Error(), logInfo, params.Channel)
+		http.Error(w, "Queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(QueueResponse{
+		JobID:    job.ID,
+		Position: position,
+	})
 }
 
 func sendAudio(request Request, audioData []byte) {
-	sendTextMessage(request.Channel, "start "+request.Time)
-	time.Sleep(50 * time.Millisecond)
 	requestName := getAudioDataName(request.Time)
-	for client, clientChannel := range clients {
-		if clientChannel == request.Channel {
-			clientName := getClientName(fmt.Sprintf("%p", client))
-			err := client.WriteMessage(websocket.BinaryMessage, audioData)
-			if err != nil {
-				logger("Error sending audio data to "+requestName+": "+err.Error(), logError, request.Channel)
-				client.Close()
-				delete(clients, client)
-				if len(requests) > 0 {
-					clearChannelRequests(request.Channel)
-				}
+	for _, client := range channelClients(request.Channel, true) {
+		clientName := getClientName(fmt.Sprintf("%p", client))
+		err := writeToClient(client, websocket.BinaryMessage, audioData)
+		if err != nil {
+			logger("Error sending audio data to "+requestName+": "+err.Error(), logError, request.Channel)
+			removeClient(client)
+			if len(requests) > 0 {
+				clearChannelRequests(request.Channel)
 			}
-			logger("Audio data "+requestName+" sent to "+clientName, logInfo, request.Channel)
 		}
+		logger("Audio data "+requestName+" sent to "+clientName, logInfo, request.Channel)
 	}
 }
\ No newline at end of file
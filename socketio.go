@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Socket.IO v2 packets as they appear on an Engine.IO v3 websocket
+const (
+	socketIOOpen    = "0"
+	socketIOPing    = "2"
+	socketIOPong    = "3"
+	socketIOConnect = "40"
+	socketIOClose   = "41"
+	socketIOEvent   = "42"
+)
+
+var errSocketIOStop = errors.New("socket.io connection refused, not reconnecting")
+
+// socketIOConn is a Socket.IO connection, writes are locked because pings come from their own goroutine
+type socketIOConn struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+}
+
+// socketIOHandler reacts to a Socket.IO connection, returning errSocketIOStop stops it from reconnecting
+type socketIOHandler struct {
+	OnConnect func(conn *socketIOConn) error
+	OnEvent   func(event string, data json.RawMessage) error
+}
+
+func (socket *socketIOConn) write(packet string) error {
+	socket.writeMutex.Lock()
+	defer socket.writeMutex.Unlock()
+	return socket.conn.WriteMessage(websocket.TextMessage, []byte(packet))
+}
+
+// emit sends an event with one argument
+func (socket *socketIOConn) emit(event string, data any) error {
+	payload, err := json.Marshal([]any{event, data})
+	if err != nil {
+		return err
+	}
+	return socket.write(socketIOEvent + string(payload))
+}
+
+// connectToSocketIO keeps a Socket.IO connection open, reconnecting like the Pally connection does
+func connectToSocketIO(name string, channel string, url string, handler socketIOHandler) {
+	logger("Connecting to "+name, logInfo, channel)
+	for {
+		if err := attemptConnectToSocketIO(name, channel, url, handler); err != nil {
+			if errors.Is(err, errSocketIOStop) {
+				return
+			}
+			// Don't hammer the server if it keeps refusing the connection
+			time.Sleep(5 * time.Second)
+			continue
+		} else {
+			logger(name+" connection closed normally.", logInfo, channel)
+			return
+		}
+	}
+}
+
+func attemptConnectToSocketIO(name string, channel string, url string, handler socketIOHandler) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		logger("Error connecting to "+name+": "+err.Error(), logError, channel)
+		return err
+	}
+	defer conn.Close()
+	socket := &socketIOConn{conn: conn}
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseAbnormalClosure) || websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				logger(name+" connection closed, reconnecting", logInfo, channel)
+			} else {
+				logger("Error reading message from "+name+": "+err.Error(), logError, channel)
+			}
+			return err
+		}
+		packet := string(data)
+
+		switch {
+		case strings.HasPrefix(packet, socketIOEvent):
+			var args []json.RawMessage
+			if err := json.Unmarshal([]byte(packet[len(socketIOEvent):]), &args); err != nil || len(args) == 0 {
+				logger("Invalid event from "+name, logDebug, channel)
+				continue
+			}
+			var event string
+			if err := json.Unmarshal(args[0], &event); err != nil {
+				continue
+			}
+			var payload json.RawMessage
+			if len(args) > 1 {
+				payload = args[1]
+			}
+			if err := handler.OnEvent(event, payload); err != nil {
+				return err
+			}
+		case packet == socketIOConnect:
+			if handler.OnConnect != nil {
+				if err := handler.OnConnect(socket); err != nil {
+					logger("Error setting up "+name+": "+err.Error(), logError, channel)
+					return err
+				}
+			}
+		case packet == socketIOClose:
+			logger(name+" disconnected, reconnecting", logInfo, channel)
+			return errors.New("disconnected by server")
+		case packet == socketIOPong:
+			logger("Received pong message from "+name, logFountain, channel)
+		case strings.HasPrefix(packet, socketIOOpen):
+			var open struct {
+				PingInterval int `json:"pingInterval"`
+			}
+			json.Unmarshal([]byte(packet[len(socketIOOpen):]), &open)
+			interval := time.Duration(open.PingInterval) * time.Millisecond
+			if interval <= 0 {
+				interval = 25 * time.Second
+			}
+			go pingSocketIO(name, channel, socket, interval, stopPing)
+		}
+	}
+}
+
+// pingSocketIO keeps the connection alive, Engine.IO v3 expects the client to ping
+func pingSocketIO(name string, channel string, socket *socketIOConn, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			logger("Sending ping message to "+name, logFountain, channel)
+			if err := socket.write(socketIOPing); err != nil {
+				return
+			}
+		}
+	}
+}
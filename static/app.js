@@ -12,10 +12,13 @@ const AppState = {
     data: {
         voices: [],
         effects: [],
-        modifiers: ['reverb'],
+        effectInfo: [],
+        managedEffects: [],
+        modifiers: [],
         tags: ['laughter', 'laughs', 'sad', 'sigh', 'cries', 'screams', 'gasps', 'groans', 'sniffs']
     },
     dataLoaded: false,
+    managingEffects: false,
     chart: null,
     currentAudio: null,
     currentButton: null,
@@ -36,6 +39,8 @@ document.addEventListener('DOMContentLoaded', async () => {
     // Initialize page-specific functionality
     initCreatePage();
     initChartPage();
+    initModeratePage();
+    initEffectsPage();
 
     // Navigate to initial page based on URL
     const path = window.location.pathname;
@@ -55,9 +60,12 @@ async function loadAppData() {
         }
 
         // Load effects
-        const effectsRes = await fetch('/api/effects');
-        if (effectsRes.ok) {
-            AppState.data.effects = await effectsRes.json();
+        await loadEffectData();
+
+        // Load modifiers
+        const modifiersRes = await fetch('/api/modifiers');
+        if (modifiersRes.ok) {
+            AppState.data.modifiers = await modifiersRes.json();
         }
 
         AppState.dataLoaded = true;
@@ -70,6 +78,19 @@ async function loadAppData() {
     }
 }
 
+async function loadEffectData() {
+    const effectsRes = await fetch('/api/effects');
+    if (effectsRes.ok) {
+        AppState.data.effects = await effectsRes.json();
+    }
+
+    // Load effect metadata for aliases and categories
+    const effectInfoRes = await fetch('/api/effects/info');
+    if (effectInfoRes.ok) {
+        AppState.data.effectInfo = await effectInfoRes.json();
+    }
+}
+
 function populateChips() {
     const voicesGrid = document.getElementById('voices-chips');
     const effectsGrid = document.getElementById('effects-chips');
@@ -108,8 +129,8 @@ function populateChips() {
 
     // Modifiers
     modifiersGrid.innerHTML = AppState.data.modifiers.map(m => `
-        <div class="chip chip-modifier" draggable="true" data-value="(${m})" data-type="modifier">
-            <span class="chip-name">${m}</span>
+        <div class="chip chip-modifier" draggable="true" data-value="(${m.name})" data-type="modifier" title="${modifierHelp(m)}">
+            <span class="chip-name">${m.name}</span>
         </div>
     `).join('') || '<p class="chip-empty">No modifiers available</p>';
 
@@ -125,6 +146,12 @@ function populateChips() {
     initPreviewButtons();
 }
 
+function modifierHelp(modifier) {
+    const params = modifier.params.map(p => `${p.name} ${p.min} to ${p.max} (default ${p.default})`);
+    if (params.length === 0) return modifier.description;
+    return `${modifier.description} - (${modifier.name}:${modifier.params.map(p => p.name).join(',')}) ${params.join(', ')}`;
+}
+
 function populateAudioLists() {
     const voicesList = document.getElementById('voices-list');
     const effectsList = document.getElementById('effects-list');
@@ -140,9 +167,15 @@ function populateAudioLists() {
     `).join('') || '<p class="chip-empty">No voices available</p>';
 
     // Effects list
+    if (AppState.managingEffects) {
+        renderManagedEffects();
+        return;
+    }
+    const effectInfo = Object.fromEntries(AppState.data.effectInfo.map(e => [e.name, e]));
     effectsList.innerHTML = AppState.data.effects.map(e => `
         <li class="audio-item">
             <div class="audio-item-name pink">${e}</div>
+            ${effectDetails(effectInfo[e])}
             <audio controls>
                 <source src="/effects/${e}.mp3" type="audio/mpeg">
             </audio>
@@ -150,6 +183,14 @@ function populateAudioLists() {
     `).join('') || '<p class="chip-empty">No effects available</p>';
 }
 
+function effectDetails(info) {
+    if (!info) return '';
+    const details = [];
+    if (info.category) details.push(escapeHTML(info.category));
+    if (info.aliases && info.aliases.length) details.push('also ' + info.aliases.map(escapeHTML).join(', '));
+    return details.length ? `<div class="audio-item-details">${details.join(' · ')}</div>` : '';
+}
+
 // =============================================
 // SPA Router
 // =============================================
@@ -178,7 +219,8 @@ function navigateTo(path, pushState = true) {
         '/voices': 'voices',
         '/effects': 'effects',
         '/chart': 'chart',
-        '/usage': 'chart'
+        '/usage': 'chart',
+        '/moderate': 'moderate'
     };
 
     const pageName = pageMap[path] || 'create';
@@ -206,7 +248,8 @@ function navigateTo(path, pushState = true) {
         create: 'TTS Message Creator - Cyan TTS',
         voices: 'Voices - Cyan TTS',
         effects: 'Effects - Cyan TTS',
-        chart: 'Usage - Cyan TTS'
+        chart: 'Usage - Cyan TTS',
+        moderate: 'Moderate - Cyan TTS'
     };
     document.title = titles[pageName] || 'Cyan TTS';
 
@@ -481,7 +524,8 @@ function validateMessage() {
 
     const voices = new Set(AppState.data.voices.map(v => v.name.toLowerCase()));
     const effects = new Set(AppState.data.effects.map(e => e.toLowerCase()));
-    const modifiers = new Set(AppState.data.modifiers.map(m => m.toLowerCase()));
+    AppState.data.effectInfo.forEach(e => (e.aliases || []).forEach(a => effects.add(a.toLowerCase())));
+    const modifiers = new Set(AppState.data.modifiers.map(m => m.name.toLowerCase()));
 
     let lastTagEnd = 0;
     let pendingVoice = null;
@@ -504,7 +548,7 @@ function validateMessage() {
             }
             pendingVoice = tagContent;
             voiceHasText = false;
-        } else if (!effects.has(tagContent) && !modifiers.has(tagContent)) {
+        } else if (!effects.has(tagContent) && !modifiers.has(modifierTagName(tagContent))) {
             showValidation({ valid: false, error: `Unknown tag: "${tagContent}"` });
             return { valid: false, error: `Unknown tag: "${tagContent}"` };
         }
@@ -524,6 +568,11 @@ function validateMessage() {
     return { valid: true, error: null };
 }
 
+// modifierTagName strips arguments and end markers, e.g. "pitch:+4" and "pitch-end" become "pitch"
+function modifierTagName(tagContent) {
+    return tagContent.split(':')[0].trim().replace(/-end$/, '');
+}
+
 function showValidation(result) {
     const validation = document.getElementById('validation');
     const copyBtn = document.getElementById('copyBtn');
@@ -658,6 +707,27 @@ async function fetchElevenData() {
     }
 }
 
+async function fetchBudget(channel) {
+    try {
+        const response = await fetch(`/api/budget/${encodeURIComponent(channel)}`);
+        if (!response.ok) return;
+
+        const data = await response.json();
+        const format = (used, limit) => limit > 0
+            ? `${used.toLocaleString()} / ${limit.toLocaleString()}`
+            : `${used.toLocaleString()} (no cap)`;
+
+        const daily = document.getElementById('budget-daily');
+        const monthly = document.getElementById('budget-monthly');
+        daily.textContent = format(data.daily_used, data.daily_limit);
+        monthly.textContent = format(data.monthly_used, data.monthly_limit);
+        daily.classList.toggle('exhausted', data.exhausted);
+        monthly.classList.toggle('exhausted', data.exhausted);
+    } catch (err) {
+        console.error('Error fetching budget:', err);
+    }
+}
+
 async function fetchChartData() {
     const channel = document.getElementById('channel-input').value.toLowerCase();
     if (!channel) {
@@ -690,11 +760,13 @@ async function fetchChartData() {
         // Group by date
         const grouped = data.reduce((acc, curr) => {
             const date = curr.date.split('T')[0];
+            const cached = curr.cached_characters || 0;
             if (acc[date]) {
                 acc[date].chars += curr.num_characters;
                 acc[date].cost += curr.estimated_cost;
+                acc[date].cached += cached;
             } else {
-                acc[date] = { chars: curr.num_characters, cost: curr.estimated_cost };
+                acc[date] = { chars: curr.num_characters, cost: curr.estimated_cost, cached: cached };
             }
             return acc;
         }, {});
@@ -705,11 +777,14 @@ async function fetchChartData() {
 
         const totalChars = sorted.reduce((s, d) => s + d.chars, 0);
         const totalCost = sorted.reduce((s, d) => s + d.cost, 0);
+        const totalCached = sorted.reduce((s, d) => s + d.cached, 0);
 
         await fetchElevenData();
+        await fetchBudget(channel);
 
         document.getElementById('total-characters').textContent = totalChars.toLocaleString();
         document.getElementById('total-cost').textContent = '$' + totalCost.toFixed(2);
+        document.getElementById('cached-characters').textContent = totalCached.toLocaleString();
 
         document.getElementById('chart-container').style.display = 'block';
 
@@ -737,7 +812,7 @@ async function fetchChartData() {
                         callbacks: {
                             label: (ctx) => {
                                 const d = sorted[ctx.dataIndex];
-                                return `Characters: ${d.chars.toLocaleString()} | Cost: $${d.cost.toFixed(2)}`;
+                                return `Characters: ${d.chars.toLocaleString()} | Cost: $${d.cost.toFixed(2)} | Cached: ${d.cached.toLocaleString()}`;
                             }
                         }
                     }
@@ -753,3 +828,278 @@ async function fetchChartData() {
         showToast('Failed to load data');
     }
 }
+
+// =============================================
+// Moderation Page Functionality
+// =============================================
+
+let pendingRefreshTimer = null;
+
+function initModeratePage() {
+    const channelInput = document.getElementById('moderate-channel');
+    const keyInput = document.getElementById('moderate-key');
+    const loadBtn = document.getElementById('loadPendingBtn');
+
+    channelInput.value = localStorage.getItem('moderateChannel') || '';
+    keyInput.value = localStorage.getItem('moderateKey') || '';
+
+    const load = () => {
+        localStorage.setItem('moderateChannel', channelInput.value.toLowerCase());
+        localStorage.setItem('moderateKey', keyInput.value);
+        fetchPending();
+        clearInterval(pendingRefreshTimer);
+        pendingRefreshTimer = setInterval(() => {
+            if (AppState.currentPage === 'moderate') fetchPending();
+        }, 5000);
+    };
+
+    keyInput.addEventListener('keydown', (e) => {
+        if (e.key === 'Enter') load();
+    });
+    loadBtn.addEventListener('click', load);
+}
+
+function moderateCredentials() {
+    return new URLSearchParams({
+        channel: localStorage.getItem('moderateChannel') || '',
+        key: localStorage.getItem('moderateKey') || ''
+    });
+}
+
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+function renderPendingSegment(segment) {
+    if (segment.effect) {
+        return `<span class="pending-segment"><span class="effect">🔊 ${escapeHTML(segment.effect)}</span></span>`;
+    }
+    const modifiers = (segment.modifiers || [])
+        .map(m => `<span class="modifier">${escapeHTML(m)}</span>`).join('');
+    return `<span class="pending-segment"><span class="voice">${escapeHTML(segment.voice || '')}</span>${modifiers}${escapeHTML(segment.text || '')}</span>`;
+}
+
+async function fetchPending() {
+    const list = document.getElementById('pending-list');
+    try {
+        const response = await fetch(`/api/pending?${moderateCredentials()}`);
+        if (!response.ok) throw new Error(await response.text());
+        const pending = await response.json();
+
+        // Don't wipe out an edit in progress
+        if (list.contains(document.activeElement) && document.activeElement.tagName === 'TEXTAREA') return;
+
+        list.innerHTML = pending.map(p => `
+            <div class="pending-card" data-id="${escapeHTML(p.id)}">
+                <div class="pending-meta">
+                    <span>${escapeHTML(p.user || 'Unknown')} via ${escapeHTML(p.source)}
+                        ${p.amount_cents ? `<span class="pending-amount">$${(p.amount_cents / 100).toFixed(2)}</span>` : ''}</span>
+                    <span>${new Date(p.received).toLocaleTimeString()}${p.expires ? ` · auto-approves ${new Date(p.expires).toLocaleTimeString()}` : ''}</span>
+                </div>
+                <div class="pending-segments">${p.segments.map(renderPendingSegment).join('')}</div>
+                <textarea class="custom-input pending-text">${escapeHTML(p.text)}</textarea>
+                <div class="pending-actions">
+                    <button class="btn btn-approve" data-action="approve">Approve</button>
+                    <button class="btn btn-reject" data-action="reject">Reject</button>
+                </div>
+            </div>
+        `).join('') || '<p class="chip-empty">No messages waiting for approval</p>';
+
+        list.querySelectorAll('.pending-actions button').forEach(button => {
+            button.addEventListener('click', () => {
+                const card = button.closest('.pending-card');
+                moderatePending(card.dataset.id, button.dataset.action, card.querySelector('textarea').value);
+            });
+        });
+    } catch (err) {
+        console.error('Error loading pending messages:', err);
+        showToast('Failed to load pending messages');
+    }
+}
+
+async function moderatePending(id, action, text) {
+    const body = moderateCredentials();
+    if (action === 'approve') body.set('text', text);
+    try {
+        const response = await fetch(`/api/pending/${encodeURIComponent(id)}/${action}`, {
+            method: 'POST',
+            body: body
+        });
+        if (!response.ok) throw new Error(await response.text());
+        showToast(action === 'approve' ? 'Message approved' : 'Message rejected');
+    } catch (err) {
+        console.error('Error moderating message:', err);
+        showToast(`Failed: ${err.message}`);
+    }
+    document.activeElement.blur();
+    fetchPending();
+}
+
+// =============================================
+// Effect Management
+// =============================================
+
+function initEffectsPage() {
+    const keyInput = document.getElementById('effects-key');
+    const manageBtn = document.getElementById('manageEffectsBtn');
+    const uploadForm = document.getElementById('effect-upload');
+
+    keyInput.value = localStorage.getItem('effectsKey') || '';
+
+    const manage = () => {
+        localStorage.setItem('effectsKey', keyInput.value);
+        fetchManagedEffects();
+    };
+
+    keyInput.addEventListener('keydown', (e) => {
+        if (e.key === 'Enter') manage();
+    });
+    manageBtn.addEventListener('click', manage);
+    uploadForm.addEventListener('submit', (e) => {
+        e.preventDefault();
+        uploadEffect();
+    });
+}
+
+function effectsKey() {
+    return localStorage.getItem('effectsKey') || '';
+}
+
+async function fetchManagedEffects() {
+    try {
+        const params = new URLSearchParams({ all: 'true', key: effectsKey() });
+        const response = await fetch(`/api/effects/info?${params}`);
+        if (!response.ok) throw new Error(await response.text());
+        AppState.data.managedEffects = await response.json();
+        AppState.managingEffects = true;
+        document.getElementById('effect-upload').classList.add('active');
+        populateAudioLists();
+    } catch (err) {
+        console.error('Error loading effects:', err);
+        showToast(`Failed: ${err.message}`);
+    }
+}
+
+function renderManagedEffects() {
+    const effectsList = document.getElementById('effects-list');
+
+    effectsList.innerHTML = AppState.data.managedEffects.map(e => `
+        <li class="audio-item${e.disabled ? ' disabled' : ''}" data-name="${escapeHTML(e.name)}">
+            <div class="audio-item-name pink">${escapeHTML(e.name)}</div>
+            ${effectDetails(e)}
+            <audio controls preload="none">
+                <source src="/effects/${encodeURIComponent(e.file)}?key=${encodeURIComponent(effectsKey())}" type="audio/mpeg">
+            </audio>
+            <div class="effect-fields">
+                <input type="text" class="custom-input" data-field="name" value="${escapeHTML(e.name)}" placeholder="Name">
+                <input type="text" class="custom-input" data-field="category" value="${escapeHTML(e.category || '')}" placeholder="Category">
+                <input type="text" class="custom-input" data-field="aliases" value="${escapeHTML((e.aliases || []).join(', '))}" placeholder="Aliases">
+                <input type="text" class="custom-input" data-field="channels" value="${escapeHTML((e.channels || []).join(', '))}" placeholder="Channels (empty for all)">
+                <input type="number" class="custom-input" data-field="gain_db" value="${e.gain_db}" step="0.5" placeholder="Gain (dB)">
+                <input type="number" class="custom-input" data-field="max_duration" value="${e.max_duration}" min="0" step="0.5" placeholder="Max length (seconds)">
+                <label class="effect-check"><input type="checkbox" data-field="disabled"${e.disabled ? ' checked' : ''}> Disabled</label>
+            </div>
+            <div class="pending-actions mt-3">
+                <button class="btn btn-approve" data-action="save">Save</button>
+                <button class="btn btn-reject" data-action="delete">Delete</button>
+            </div>
+        </li>
+    `).join('') || '<p class="chip-empty">No effects uploaded yet</p>';
+
+    effectsList.querySelectorAll('.pending-actions button').forEach(button => {
+        button.addEventListener('click', () => {
+            const item = button.closest('.audio-item');
+            if (button.dataset.action === 'delete') {
+                deleteEffect(item.dataset.name);
+            } else {
+                saveEffect(item);
+            }
+        });
+    });
+}
+
+async function effectAction(name, action, fields) {
+    const body = new URLSearchParams({ key: effectsKey(), ...fields });
+    const response = await fetch(`/api/effects/${encodeURIComponent(name)}/${action}`, {
+        method: 'POST',
+        body: body
+    });
+    if (!response.ok) throw new Error(await response.text());
+}
+
+async function saveEffect(item) {
+    const field = (name) => item.querySelector(`[data-field="${name}"]`);
+    const name = item.dataset.name;
+    const newName = field('name').value.trim();
+    try {
+        await effectAction(name, 'tag', {
+            category: field('category').value,
+            aliases: field('aliases').value,
+            channels: field('channels').value,
+            gain_db: field('gain_db').value || '0',
+            max_duration: field('max_duration').value || '0',
+            disabled: field('disabled').checked ? 'true' : 'false'
+        });
+        if (newName !== name) {
+            await effectAction(name, 'rename', { name: newName });
+        }
+        showToast('Effect saved');
+    } catch (err) {
+        console.error('Error saving effect:', err);
+        showToast(`Failed: ${err.message}`);
+    }
+    refreshEffects();
+}
+
+async function deleteEffect(name) {
+    if (!confirm(`Delete the ${name} effect?`)) return;
+    try {
+        await effectAction(name, 'delete', {});
+        showToast('Effect deleted');
+    } catch (err) {
+        console.error('Error deleting effect:', err);
+        showToast(`Failed: ${err.message}`);
+    }
+    refreshEffects();
+}
+
+async function uploadEffect() {
+    const file = document.getElementById('effect-file');
+    const uploadBtn = document.getElementById('uploadEffectBtn');
+    const body = new FormData();
+    body.set('key', effectsKey());
+    body.set('file', file.files[0]);
+    body.set('name', document.getElementById('effect-name').value.trim());
+    body.set('category', document.getElementById('effect-category').value);
+    body.set('aliases', document.getElementById('effect-aliases').value);
+    body.set('replace', document.getElementById('effect-replace').checked ? 'true' : 'false');
+
+    uploadBtn.disabled = true;
+    try {
+        const response = await fetch('/api/effects/upload', {
+            method: 'POST',
+            body: body
+        });
+        if (!response.ok) throw new Error(await response.text());
+        document.getElementById('effect-upload').reset();
+        showToast('Effect uploaded');
+    } catch (err) {
+        console.error('Error uploading effect:', err);
+        showToast(`Failed: ${err.message}`);
+    }
+    uploadBtn.disabled = false;
+    refreshEffects();
+}
+
+// refreshEffects reloads the library everywhere it's shown so changes appear without a page reload
+async function refreshEffects() {
+    await loadEffectData();
+    populateChips();
+    if (AppState.managingEffects) {
+        await fetchManagedEffects();
+    } else {
+        populateAudioLists();
+    }
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	stitchEnabled    bool
+	stitchGap        = 150 * time.Millisecond
+	stitchCrossfade  time.Duration
+	stitchLoudnorm   bool
+	stitchTimeout    = 60 * time.Second
+	recentMixes      = make(map[string]*StoredMix)
+	recentMixesMutex = sync.Mutex{}
+	maxRecentMixes   = 20
+)
+
+// StoredMix is a finished stitched message kept around for download and replay
+type StoredMix struct {
+	ID      string
+	Channel string
+	Audio   []byte
+	Created time.Time
+}
+
+func setupStitching() {
+	setupStitchAudio()
+	stitchLoudnorm = strings.ToLower(getSetting("STITCH_LOUDNORM")) == "true"
+	if gap := getSetting("STITCH_GAP_MS"); gap != "" {
+		ms, err := strconv.Atoi(gap)
+		if err != nil || ms < 0 {
+			logger("Invalid STITCH_GAP_MS, using default", logError, "Universal")
+		} else {
+			stitchGap = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if crossfade := getSetting("STITCH_CROSSFADE_MS"); crossfade != "" {
+		ms, err := strconv.Atoi(crossfade)
+		if err != nil || ms < 0 {
+			logger("Invalid STITCH_CROSSFADE_MS, using default", logError, "Universal")
+		} else {
+			stitchCrossfade = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if stitchEnabled {
+		logger("Server-side audio stitching enabled", logInfo, "Universal")
+	}
+}
+
+// setupStitchAudio reads STITCH_AUDIO, which can change when the config file is reloaded
+func setupStitchAudio() {
+	stitchEnabled = strings.ToLower(getSetting("STITCH_AUDIO")) == "true"
+}
+
+// buildStitchGraph builds the ffmpeg filter graph that joins all inputs into one stream
+// Inputs are resampled to a common format first so concat and acrossfade accept them
+func buildStitchGraph(count int) string {
+	var filters []string
+	for i := 0; i < count; i++ {
+		chain := "aresample=44100,aformat=sample_fmts=fltp:channel_layouts=stereo"
+		if stitchLoudnorm {
+			chain += ",loudnorm=I=-16:TP=-1.5:LRA=11,aresample=44100"
+		}
+		if stitchCrossfade == 0 && stitchGap > 0 && i < count-1 {
+			chain += fmt.Sprintf(",apad=pad_dur=%.3f", stitchGap.Seconds())
+		}
+		filters = append(filters, fmt.Sprintf("[%d:a]%s[a%d]", i, chain, i))
+	}
+
+	if count == 1 {
+		filters = append(filters, "[a0]anull[out]")
+		return strings.Join(filters, ";")
+	}
+
+	if stitchCrossfade > 0 {
+		previous := "a0"
+		for i := 1; i < count; i++ {
+			out := fmt.Sprintf("x%d", i)
+			if i == count-1 {
+				out = "out"
+			}
+			filters = append(filters, fmt.Sprintf("[%s][a%d]acrossfade=d=%.3f[%s]", previous, i, stitchCrossfade.Seconds(), out))
+			previous = out
+		}
+		return strings.Join(filters, ";")
+	}
+
+	var inputs string
+	for i := 0; i < count; i++ {
+		inputs += fmt.Sprintf("[a%d]", i)
+	}
+	filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=0:a=1[out]", inputs, count))
+	return strings.Join(filters, ";")
+}
+
+// stitchOffsets returns where each segment starts in the stitched mix, in seconds
+// Gaps push later segments back while crossfades pull them forward
+func stitchOffsets(durations []float64) []float64 {
+	offsets := make([]float64, len(durations))
+	position := 0.0
+	for i, duration := range durations {
+		offsets[i] = position
+		position += duration
+		if stitchCrossfade > 0 {
+			position -= stitchCrossfade.Seconds()
+		} else {
+			position += stitchGap.Seconds()
+		}
+	}
+	return offsets
+}
+
+// stitchAudio joins all segments into a single mp3 and returns it with its length in seconds
+func stitchAudio(segments [][]byte, channel string) ([]byte, float64, error) {
+	if len(segments) == 0 {
+		return nil, 0, fmt.Errorf("no segments to stitch")
+	}
+
+	tempDir, err := os.MkdirTemp("", "tts-stitch-")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	for i, segment := range segments {
+		segmentFile := filepath.Join(tempDir, fmt.Sprintf("segment-%d.mp3", i))
+		if err := os.WriteFile(segmentFile, segment, 0644); err != nil {
+			return nil, 0, err
+		}
+		args = append(args, "-i", segmentFile)
+	}
+
+	outputFile := filepath.Join(tempDir, "mix.mp3")
+	args = append(args, "-filter_complex", buildStitchGraph(len(segments)), "-map", "[out]", "-b:a", "320k", outputFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stitchTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logger("Failed to stitch audio: "+err.Error()+" "+strings.TrimSpace(stderr.String()), logError, channel)
+		return nil, 0, fmt.Errorf("error stitching audio: %w", err)
+	}
+
+	mix, err := os.ReadFile(outputFile)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The exact length is used for caption timings and the playback timeout, so it isn't rounded
+	duration, err := getAudioDuration(mix)
+	if err != nil {
+		duration = 0
+	}
+
+	logger(fmt.Sprintf("Stitched %d segments into %.1f seconds of audio", len(segments), duration), logDebug, channel)
+	return mix, duration, nil
+}
+
+// storeMix keeps a finished mix for download and replay, dropping the oldest when full
+func storeMix(id string, channel string, audio []byte) {
+	recentMixesMutex.Lock()
+	defer recentMixesMutex.Unlock()
+
+	recentMixes[id] = &StoredMix{
+		ID:      id,
+		Channel: channel,
+		Audio:   audio,
+		Created: time.Now(),
+	}
+
+	for len(recentMixes) > maxRecentMixes {
+		var oldest *StoredMix
+		for _, mix := range recentMixes {
+			if oldest == nil || mix.Created.Before(oldest.Created) {
+				oldest = mix
+			}
+		}
+		delete(recentMixes, oldest.ID)
+	}
+}
+
+func getMix(id string) (*StoredMix, bool) {
+	recentMixesMutex.Lock()
+	defer recentMixesMutex.Unlock()
+	mix, ok := recentMixes[id]
+	return mix, ok
+}
+
+// handleMixDownload serves a finished mix as an mp3
+// Job IDs are timestamps and easy to guess, so the mix's channel key is required like for /replay
+func handleMixDownload(w http.ResponseWriter, r *http.Request) {
+	channel := strings.ToLower(r.URL.Query().Get("channel"))
+	if !requireChannelAuth(w, r, channel, r.URL.Query().Get("key")) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	mix, ok := getMix(id)
+	if !ok || mix.Channel != channel {
+		http.Error(w, "Mix not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+mix.Channel+"-"+mix.ID+".mp3\"")
+	w.Write(mix.Audio)
+}
+
+// handleReplay queues a finished mix to be played again on its channel
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	channel := strings.ToLower(r.URL.Query().Get("channel"))
+	if !requireChannelAuth(w, r, channel, r.URL.Query().Get("key")) {
+		return
+	}
+
+	mix, ok := getMix(r.URL.Query().Get("id"))
+	if !ok || mix.Channel != channel {
+		http.Error(w, "Mix not found", http.StatusNotFound)
+		return
+	}
+
+	job, position, err := enqueueMessage(Message{
+		Channel: channel,
+		Text:    "Replay of " + mix.ID,
+		Audio:   mix.Audio,
+	})
+	if err != nil {
+		http.Error(w, "Queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger("Replaying mix "+getAudioDataName(mix.ID), logInfo, channel)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(QueueResponse{
+		JobID:    job.ID,
+		Position: position,
+	})
+}
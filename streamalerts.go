@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+var (
+	streamElementsURL = "wss://realtime.streamelements.com/socket.io/?cid=&transport=websocket&EIO=3"
+	streamlabsURL     = "wss://sockets.streamlabs.com/socket.io/?transport=websocket&EIO=3"
+)
+
+// StreamElementsEvent is an activity from the StreamElements realtime socket
+type StreamElementsEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Username    string          `json:"username"`
+		DisplayName string          `json:"displayName"`
+		Amount      json.RawMessage `json:"amount"`
+		Currency    string          `json:"currency"`
+		Message     string          `json:"message"`
+	} `json:"data"`
+}
+
+// StreamElementsTestEvent is what the "Emulate" buttons on the StreamElements dashboard send
+type StreamElementsTestEvent struct {
+	Listener string `json:"listener"`
+	Event    struct {
+		Name    string          `json:"name"`
+		Amount  json.RawMessage `json:"amount"`
+		Message string          `json:"message"`
+	} `json:"event"`
+}
+
+// StreamlabsEvent is an alert from the Streamlabs socket API
+type StreamlabsEvent struct {
+	Type    string `json:"type"`
+	Message []struct {
+		Name     string          `json:"name"`
+		Amount   json.RawMessage `json:"amount"`
+		Currency string          `json:"currency"`
+		Message  string          `json:"message"`
+	} `json:"message"`
+}
+
+func setupStreamAlerts() {
+	if server := getSetting("STREAMELEMENTS_SERVER"); server != "" {
+		streamElementsURL = server
+	}
+	if server := getSetting("STREAMLABS_SERVER"); server != "" {
+		streamlabsURL = server
+	}
+
+	for _, key := range loadDonationKeys("STREAMELEMENTS_TOKENS") {
+		go connectToSocketIO("StreamElements", key.Channel, streamElementsURL, streamElementsHandler(key))
+	}
+	for _, key := range loadDonationKeys("STREAMLABS_TOKENS") {
+		go connectToSocketIO("Streamlabs", key.Channel, streamlabsURL+"&token="+url.QueryEscape(key.Token), streamlabsHandler(key))
+	}
+}
+
+// streamElementsHandler logs in with the channel's JWT and reads out tips
+func streamElementsHandler(key DonationKey) socketIOHandler {
+	channel := key.Channel
+	return socketIOHandler{
+		OnConnect: func(conn *socketIOConn) error {
+			return conn.emit("authenticate", map[string]string{"method": "jwt", "token": key.Token})
+		},
+		OnEvent: func(event string, data json.RawMessage) error {
+			switch event {
+			case "authenticated":
+				logger("Authenticated with StreamElements", logInfo, channel)
+			case "unauthorized":
+				logger("StreamElements refused the JWT token: "+string(data), logError, channel)
+				return errSocketIOStop
+			case "event":
+				var activity StreamElementsEvent
+				if err := json.Unmarshal(data, &activity); err != nil || activity.Type != "tip" {
+					return nil
+				}
+				amount, ok := parseAmountCents(activity.Data.Amount)
+				if !ok {
+					logger("Invalid StreamElements amount: "+string(activity.Data.Amount), logError, channel)
+					return nil
+				}
+				donor := activity.Data.DisplayName
+				if donor == "" {
+					donor = activity.Data.Username
+				}
+				go handleDonation(Donation{
+					Source:      sourceStreamElements,
+					Channel:     channel,
+					Donor:       donor,
+					AmountCents: amount,
+					Currency:    activity.Data.Currency,
+					Message:     activity.Data.Message,
+				})
+			case "event:test":
+				var test StreamElementsTestEvent
+				if err := json.Unmarshal(data, &test); err != nil || test.Listener != "tip-latest" {
+					return nil
+				}
+				amount, _ := parseAmountCents(test.Event.Amount)
+				go handleDonation(Donation{
+					Source:      sourceStreamElements,
+					Channel:     channel,
+					Donor:       test.Event.Name,
+					AmountCents: amount,
+					Message:     test.Event.Message,
+				})
+			}
+			return nil
+		},
+	}
+}
+
+// streamlabsHandler reads out donations, the token in the URL is the only login Streamlabs needs
+func streamlabsHandler(key DonationKey) socketIOHandler {
+	channel := key.Channel
+	return socketIOHandler{
+		OnEvent: func(event string, data json.RawMessage) error {
+			if event != "event" {
+				return nil
+			}
+			var alert StreamlabsEvent
+			if err := json.Unmarshal(data, &alert); err != nil || alert.Type != "donation" {
+				return nil
+			}
+			for _, donation := range alert.Message {
+				amount, ok := parseAmountCents(donation.Amount)
+				if !ok {
+					logger("Invalid Streamlabs amount: "+string(donation.Amount), logError, channel)
+					continue
+				}
+				go handleDonation(Donation{
+					Source:      sourceStreamlabs,
+					Channel:     channel,
+					Donor:       donation.Name,
+					AmountCents: amount,
+					Currency:    donation.Currency,
+					Message:     donation.Message,
+				})
+			}
+			return nil
+		},
+	}
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Johnnycyan/elevenlabs/client"
 	"github.com/Johnnycyan/elevenlabs/client/types"
@@ -24,11 +26,16 @@ var (
 	elevenKey      string
 	ttsClient      client.Client
 	ttsKey         string
+
+	elevenFormat      string
+	elevenFormatTime  time.Time
+	elevenFormatMutex = sync.Mutex{}
 )
 
 type Voice struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
+	Name     string `json:"name"`
+	ID       string `json:"id"`
+	Provider string `json:"provider"` // "elevenlabs" (default) or "local"
 }
 
 type VoiceModel struct {
@@ -53,7 +60,9 @@ func createClient() {
 }
 
 func setupVoices() {
-	voicesEnv := os.Getenv("VOICES")
+	voices = nil
+	defaultVoice, defaultVoiceID = "", ""
+	voicesEnv := getSetting("VOICES")
 	err := json.Unmarshal([]byte(voicesEnv), &voices)
 	if err != nil {
 		logger("Error unmarshalling voices.json: "+err.Error(), logError, "Universal")
@@ -67,7 +76,8 @@ func setupVoices() {
 }
 
 func setupVoiceModels() {
-	voiceModelsEnv := os.Getenv("VOICE_MODELS")
+	voiceModels = nil
+	voiceModelsEnv := getSetting("VOICE_MODELS")
 	err := json.Unmarshal([]byte(voiceModelsEnv), &voiceModels)
 	if err != nil {
 		logger("Error unmarshalling voice models: "+err.Error(), logError, "Universal")
@@ -76,7 +86,8 @@ func setupVoiceModels() {
 }
 
 func setupVoiceStyles() {
-	voiceStylesEnv := os.Getenv("VOICE_STYLES")
+	voiceStyles = nil
+	voiceStylesEnv := getSetting("VOICE_STYLES")
 	err := json.Unmarshal([]byte(voiceStylesEnv), &voiceStyles)
 	if err != nil {
 		logger("Error unmarshalling voice styles: "+err.Error(), logError, "Universal")
@@ -84,11 +95,12 @@ func setupVoiceStyles() {
 	}
 }
 
-func validVoice(voice string) bool {
+// validVoice checks a voice name against the channel's catalog, an empty channel only checks the global voices
+func validVoice(voice string, channel string) bool {
 	if voice == "" {
 		return false
 	}
-	for _, v := range voices {
+	for _, v := range channelVoices(channel) {
 		if strings.EqualFold(v.Name, voice) {
 			return true
 		}
@@ -96,8 +108,8 @@ func validVoice(voice string) bool {
 	return false
 }
 
-func getVoiceID(voice string) (string, error) {
-	for _, v := range voices {
+func getVoiceID(voice string, channel string) (string, error) {
+	for _, v := range channelVoices(channel) {
 		if strings.EqualFold(v.Name, voice) {
 			return v.ID, nil
 		}
@@ -105,127 +117,278 @@ func getVoiceID(voice string) (string, error) {
 	return "", fmt.Errorf("Voice not found")
 }
 
-func getVoiceName(ID string) (string, error) {
-	for _, v := range voices {
-		if v.ID == ID {
-			return v.Name, nil
-		}
+func getVoiceName(ID string, channel string) (string, error) {
+	if v, found := findVoiceByID(ID, channel); found {
+		return v.Name, nil
 	}
 	return "", fmt.Errorf("Voice not found")
 }
 
-func getVoiceModel(ID string) (string, error) {
-	voice, err := getVoiceName(ID)
+func getVoiceModel(ID string, channel string) (string, error) {
+	voice, err := getVoiceName(ID, channel)
 	if err != nil {
-		logger("Error getting voice name: "+err.Error(), logError, "Universal")
+		logger("Error getting voice name: "+err.Error(), logError, channel)
 		return "", err
 	}
-	logger("Getting voice model for voice: "+voice, logDebug, "Universal")
-	for _, v := range voiceModels {
+	logger("Getting voice model for voice: "+voice, logDebug, channel)
+	// The channel's overrides are checked before the global ones
+	models := readConfig(&voiceModels)
+	if catalog := getVoiceCatalog(channel); catalog != nil {
+		models = append(append([]VoiceModel{}, catalog.Models...), models...)
+	}
+	for _, v := range models {
 		if strings.EqualFold(v.Name, voice) {
 			return v.Model, nil
 		}
 	}
-	logger("Voice model not found", logDebug, "Universal")
+	logger("Voice model not found", logDebug, channel)
 	return "", fmt.Errorf("Voice model not found")
 }
 
-func getVoiceStyle(ID string) (float64, error) {
-	voice, err := getVoiceName(ID)
+func getVoiceStyle(ID string, channel string) (float64, error) {
+	voice, err := getVoiceName(ID, channel)
 	if err != nil {
-		logger("Error getting voice name: "+err.Error(), logError, "Universal")
+		logger("Error getting voice name: "+err.Error(), logError, channel)
 		return 0, err
 	}
-	logger("Getting voice style for voice: "+voice, logDebug, "Universal")
-	for _, v := range voiceStyles {
+	logger("Getting voice style for voice: "+voice, logDebug, channel)
+	styles := readConfig(&voiceStyles)
+	if catalog := getVoiceCatalog(channel); catalog != nil {
+		styles = append(append([]VoiceStyle{}, catalog.Styles...), styles...)
+	}
+	for _, v := range styles {
 		if strings.EqualFold(v.Name, voice) {
 			style, err := strconv.ParseFloat(v.Style, 64)
 			if err != nil {
-				logger("Error parsing voice style: "+err.Error(), logError, "Universal")
+				logger("Error parsing voice style: "+err.Error(), logError, channel)
 				return 0, err
 			}
 			return style, nil
 		}
 	}
-	logger("Voice style not found", logDebug, "Universal")
+	logger("Voice style not found", logDebug, channel)
 	return 0, fmt.Errorf("Voice style not found")
 }
 
-func generateAudio(request Request) ([]byte, error) {
-	var verb bool
+// GeneratedAudio is a synthesized TTS segment
+type GeneratedAudio struct {
+	Audio  []byte
+	Cached bool         // Served from the audio cache
+	Words  []WordTiming // Word timings, only set when caption alignment is enabled
+	Voice  string       // Voice ID used, differs from the request when a budget fell back to a local voice
+	Model  string       // Model override used, set when a budget downgraded the model
+}
+
+// lookupCachedAudio returns the cached audio and word timings for a request along with its cache key, which is empty when the cache is off
+// Audio from a provider with word timings only counts as cached when its timings are cached too
+func lookupCachedAudio(provider TTSProvider, request Request) (audioData []byte, words []WordTiming, cached bool, cacheKey string) {
+	if !cacheEnabled() {
+		return nil, nil, false, ""
+	}
+	cacheKey = audioCacheKey(provider, request)
+	if request.NoCache {
+		return nil, nil, false, cacheKey
+	}
+	audioData, cached = getCachedAudio(cacheKey)
+	if cached && alignmentEnabled {
+		_, canAlign := provider.(AlignedProvider)
+		var aligned bool
+		words, aligned = getCachedAlignment(cacheKey)
+		if canAlign && !aligned {
+			logger("Cached audio is missing its word timings, generating it again", logDebug, request.Channel)
+			return nil, nil, false, cacheKey
+		}
+	}
+	return audioData, words, cached, cacheKey
+}
+
+// generateAudio synthesizes a TTS segment, serving it from the audio cache when possible
+func generateAudio(request Request) (*GeneratedAudio, error) {
+	var modifiers []AudioModifier
 	if strings.HasPrefix(request.Text, "(reverb) ") {
-		verb = true
+		modifiers = append(modifiers, defaultModifier("reverb"))
 		request.Text = strings.TrimPrefix(request.Text, "(reverb) ")
-	} else {
-		verb = false
 	}
 
 	logger("Generating TTS audio for text: "+request.Text, logDebug, request.Channel)
 
-	voiceModifierList, err := getVoiceModifiers(request.Voice.Voice)
+	provider := getVoiceProvider(request.Voice.Voice, request.Channel)
+	audioData, words, cached, cacheKey := lookupCachedAudio(provider, request)
+
+	// Budgets only apply to audio ElevenLabs will charge for, cached lines still play once a budget is used up
+	if !cached && provider.Name() == elevenLabsProviderName {
+		budgeted, err := applyBudget(request)
+		if err != nil {
+			return nil, err
+		}
+		if budgeted.Voice.Voice != request.Voice.Voice || budgeted.Model != request.Model {
+			request = budgeted
+			provider = getVoiceProvider(request.Voice.Voice, request.Channel)
+			audioData, words, cached, cacheKey = lookupCachedAudio(provider, request)
+		}
+	}
+	if cacheEnabled() {
+		recordCacheResult(cached, len(request.Text))
+	}
+	logger("Using provider: "+provider.Name(), logDebug, request.Channel)
+
+	voiceModifierList, err := getVoiceModifiers(request.Voice.Voice, request.Channel)
 	if err != nil {
 		logger("No voice modifiers found", logDebug, request.Channel)
 	} else {
-		// split the voiceModifierList into a list of voice modifiers by splitting on the comma
-		voiceModifiers := strings.Split(voiceModifierList, ",")
-		for _, modifier := range voiceModifiers {
-			if modifier == "reverb" {
-				verb = true
-			}
+		modifiers = append(modifiers, parseModifierList(voiceModifierList, request.Channel)...)
+	}
+	modifiers = mergeModifiers(modifiers, request.Modifiers)
+
+	aligned, canAlign := provider.(AlignedProvider)
+	if cached {
+		logger("Using cached audio", logDebug, request.Channel)
+	} else if alignmentEnabled && canAlign {
+		audioData, words, err = aligned.GenerateWithAlignment(request)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		audioData, err = provider.Generate(request)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	ctx := context.Background()
-	pipeReader, pipeWriter := io.Pipe()
+	// Check if audio data is empty (can happen with some API errors)
+	if len(audioData) == 0 {
+		voiceName, _ := getVoiceName(request.Voice.Voice, request.Channel)
+		logger(fmt.Sprintf("Empty audio data received | Parameters: text=%q, voice=%s (ID: %s), stability=%.2f, similarity_boost=%.2f",
+			request.Text, voiceName, request.Voice.Voice, request.Voice.Stability, request.Voice.SimilarityBoost), logError, request.Channel)
+		return nil, fmt.Errorf("empty audio data received from TTS provider")
+	}
 
-	var model string
-	voiceModel, err := getVoiceModel(request.Voice.Voice)
-	if err != nil {
-		model = "eleven_v3"
-	}
-
-	if voiceModel != "" {
-		switch voiceModel {
-		case "turbo":
-			model = "eleven_turbo_v2"
-		case "v2":
-			model = "eleven_multilingual_v2"
-		case "v3":
-			model = "eleven_v3"
-		default:
-			model = "eleven_v3"
+	if cacheKey != "" && !cached {
+		storeCachedAudio(cacheKey, audioData, request.Channel)
+		if len(words) > 0 {
+			storeCachedAlignment(cacheKey, words, request.Channel)
 		}
-	} else {
-		model = "eleven_v3"
 	}
 
-	logger("Using model: "+model, logDebug, request.Channel)
+	// Fall back to spreading the words over the clip when the provider has no alignment
+	if alignmentEnabled && len(words) == 0 {
+		duration, err := getAudioDuration(audioData)
+		if err != nil {
+			logger("Error getting audio duration for word timings: "+err.Error(), logDebug, request.Channel)
+		} else {
+			words = estimateWordTimings(request.Text, duration)
+		}
+	}
+
+	if len(modifiers) > 0 {
+		audioData, err = applyModifiers(audioData, modifiers, request.Channel)
+		if err != nil {
+			logger("Error applying voice modifiers to audio: "+err.Error(), logError, request.Channel)
+			return nil, err
+		}
+		if scale := modifierTimeScale(modifiers); scale != 1 && len(words) > 0 {
+			words = shiftWordTimings(words, 0, scale)
+		}
+	}
+
+	return &GeneratedAudio{
+		Audio:  audioData,
+		Cached: cached,
+		Words:  words,
+		Voice:  request.Voice.Voice,
+		Model:  request.Model,
+	}, nil
+}
+
+// elevenLabsProvider generates speech with the ElevenLabs API
+type elevenLabsProvider struct{}
+
+func (elevenLabsProvider) Name() string {
+	return elevenLabsProviderName
+}
+
+func (elevenLabsProvider) Settings(request Request) (string, string) {
+	format, err := getElevenFormat(context.Background())
+	if err != nil {
+		format = ""
+	}
+	return requestModel(request), format
+}
+
+// requestModel returns the ElevenLabs model for a request, honoring a model override
+func requestModel(request Request) string {
+	if request.Model != "" {
+		return request.Model
+	}
+	return getElevenModel(request.Voice.Voice, request.Channel)
+}
+
+// getElevenModel maps the configured model for a voice to an ElevenLabs model ID
+func getElevenModel(voiceID string, channel string) string {
+	voiceModel, err := getVoiceModel(voiceID, channel)
+	if err != nil {
+		return "eleven_v3"
+	}
+
+	switch voiceModel {
+	case "turbo":
+		return "eleven_turbo_v2"
+	case "v2":
+		return "eleven_multilingual_v2"
+	case "v3":
+		return "eleven_v3"
+	default:
+		return "eleven_v3"
+	}
+}
+
+// getElevenFormat returns the output format for the account's subscription tier
+// The tier is looked up at most once an hour instead of once per segment
+func getElevenFormat(ctx context.Context) (string, error) {
+	elevenFormatMutex.Lock()
+	defer elevenFormatMutex.Unlock()
+
+	if elevenFormat != "" && time.Since(elevenFormatTime) < time.Hour {
+		return elevenFormat, nil
+	}
 
 	clientData, err := ttsClient.GetUserInfo(ctx)
 	if err != nil {
-		logger("Error getting user info: "+err.Error(), logError, request.Channel)
-		return nil, err
+		return "", err
 	}
 
 	userTier := strings.TrimSpace(clientData.Subscription.Tier)
-	var format string
 	switch userTier {
 	case "starter":
-		format = "mp3_44100_128"
+		elevenFormat = "mp3_44100_128"
 	case "creator":
-		format = "mp3_44100_192"
+		elevenFormat = "mp3_44100_192"
 	default:
-		format = "mp3_44100_128"
+		elevenFormat = "mp3_44100_128"
+	}
+	elevenFormatTime = time.Now()
+
+	return elevenFormat, nil
+}
+
+// elevenSettings resolves the model, format, stability and style used for an ElevenLabs request
+func elevenSettings(ctx context.Context, request Request) (model string, format string, stability float64, style float64, err error) {
+	model = requestModel(request)
+	logger("Using model: "+model, logDebug, request.Channel)
+
+	format, err = getElevenFormat(ctx)
+	if err != nil {
+		logger("Error getting user info: "+err.Error(), logError, request.Channel)
+		return "", "", 0, 0, err
 	}
 
-	var style float64
-	style, err = getVoiceStyle(request.Voice.Voice)
+	style, err = getVoiceStyle(request.Voice.Voice, request.Channel)
 	if err != nil {
 		style = request.Voice.Style
 	}
 
 	// Adjust stability for v3 model - only accepts 0.0, 0.5, or 1.0
-	stability := request.Voice.Stability
+	stability = request.Voice.Stability
 	if model == "eleven_v3" {
 		if stability < 0.25 {
 			stability = 0.0
@@ -238,6 +401,22 @@ func generateAudio(request Request) ([]byte, error) {
 
 	logger("Using style: "+fmt.Sprintf("%f", style), logDebug, request.Channel)
 	logger("Using stability: "+fmt.Sprintf("%f", stability), logDebug, request.Channel)
+	return model, format, stability, style, nil
+}
+
+// elevenSupportsStyle reports whether a model accepts the style voice setting
+func elevenSupportsStyle(model string) bool {
+	return model != "eleven_v3" && model != "eleven_turbo_v2_5" && model != "eleven_flash_v2_5"
+}
+
+func (elevenLabsProvider) Generate(request Request) ([]byte, error) {
+	ctx := context.Background()
+	pipeReader, pipeWriter := io.Pipe()
+
+	model, format, stability, style, err := elevenSettings(ctx, request)
+	if err != nil {
+		return nil, err
+	}
 
 	// Channel to capture TTS errors from the goroutine
 	errChan := make(chan error, 1)
@@ -252,7 +431,7 @@ func generateAudio(request Request) ([]byte, error) {
 		}
 		if err != nil {
 			// Log detailed parameters when API call fails
-			voiceName, _ := getVoiceName(request.Voice.Voice)
+			voiceName, _ := getVoiceName(request.Voice.Voice, request.Channel)
 			logger(fmt.Sprintf("Error generating TTS audio: %s | Parameters: text=%q, voice=%s (ID: %s), model=%s, stability=%.2f, similarity_boost=%.2f, format=%s",
 				err.Error(), request.Text, voiceName, request.Voice.Voice, model, stability, request.Voice.SimilarityBoost, format), logError, request.Channel)
 			errChan <- err
@@ -274,24 +453,72 @@ func generateAudio(request Request) ([]byte, error) {
 		return nil, ttsErr
 	}
 
-	// Check if audio data is empty (can happen with some API errors)
-	if len(audioData) == 0 {
-		voiceName, _ := getVoiceName(request.Voice.Voice)
-		logger(fmt.Sprintf("Empty audio data received | Parameters: text=%q, voice=%s (ID: %s), stability=%.2f, similarity_boost=%.2f",
-			request.Text, voiceName, request.Voice.Voice, request.Voice.Stability, request.Voice.SimilarityBoost), logError, request.Channel)
-		return nil, fmt.Errorf("empty audio data received from TTS API")
+	return audioData, nil
+}
+
+// GenerateWithAlignment generates speech with the timestamps endpoint, which returns per-character timings
+func (elevenLabsProvider) GenerateWithAlignment(request Request) ([]byte, []WordTiming, error) {
+	ctx := context.Background()
+
+	model, format, stability, style, err := elevenSettings(ctx, request)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if verb {
-		verbAudio := reverb(audioData, request.Channel)
-		if verbAudio == nil {
-			logger("Error applying reverb to audio", logError, request.Channel)
-			return nil, fmt.Errorf("error applying reverb to audio")
-		}
-		audioData = verbAudio
+	voiceSettings := map[string]interface{}{
+		"stability":        stability,
+		"similarity_boost": request.Voice.SimilarityBoost,
+	}
+	if elevenSupportsStyle(model) {
+		voiceSettings["style"] = style
+	}
+	requestBody := map[string]interface{}{
+		"text":           request.Text,
+		"model_id":       model,
+		"voice_settings": voiceSettings,
 	}
 
-	return audioData, nil
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	url := "https://api.elevenlabs.io/v1/text-to-speech/" + request.Voice.Voice + "/with-timestamps?output_format=" + format
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("xi-api-key", elevenKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		voiceName, _ := getVoiceName(request.Voice.Voice, request.Channel)
+		logger(fmt.Sprintf("Error generating TTS audio with timestamps: status %d | Parameters: text=%q, voice=%s (ID: %s), model=%s, stability=%.2f, similarity_boost=%.2f, format=%s",
+			resp.StatusCode, request.Text, voiceName, request.Voice.Voice, model, stability, request.Voice.SimilarityBoost, format), logError, request.Channel)
+		return nil, nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		AudioBase64 string             `json:"audio_base64"`
+		Alignment   characterAlignment `json:"alignment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, err
+	}
+
+	audioData, err := base64.StdEncoding.DecodeString(result.AudioBase64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return audioData, wordsFromAlignment(result.Alignment), nil
 }
 
 // ttsStreamWithoutStyle is a custom TTS function for models that don't support the style parameter (v3, turbo v2.5, flash v2.5)
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	twitchChannels []TwitchChannel
+	twitchServer   = "ircs://irc.chat.twitch.tv:6697"
+	twitchNick     string
+	twitchToken    string
+
+	// twitchReconnectDelay keeps a refused connection from hammering the server
+	twitchReconnectDelay = 5 * time.Second
+
+	errTwitchReconnect = errors.New("server asked to reconnect")
+)
+
+// Chat badges that can be allowed to use the command
+const (
+	badgeBroadcaster = "broadcaster"
+	badgeModerator   = "moderator"
+	badgeVIP         = "vip"
+	badgeSubscriber  = "subscriber"
+	badgeEveryone    = "everyone"
+)
+
+// TwitchChannel is a Twitch chat to listen to, messages are played on the TTS channel with the same name
+type TwitchChannel struct {
+	Channel string   `json:"channel"`
+	Command string   `json:"command"` // Command prefix, default !tts
+	Allowed []string `json:"allowed"` // Badges that may use the command, the broadcaster always can (default everyone)
+	Voice   string   `json:"voice"`   // Default voice for chat messages
+}
+
+// ircMessage is a parsed IRC line
+type ircMessage struct {
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+func setupTwitchChat() {
+	config := getSetting("TWITCH_CHANNELS")
+	if config == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(config), &twitchChannels)
+	if err != nil {
+		logger("Error unmarshalling Twitch channels: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range twitchChannels {
+		twitchChannels[i].Channel = strings.ToLower(strings.TrimPrefix(twitchChannels[i].Channel, "#"))
+		if twitchChannels[i].Command == "" {
+			twitchChannels[i].Command = "!tts"
+		}
+		if len(twitchChannels[i].Allowed) == 0 {
+			twitchChannels[i].Allowed = []string{badgeEveryone}
+		}
+	}
+
+	if server := getSetting("TWITCH_IRC_SERVER"); server != "" {
+		twitchServer = server
+	}
+	twitchNick = strings.ToLower(getSetting("TWITCH_IRC_NICK"))
+	twitchToken = strings.TrimPrefix(getSetting("TWITCH_IRC_TOKEN"), "oauth:")
+	if twitchNick == "" || twitchToken == "" {
+		// Anonymous logins can read chat but not send to it
+		twitchNick = "justinfan" + fmt.Sprintf("%05d", time.Now().UnixNano()%100000)
+		twitchToken = ""
+	}
+
+	go connectToTwitchChat()
+}
+
+func getTwitchChannel(channel string) (TwitchChannel, bool) {
+	for _, twitchChannel := range twitchChannels {
+		if twitchChannel.Channel == channel {
+			return twitchChannel, true
+		}
+	}
+	return TwitchChannel{}, false
+}
+
+func connectToTwitchChat() {
+	logger("Connecting to Twitch chat", logInfo, "Universal")
+	for {
+		if err := attemptConnectToTwitchChat(); err != nil {
+			time.Sleep(twitchReconnectDelay)
+			continue
+		} else {
+			logger("Twitch chat connection closed normally.", logInfo, "Universal")
+			return
+		}
+	}
+}
+
+// dialTwitchChat connects to the configured server, ircs:// uses TLS and irc:// doesn't, e.g. for a local test server
+func dialTwitchChat() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if address, plain := strings.CutPrefix(twitchServer, "irc://"); plain {
+		return dialer.Dial("tcp", address)
+	}
+	address := strings.TrimPrefix(twitchServer, "ircs://")
+	return tls.DialWithDialer(dialer, "tcp", address, nil)
+}
+
+func attemptConnectToTwitchChat() error {
+	conn, err := dialTwitchChat()
+	if err != nil {
+		logger("Error connecting to Twitch chat: "+err.Error(), logError, "Universal")
+		return err
+	}
+	defer conn.Close()
+
+	var joins []string
+	for _, twitchChannel := range twitchChannels {
+		joins = append(joins, "#"+twitchChannel.Channel)
+	}
+	login := []string{"CAP REQ :twitch.tv/tags twitch.tv/commands"}
+	if twitchToken != "" {
+		login = append(login, "PASS oauth:"+twitchToken)
+	}
+	login = append(login, "NICK "+twitchNick, "JOIN "+strings.Join(joins, ","))
+	for _, line := range login {
+		if _, err := fmt.Fprintf(conn, "%s\r\n", line); err != nil {
+			logger("Error logging in to Twitch chat: "+err.Error(), logError, "Universal")
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		// Twitch pings about every five minutes, so a longer silence means the connection is gone
+		conn.SetReadDeadline(time.Now().Add(6 * time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				logger("Twitch chat connection closed, reconnecting", logInfo, "Universal")
+			} else {
+				logger("Error reading from Twitch chat: "+err.Error(), logError, "Universal")
+			}
+			return err
+		}
+
+		message, ok := parseIRCMessage(strings.TrimRight(line, "\r\n"))
+		if !ok {
+			continue
+		}
+		switch message.Command {
+		case "PING":
+			logger("Received ping from Twitch chat", logFountain, "Universal")
+			if _, err := fmt.Fprintf(conn, "PONG :%s\r\n", message.trailing()); err != nil {
+				return err
+			}
+		case "RECONNECT":
+			logger("Twitch chat asked to reconnect", logInfo, "Universal")
+			return errTwitchReconnect
+		case "NOTICE":
+			logger("Twitch chat notice: "+message.trailing(), logInfo, "Universal")
+		case "JOIN":
+			if message.nick() == twitchNick && len(message.Params) > 0 {
+				logger("Joined Twitch chat", logInfo, strings.TrimPrefix(message.Params[0], "#"))
+			}
+		case "PRIVMSG":
+			if len(message.Params) < 2 {
+				continue
+			}
+			handleTwitchChatMessage(message)
+		}
+	}
+}
+
+// parseIRCMessage splits a line into IRCv3 tags, prefix, command and parameters
+func parseIRCMessage(line string) (ircMessage, bool) {
+	message := ircMessage{Tags: make(map[string]string)}
+	if line == "" {
+		return message, false
+	}
+
+	if strings.HasPrefix(line, "@") {
+		tags, rest, found := strings.Cut(line[1:], " ")
+		if !found {
+			return message, false
+		}
+		for _, tag := range strings.Split(tags, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			message.Tags[key] = unescapeTagValue(value)
+		}
+		line = rest
+	}
+
+	if strings.HasPrefix(line, ":") {
+		prefix, rest, found := strings.Cut(line[1:], " ")
+		if !found {
+			return message, false
+		}
+		message.Prefix = prefix
+		line = rest
+	}
+
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	if strings.HasPrefix(line, ":") {
+		// No middle parameters, the whole rest is trailing
+		trailing, hasTrailing = line[1:], true
+		line = ""
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return message, false
+	}
+	message.Command = strings.ToUpper(fields[0])
+	message.Params = fields[1:]
+	if hasTrailing {
+		message.Params = append(message.Params, trailing)
+	}
+	return message, true
+}
+
+// unescapeTagValue undoes the IRCv3 tag value escaping
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			builder.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case ':':
+			builder.WriteByte(';')
+		case 's':
+			builder.WriteByte(' ')
+		case 'r':
+			builder.WriteByte('\r')
+		case 'n':
+			builder.WriteByte('\n')
+		default:
+			builder.WriteByte(value[i])
+		}
+	}
+	return builder.String()
+}
+
+func (message ircMessage) trailing() string {
+	if len(message.Params) == 0 {
+		return ""
+	}
+	return message.Params[len(message.Params)-1]
+}
+
+// nick returns the sender's login name from the prefix
+func (message ircMessage) nick() string {
+	nick, _, _ := strings.Cut(message.Prefix, "!")
+	return strings.ToLower(nick)
+}
+
+// badges returns the chat badges of the sender
+func (message ircMessage) badges() map[string]bool {
+	badges := make(map[string]bool)
+	for _, badge := range strings.Split(message.Tags["badges"], ",") {
+		name, _, _ := strings.Cut(badge, "/")
+		if name != "" {
+			badges[name] = true
+		}
+	}
+	// Founders are subscribers too
+	if badges["founder"] {
+		badges[badgeSubscriber] = true
+	}
+	if message.Tags["mod"] == "1" {
+		badges[badgeModerator] = true
+	}
+	return badges
+}
+
+// twitchChatAllowed reports whether the sender has one of the badges allowed to use the command
+func twitchChatAllowed(twitchChannel TwitchChannel, message ircMessage) bool {
+	badges := message.badges()
+	if badges[badgeBroadcaster] {
+		return true
+	}
+	for _, allowed := range twitchChannel.Allowed {
+		allowed = strings.ToLower(allowed)
+		if allowed == badgeEveryone || badges[allowed] {
+			return true
+		}
+	}
+	return false
+}
+
+func handleTwitchChatMessage(message ircMessage) {
+	channel := strings.ToLower(strings.TrimPrefix(message.Params[0], "#"))
+	twitchChannel, ok := getTwitchChannel(channel)
+	if !ok {
+		return
+	}
+
+	command, text, _ := strings.Cut(strings.TrimSpace(message.trailing()), " ")
+	if !strings.EqualFold(command, twitchChannel.Command) {
+		return
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+
+	user := message.Tags["display-name"]
+	if user == "" {
+		user = message.nick()
+	}
+	if !twitchChatAllowed(twitchChannel, message) {
+		logger(user+" isn't allowed to use "+twitchChannel.Command, logDebug, channel)
+		return
+	}
+	logger("Received Twitch chat command from "+user, logInfo, channel)
+
+	if !channelHasClient(channel) {
+		logger("No connected client", logInfo, channel)
+		return
+	}
+	if budgetRejects(channel) {
+		logger("Character budget exhausted, ignoring Twitch chat message", logInfo, channel)
+		return
+	}
+
+	moderation := moderateMessage(channel, text, sourceTwitch)
+	if moderation.Rejected {
+		logger("Twitch chat message from "+user+" rejected by moderation", logInfo, channel)
+		return
+	}
+
+	stability, similarityBoost, style := getVoiceSettings(channel)
+	msg := Message{
+		Channel:         channel,
+		Text:            moderation.Text,
+		DefaultVoice:    twitchChannel.Voice,
+		Stability:       stability,
+		SimilarityBoost: similarityBoost,
+		Style:           style,
+		Stitch:          readConfig(&stitchEnabled),
+		User:            user,
+	}
+
+	// Parse up front so invalid messages are dropped before they are queued
+	segments, err := ParseMessage(msg)
+	if err != nil {
+		logger("Error parsing Twitch chat message: "+err.Error(), logInfo, channel)
+		return
+	}
+	if _, err := applyMessageLimits(channel, segments, false); err != nil {
+		logger("Twitch chat message over the message limits, ignoring", logInfo, channel)
+		return
+	}
+	if _, ok := checkRateLimit(channel, user); !ok {
+		logger("Rate limited Twitch chat message from "+user, logInfo, channel)
+		return
+	}
+
+	if shouldHold(channel, sourceTwitch, user, 0, false) {
+		_, err = holdMessage(msg, sourceTwitch, user, 0)
+	} else {
+		_, _, err = enqueueMessage(msg)
+	}
+	if err != nil {
+		logger("Error queueing Twitch chat message: "+err.Error(), logError, channel)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIRCServer accepts Twitch chat connections on a local port
+type fakeIRCServer struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func startFakeIRCServer(t *testing.T) *fakeIRCServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	server := &fakeIRCServer{listener: listener, conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.conns <- conn
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+// accept waits for the next client connection
+func (server *fakeIRCServer) accept(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	select {
+	case conn := <-server.conns:
+		return conn, bufio.NewReader(conn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a connection")
+		return nil, nil
+	}
+}
+
+// readLine reads one line sent by the client without its line ending
+func readLine(t *testing.T, conn net.Conn, reader *bufio.Reader) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading from client: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// expectLines fails unless the client sends exactly these lines next
+func expectLines(t *testing.T, conn net.Conn, reader *bufio.Reader, want ...string) {
+	t.Helper()
+	for _, expected := range want {
+		if line := readLine(t, conn, reader); line != expected {
+			t.Fatalf("got line %q, want %q", line, expected)
+		}
+	}
+}
+
+// useTwitchChat points the Twitch chat settings at the fake server for one test
+func useTwitchChat(t *testing.T, server *fakeIRCServer, nick string, token string) {
+	t.Helper()
+	oldChannels, oldServer, oldNick, oldToken, oldDelay := twitchChannels, twitchServer, twitchNick, twitchToken, twitchReconnectDelay
+	t.Cleanup(func() {
+		twitchChannels, twitchServer, twitchNick, twitchToken, twitchReconnectDelay = oldChannels, oldServer, oldNick, oldToken, oldDelay
+	})
+
+	t.Setenv("TWITCH_IRC_SERVER", "irc://"+server.listener.Addr().String())
+	twitchServer = getSetting("TWITCH_IRC_SERVER")
+	twitchChannels = []TwitchChannel{{Channel: "streamer"}, {Channel: "other"}}
+	twitchNick = nick
+	twitchToken = token
+}
+
+func TestTwitchChatLogin(t *testing.T) {
+	tests := []struct {
+		name  string
+		nick  string
+		token string
+		want  []string
+	}{
+		{
+			name:  "authenticated",
+			nick:  "ttsbot",
+			token: "secret",
+			want: []string{
+				"CAP REQ :twitch.tv/tags twitch.tv/commands",
+				"PASS oauth:secret",
+				"NICK ttsbot",
+				"JOIN #streamer,#other",
+			},
+		},
+		{
+			name: "anonymous",
+			nick: "justinfan12345",
+			want: []string{
+				"CAP REQ :twitch.tv/tags twitch.tv/commands",
+				"NICK justinfan12345",
+				"JOIN #streamer,#other",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startFakeIRCServer(t)
+			useTwitchChat(t, server, test.nick, test.token)
+
+			done := make(chan error, 1)
+			go func() { done <- attemptConnectToTwitchChat() }()
+
+			conn, reader := server.accept(t)
+			defer conn.Close()
+			expectLines(t, conn, reader, test.want...)
+
+			conn.Write([]byte("PING :tmi.twitch.tv\r\n"))
+			expectLines(t, conn, reader, "PONG :tmi.twitch.tv")
+
+			conn.Write([]byte(":tmi.twitch.tv RECONNECT\r\n"))
+			select {
+			case err := <-done:
+				if !errors.Is(err, errTwitchReconnect) {
+					t.Fatalf("got error %v, want %v", err, errTwitchReconnect)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("client didn't disconnect after RECONNECT")
+			}
+		})
+	}
+}
+
+func TestTwitchChatReconnect(t *testing.T) {
+	server := startFakeIRCServer(t)
+	useTwitchChat(t, server, "ttsbot", "secret")
+	twitchReconnectDelay = 10 * time.Millisecond
+	login := []string{
+		"CAP REQ :twitch.tv/tags twitch.tv/commands",
+		"PASS oauth:secret",
+		"NICK ttsbot",
+		"JOIN #streamer,#other",
+	}
+
+	go connectToTwitchChat()
+
+	// Asked to reconnect
+	conn, reader := server.accept(t)
+	expectLines(t, conn, reader, login...)
+	conn.Write([]byte(":tmi.twitch.tv RECONNECT\r\n"))
+
+	// Dropped by the server
+	conn, reader = server.accept(t)
+	expectLines(t, conn, reader, login...)
+	conn.Close()
+
+	// The last connection is left open so the client stops retrying once the test ends
+	conn, reader = server.accept(t)
+	expectLines(t, conn, reader, login...)
+	conn.Write([]byte("PING :tmi.twitch.tv\r\n"))
+	expectLines(t, conn, reader, "PONG :tmi.twitch.tv")
+}
+
+func TestParseIRCMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+		want ircMessage
+	}{
+		{
+			name: "privmsg with tags",
+			line: `@badge-info=subscriber/8;badges=subscriber/6,vip/1;display-name=Some\sViewer;mod=0 :someviewer!someviewer@someviewer.tmi.twitch.tv PRIVMSG #streamer :!tts hello there`,
+			ok:   true,
+			want: ircMessage{
+				Tags: map[string]string{
+					"badge-info":   "subscriber/8",
+					"badges":       "subscriber/6,vip/1",
+					"display-name": "Some Viewer",
+					"mod":          "0",
+				},
+				Prefix:  "someviewer!someviewer@someviewer.tmi.twitch.tv",
+				Command: "PRIVMSG",
+				Params:  []string{"#streamer", "!tts hello there"},
+			},
+		},
+		{
+			name: "ping",
+			line: "PING :tmi.twitch.tv",
+			ok:   true,
+			want: ircMessage{Tags: map[string]string{}, Command: "PING", Params: []string{"tmi.twitch.tv"}},
+		},
+		{
+			name: "no parameters",
+			line: ":tmi.twitch.tv RECONNECT",
+			ok:   true,
+			want: ircMessage{Tags: map[string]string{}, Prefix: "tmi.twitch.tv", Command: "RECONNECT", Params: []string{}},
+		},
+		{
+			name: "middle parameters only",
+			line: ":ttsbot!ttsbot@ttsbot.tmi.twitch.tv join #streamer",
+			ok:   true,
+			want: ircMessage{Tags: map[string]string{}, Prefix: "ttsbot!ttsbot@ttsbot.tmi.twitch.tv", Command: "JOIN", Params: []string{"#streamer"}},
+		},
+		{
+			name: "trailing keeps colons and spaces",
+			line: ":tmi.twitch.tv NOTICE * :Login  failed: bad token",
+			ok:   true,
+			want: ircMessage{Tags: map[string]string{}, Prefix: "tmi.twitch.tv", Command: "NOTICE", Params: []string{"*", "Login  failed: bad token"}},
+		},
+		{name: "empty", line: ""},
+		{name: "tags only", line: "@badges=vip/1"},
+		{name: "prefix only", line: ":tmi.twitch.tv"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, ok := parseIRCMessage(test.line)
+			if ok != test.ok {
+				t.Fatalf("got ok %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(message, test.want) {
+				t.Fatalf("got %+v, want %+v", message, test.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`plain`, "plain"},
+		{`Hello\sworld`, "Hello world"},
+		{`a\:b`, "a;b"},
+		{`back\\slash`, `back\slash`},
+		{`line\r\nbreak`, "line\r\nbreak"},
+		{`unknown\qescape`, "unknownqescape"},
+		{`trailing\`, `trailing\`},
+	}
+
+	for _, test := range tests {
+		if got := unescapeTagValue(test.value); got != test.want {
+			t.Errorf("unescapeTagValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTwitchChatAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		tags    string
+		want    bool
+	}{
+		{"everyone", []string{badgeEveryone}, "badges=", true},
+		{"broadcaster always allowed", []string{badgeVIP}, "badges=broadcaster/1", true},
+		{"subscriber", []string{badgeSubscriber}, "badges=subscriber/12", true},
+		{"founder counts as subscriber", []string{badgeSubscriber}, "badges=founder/0", true},
+		{"vip with other badges", []string{badgeSubscriber, badgeVIP}, "badges=vip/1,premium/1", true},
+		{"allowed badges are case insensitive", []string{"VIP"}, "badges=vip/1", true},
+		{"moderator from mod tag", []string{badgeModerator}, "badges=;mod=1", true},
+		{"moderator badge", []string{badgeModerator}, "badges=moderator/1", true},
+		{"missing badge", []string{badgeSubscriber, badgeVIP}, "badges=moderator/1", false},
+		{"no badges", []string{badgeSubscriber}, "badges=;mod=0", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, ok := parseIRCMessage("@" + test.tags + " :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #streamer :!tts hi")
+			if !ok {
+				t.Fatal("couldn't parse test message")
+			}
+			twitchChannel := TwitchChannel{Channel: "streamer", Command: "!tts", Allowed: test.allowed}
+			if got := twitchChatAllowed(twitchChannel, message); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+var voiceCatalogs []VoiceCatalog
+
+// Settings used when neither the request nor the channel's catalog sets them
+const (
+	defaultStability       = 0.40
+	defaultSimilarityBoost = 1.00
+	defaultStyle           = 0.00
+)
+
+// VoiceCatalog gives a channel its own voices and defaults, anything it leaves out comes from the global settings
+type VoiceCatalog struct {
+	Channel         string          `json:"channel"`
+	Voices          []Voice         `json:"voices"`         // Voices only this channel can use, e.g. private clones
+	IncludeGlobal   *bool           `json:"include_global"` // Also offer the global VOICES (default true)
+	DefaultVoice    string          `json:"default_voice"`  // Voice used when a message doesn't pick one
+	Stability       *float64        `json:"stability"`
+	SimilarityBoost *float64        `json:"similarity_boost"`
+	Style           *float64        `json:"style"`
+	Models          []VoiceModel    `json:"models"`    // Same format as VOICE_MODELS
+	Styles          []VoiceStyle    `json:"styles"`    // Same format as VOICE_STYLES
+	Modifiers       []VoiceModifier `json:"modifiers"` // Same format as VOICE_MODIFIERS
+}
+
+func setupVoiceCatalogs() {
+	voiceCatalogs = nil
+	catalogs := getSetting("VOICE_CATALOGS")
+	if catalogs == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(catalogs), &voiceCatalogs)
+	if err != nil {
+		logger("Error unmarshalling voice catalogs: "+err.Error(), logError, "Universal")
+		return
+	}
+	for i := range voiceCatalogs {
+		voiceCatalogs[i].Channel = strings.ToLower(voiceCatalogs[i].Channel)
+		if voiceCatalogs[i].DefaultVoice != "" && !voiceCatalogs[i].hasVoice(voiceCatalogs[i].DefaultVoice) {
+			logger("Default voice "+voiceCatalogs[i].DefaultVoice+" is not in the channel's catalog", logError, voiceCatalogs[i].Channel)
+		}
+	}
+}
+
+// hasVoice reports whether a voice can be used with the catalog
+// It reads the globals directly so it can run while a reload holds configMutex
+func (catalog *VoiceCatalog) hasVoice(name string) bool {
+	list := catalog.Voices
+	if catalog.IncludeGlobal == nil || *catalog.IncludeGlobal {
+		list = append(append([]Voice{}, list...), voices...)
+	}
+	for _, v := range list {
+		if strings.EqualFold(v.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getVoiceCatalog returns a channel's catalog, or nil if it only uses the global voices
+func getVoiceCatalog(channel string) *VoiceCatalog {
+	channel = strings.ToLower(channel)
+	catalogs := readConfig(&voiceCatalogs)
+	for i := range catalogs {
+		if catalogs[i].Channel == channel {
+			return &catalogs[i]
+		}
+	}
+	return nil
+}
+
+// channelVoices returns the voices a channel can use, its own voices first so they win over global voices with the same name
+func channelVoices(channel string) []Voice {
+	global := readConfig(&voices)
+	catalog := getVoiceCatalog(channel)
+	if catalog == nil {
+		return global
+	}
+	if catalog.IncludeGlobal != nil && !*catalog.IncludeGlobal {
+		return catalog.Voices
+	}
+	list := make([]Voice, 0, len(catalog.Voices)+len(global))
+	list = append(list, catalog.Voices...)
+	return append(list, global...)
+}
+
+// findVoiceByID looks up a voice in a channel's catalog and then the global voices
+func findVoiceByID(ID string, channel string) (Voice, bool) {
+	for _, v := range channelVoices(channel) {
+		if v.ID == ID {
+			return v, true
+		}
+	}
+	// Voices picked before a catalog change or by a budget fallback may not be in the catalog
+	for _, v := range readConfig(&voices) {
+		if v.ID == ID {
+			return v, true
+		}
+	}
+	return Voice{}, false
+}
+
+// voiceNameInUse reports whether any channel has a voice with the name
+func voiceNameInUse(name string) bool {
+	if validVoice(name, "") {
+		return true
+	}
+	for _, catalog := range readConfig(&voiceCatalogs) {
+		for _, v := range catalog.Voices {
+			if strings.EqualFold(v.Name, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getDefaultVoice returns the voice a channel uses when a message doesn't pick one
+func getDefaultVoice(channel string) (name string, ID string) {
+	catalog := getVoiceCatalog(channel)
+	if catalog == nil {
+		return globalDefaultVoice()
+	}
+	if catalog.DefaultVoice != "" {
+		if id, err := getVoiceID(catalog.DefaultVoice, channel); err == nil {
+			return catalog.DefaultVoice, id
+		}
+	}
+	if list := channelVoices(channel); len(list) > 0 {
+		return list[0].Name, list[0].ID
+	}
+	return globalDefaultVoice()
+}
+
+// globalDefaultVoice returns the first of the global voices
+func globalDefaultVoice() (name string, ID string) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return defaultVoice, defaultVoiceID
+}
+
+// getVoiceSettings returns a channel's default stability, similarity boost and style
+func getVoiceSettings(channel string) (stability float64, similarityBoost float64, style float64) {
+	stability, similarityBoost, style = defaultStability, defaultSimilarityBoost, defaultStyle
+	catalog := getVoiceCatalog(channel)
+	if catalog == nil {
+		return
+	}
+	if catalog.Stability != nil {
+		stability = *catalog.Stability
+	}
+	if catalog.SimilarityBoost != nil {
+		similarityBoost = *catalog.SimilarityBoost
+	}
+	if catalog.Style != nil {
+		style = *catalog.Style
+	}
+	return
+}
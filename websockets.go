@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,11 +13,12 @@ import (
 )
 
 var (
-	clients       = make(map[*websocket.Conn]string)
+	clients = make(map[*websocket.Conn]string)
+	// clientInfos holds what each client negotiated when it connected
+	clientInfos   = make(map[*websocket.Conn]ClientInfo)
 	addrToNameMap = make(map[string]string)
 	mapMutex      = sync.Mutex{}
 	connMutex     = sync.Mutex{}
-	playing       = make(map[string]bool)
 )
 
 func generateRandomName() string {
@@ -41,6 +43,84 @@ func getClientName(remoteAddr string) string {
 	return name
 }
 
+// channelHasClient reports whether any audio overlay is connected for the channel
+func channelHasClient(channel string) bool {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	for client, clientChannel := range clients {
+		if clientChannel == channel && !clientInfos[client].CaptionsOnly {
+			clientName := getClientName(fmt.Sprintf("%p", client))
+			logger("Found client "+clientName, logDebug, channel)
+			return true
+		}
+	}
+	return false
+}
+
+// ClientInfo describes a connected overlay
+type ClientInfo struct {
+	Protocol int
+	// CaptionsOnly clients only show captions, they get no audio and never confirm playback
+	CaptionsOnly bool
+	// writeMutex is held while writing, gorilla/websocket allows only one writer per connection
+	writeMutex *sync.Mutex
+}
+
+// channelClients returns the clients connected for a channel, copied so they can be written to without holding connMutex
+// audioOnly leaves out caption-only clients
+func channelClients(channel string, audioOnly bool) []*websocket.Conn {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	var list []*websocket.Conn
+	for client, clientChannel := range clients {
+		if clientChannel == channel && !(audioOnly && clientInfos[client].CaptionsOnly) {
+			list = append(list, client)
+		}
+	}
+	return list
+}
+
+// hasClients reports whether any client is connected at all
+func hasClients() bool {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	return len(clients) > 0
+}
+
+// writeToClient sends a message to a client
+// Control requests, the queue worker and alerts write from their own goroutines, so every write goes through here
+func writeToClient(conn *websocket.Conn, messageType int, data []byte) error {
+	connMutex.Lock()
+	info, ok := clientInfos[conn]
+	connMutex.Unlock()
+	if !ok {
+		return errors.New("client disconnected")
+	}
+	info.writeMutex.Lock()
+	defer info.writeMutex.Unlock()
+	return conn.WriteMessage(messageType, data)
+}
+
+// getClientProtocol returns the protocol version a client negotiated
+func getClientProtocol(conn *websocket.Conn) int {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	info, ok := clientInfos[conn]
+	if !ok {
+		return protocolLegacy
+	}
+	return info.Protocol
+}
+
+// removeClient closes a client connection and forgets it
+func removeClient(conn *websocket.Conn) {
+	conn.Close()
+	connMutex.Lock()
+	delete(clients, conn)
+	delete(clientInfos, conn)
+	connMutex.Unlock()
+}
+
 func clearChannelRequests(channel string) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -68,9 +148,17 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	hash := r.URL.Query().Get("v")
-	currentHash, err := ComputeMD5("static/index.html")
+	protocol := parseProtocolVersion(r.URL.Query().Get("protocol"))
+	captionsOnly := r.URL.Query().Get("role") == "captions"
+	page := "static/index.html"
+	if captionsOnly {
+		// Caption sources always speak the JSON protocol
+		page = "static/captions.html"
+		protocol = protocolJSON
+	}
+	currentHash, err := ComputeMD5(page)
 	if err != nil {
-		logger("Error computing hash for index.html: "+err.Error(), logError, channel)
+		logger("Error computing hash for "+page+": "+err.Error(), logError, channel)
 		return
 	}
 
@@ -78,16 +166,22 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if hash != currentHash {
 		logger(clientName+" connected with outdated version: "+hash+" (current: "+currentHash+")", logInfo, channel)
 		logger("Sending update message to "+clientName+": "+currentHash, logInfo, channel)
-		err := conn.WriteMessage(websocket.TextMessage, []byte("update "+currentHash))
+		update, _ := encodeControlMessage(ControlMessage{Type: controlUpdate, Hash: currentHash}, protocol)
+		err := conn.WriteMessage(websocket.TextMessage, update)
 		if err != nil {
 			logger("Error sending update message to client: "+err.Error(), logError, channel)
 		}
 		conn.Close()
 		return
 	}
-	logger("Client "+clientName+" connected", logInfo, channel)
+	if captionsOnly {
+		logger("Caption client "+clientName+" connected", logInfo, channel)
+	} else {
+		logger(fmt.Sprintf("Client %s connected using protocol v%d", clientName, protocol), logInfo, channel)
+	}
 	connMutex.Lock()
 	clients[conn] = channel
+	clientInfos[conn] = ClientInfo{Protocol: protocol, CaptionsOnly: captionsOnly, writeMutex: &sync.Mutex{}}
 	connMutex.Unlock()
 
 	// Read messages from the client
@@ -100,10 +194,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				case <-clientPingTicker.C:
 					logger("Ping not received, closing connection for client "+clientName, logInfo, channel)
 					clearChannelRequests(channel)
-					conn.Close()
-					connMutex.Lock()
-					delete(clients, conn)
-					connMutex.Unlock()
+					removeClient(conn)
 					//remove clientname from map
 					mapMutex.Lock()
 					delete(addrToNameMap, fmt.Sprintf("%p", conn))
@@ -122,10 +213,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				} else {
 					logger("Error reading message from client "+clientName+": "+err.Error(), logError, channel)
 				}
-				conn.Close()
-				connMutex.Lock()
-				delete(clients, conn)
-				connMutex.Unlock()
+				removeClient(conn)
 				//remove clientname from map
 				mapMutex.Lock()
 				delete(addrToNameMap, fmt.Sprintf("%p", conn))
@@ -135,32 +223,31 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 			switch messageType {
 			case websocket.TextMessage:
-				message := string(messageBytes)
-				if message == "ping" {
+				message, err := decodeControlMessage(string(messageBytes))
+				if err != nil {
+					logger("Invalid message from "+clientName+": "+err.Error(), logDebug, channel)
+					continue
+				}
+				switch message.Type {
+				case controlPing:
 					logger("Received ping from "+clientName, logFountain, channel)
 					clientPingTicker.Reset(60 * time.Second)
-				} else if message == "close" {
+				case controlClose:
 					logger("Client "+clientName+" closed the connection", logInfo, channel)
 					clearChannelRequests(channel)
-					conn.Close()
-					connMutex.Lock()
-					delete(clients, conn)
-					connMutex.Unlock()
+					removeClient(conn)
 					//remove clientname from map
 					mapMutex.Lock()
 					delete(addrToNameMap, fmt.Sprintf("%p", conn))
 					mapMutex.Unlock()
 					return
-				} else if strings.Contains(message, "confirm") {
-					// split the message by spaces and get the last element
-					// this is the timestamp of the audio that the client is confirming
-					timestamp := strings.Split(message, " ")[1]
-					requestName := getAudioDataName(timestamp)
-					logger("Client "+clientName+" confirmed playing audio for "+requestName, logInfo, channel)
-					// remove timestamp from playing map
-					delete(playing, timestamp)
-				} else {
-					logger("Unknown message from "+clientName+": "+message, logDebug, channel)
+				case controlConfirm:
+					// the job ID is the timestamp of the audio that the client is confirming
+					requestName := getAudioDataName(message.JobID)
+					logger(fmt.Sprintf("Client %s confirmed playing segment %d of %s", clientName, message.Segment, requestName), logInfo, channel)
+					finishPlayback(channel, message.JobID, nil)
+				default:
+					logger("Unknown message from "+clientName+": "+string(messageBytes), logDebug, channel)
 				}
 			case websocket.BinaryMessage:
 				logger("Received binary message from "+clientName, logDebug, channel)
@@ -170,20 +257,3 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		}
 	}(clientName, channel, conn)
 }
-
-func sendTextMessage(channel string, message string) {
-	for client, clientChannel := range clients {
-		if clientChannel == channel {
-			clientName := getClientName(fmt.Sprintf("%p", client))
-			err := client.WriteMessage(websocket.TextMessage, []byte(message))
-			if err != nil {
-				logger("Error sending text message to "+clientName+": "+err.Error(), logError, channel)
-				client.Close()
-				connMutex.Lock()
-				delete(clients, client)
-				connMutex.Unlock()
-			}
-			logger("Text message sent to "+clientName, logInfo, channel)
-		}
-	}
-}